@@ -5,8 +5,12 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/StackPointCloud/digitalocean-flex-volume/pkg/digitalocean/cloud"
+	"github.com/StackPointCloud/digitalocean-flex-volume/pkg/digitalocean/plugin"
 	"github.com/golang/glog"
 )
 
@@ -14,6 +18,10 @@ const (
 	tokenFileEnv         = "DIGITALOCEAN_TOKEN_FILE_PATH"
 	tokenEnv             = "DIGITALOCEAN_TOKEN"
 	tokenDefaultLocation = "/etc/kubernetes/digitalocean.json"
+	apiURLEnv            = "DIGITALOCEAN_API_URL"
+	metadataURLEnv       = "DIGITALOCEAN_METADATA_URL"
+	cacheBypassEnv       = "DIGITALOCEAN_CACHE_BYPASS"
+	mounterEnv           = "DIGITALOCEAN_MOUNTER"
 )
 
 // GetDigitalOceanToken uses environment variables to locate a Digital Ocean
@@ -49,19 +57,244 @@ func GetDigitalOceanToken() (string, error) {
 	return "", fmt.Errorf("No valid Digital Ocean tokens were found: %s", err)
 }
 
+// GetManagerOptions uses environment variables to override the
+// DigitalOcean API and metadata service endpoints and to bypass the cache,
+// and the configuration file, if it exists, to override other defaults
+func GetManagerOptions() (*cloud.ManagerOptions, error) {
+	options := &cloud.ManagerOptions{
+		APIURL:      strings.TrimSpace(os.Getenv(apiURLEnv)),
+		MetadataURL: strings.TrimSpace(os.Getenv(metadataURLEnv)),
+		ActionPoll:  cloud.DefaultPollOptions(),
+		Retry:       cloud.DefaultRetryOptions(),
+		Cache:       cloud.DefaultCacheOptions(),
+	}
+
+	if v := strings.TrimSpace(os.Getenv(cacheBypassEnv)); v != "" {
+		bypass, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q: %s", cacheBypassEnv, v, err.Error())
+		}
+		options.Cache.Bypass = bypass
+	}
+
+	c, err := ReadConfigFile(configFile())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return options, nil
+		}
+		return nil, err
+	}
+
+	if c.ActionPoll != nil {
+		if err := c.ActionPoll.apply(&options.ActionPoll); err != nil {
+			return nil, err
+		}
+	}
+
+	if c.Retry != nil {
+		if err := c.Retry.apply(&options.Retry); err != nil {
+			return nil, err
+		}
+	}
+
+	if c.Cache != nil {
+		if err := c.Cache.apply(&options.Cache); err != nil {
+			return nil, err
+		}
+	}
+
+	options.NodeMatchers = c.NodeMatchers
+	options.NodeMappingFile = c.NodeMappingFile
+
+	return options, nil
+}
+
+// GetPluginOptions uses the configuration file, if it exists, and then
+// environment variables to override the plugin defaults
+func GetPluginOptions() (*plugin.Options, error) {
+	options := plugin.DefaultOptions()
+
+	c, err := ReadConfigFile(configFile())
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if c != nil {
+		if c.Mounter != "" {
+			options.Mounter = c.Mounter
+		}
+		if c.Fsck != "" {
+			options.Fsck = c.Fsck
+		}
+		options.MkfsOptions = c.MkfsOptions
+		options.KeyDir = c.LUKSKeyDir
+		if c.AttachTimeout != "" {
+			d, err := time.ParseDuration(c.AttachTimeout)
+			if err != nil || d <= 0 {
+				return nil, fmt.Errorf("invalid attachTimeout %q", c.AttachTimeout)
+			}
+			options.AttachTimeout = d
+		}
+	}
+
+	if v := strings.TrimSpace(os.Getenv(mounterEnv)); v != "" {
+		options.Mounter = v
+	}
+
+	switch options.Mounter {
+	case plugin.MounterNative, plugin.MounterExec:
+	default:
+		return nil, fmt.Errorf("invalid mounter %q, expected %s or %s", options.Mounter, plugin.MounterNative, plugin.MounterExec)
+	}
+
+	return &options, nil
+}
+
+// configFile returns the configuration file path
+func configFile() string {
+	if f, ok := os.LookupEnv(tokenFileEnv); ok && f != "" {
+		return f
+	}
+	return tokenDefaultLocation
+}
+
 // Config contains Digital Ocean configuration items
 type Config struct {
-	Token string `json:"token"`
+	Token           string              `json:"token"`
+	ActionPoll      *PollConfig         `json:"actionPoll,omitempty"`
+	Retry           *RetryConfig        `json:"retry,omitempty"`
+	Cache           *CacheConfig        `json:"cache,omitempty"`
+	NodeMatchers    []string            `json:"nodeMatchers,omitempty"`
+	NodeMappingFile string              `json:"nodeMappingFile,omitempty"`
+	Mounter         string              `json:"mounter,omitempty"`
+	MkfsOptions     map[string][]string `json:"mkfsOptions,omitempty"`
+	Fsck            string              `json:"fsck,omitempty"`
+	AttachTimeout   string              `json:"attachTimeout,omitempty"`
+	LUKSKeyDir      string              `json:"luksKeyDir,omitempty"`
 }
 
-// ReadTokenFromJSONFile reads the Digital Ocean token from a config file
-func ReadTokenFromJSONFile(file string) (string, error) {
+// PollConfig configures how DigitalOcean actions are polled.
+// Durations use Go syntax, such as "500ms" or "3m"
+type PollConfig struct {
+	InitialInterval string   `json:"initialInterval,omitempty"`
+	Factor          float64  `json:"factor,omitempty"`
+	Jitter          *float64 `json:"jitter,omitempty"`
+	MaxInterval     string   `json:"maxInterval,omitempty"`
+	Timeout         string   `json:"timeout,omitempty"`
+}
+
+// apply overrides the poll options with the configured values
+func (p *PollConfig) apply(o *cloud.PollOptions) error {
+	durations := []durationSetting{
+		{"actionPoll initialInterval", p.InitialInterval, &o.InitialInterval},
+		{"actionPoll maxInterval", p.MaxInterval, &o.MaxInterval},
+		{"actionPoll timeout", p.Timeout, &o.Timeout},
+	}
+	if err := setDurations(durations); err != nil {
+		return err
+	}
+
+	if p.Factor != 0 {
+		o.Factor = p.Factor
+	}
+	if p.Jitter != nil {
+		o.Jitter = *p.Jitter
+	}
+	return nil
+}
+
+// RetryConfig configures how rate limited and failed DigitalOcean API
+// requests are retried. Durations use Go syntax, such as "500ms" or "3m"
+type RetryConfig struct {
+	MaxRetries     *int   `json:"maxRetries,omitempty"`
+	InitialBackoff string `json:"initialBackoff,omitempty"`
+	MaxBackoff     string `json:"maxBackoff,omitempty"`
+	LowBudget      *int   `json:"lowBudget,omitempty"`
+}
+
+// apply overrides the retry options with the configured values
+func (r *RetryConfig) apply(o *cloud.RetryOptions) error {
+	durations := []durationSetting{
+		{"retry initialBackoff", r.InitialBackoff, &o.InitialBackoff},
+		{"retry maxBackoff", r.MaxBackoff, &o.MaxBackoff},
+	}
+	if err := setDurations(durations); err != nil {
+		return err
+	}
+
+	if r.MaxRetries != nil {
+		o.MaxRetries = *r.MaxRetries
+	}
+	if r.LowBudget != nil {
+		o.LowBudget = *r.LowBudget
+	}
+	return nil
+}
+
+// CacheConfig configures the on-node cache for droplet and volume lookups.
+// A "0s" TTL disables the cache.
+type CacheConfig struct {
+	Dir    string `json:"dir,omitempty"`
+	TTL    string `json:"ttl,omitempty"`
+	Bypass bool   `json:"bypass,omitempty"`
+}
+
+// apply overrides the cache options with the configured values
+func (c *CacheConfig) apply(o *cloud.CacheOptions) error {
+	durations := []durationSetting{
+		{"cache ttl", c.TTL, &o.TTL},
+	}
+	if err := setDurations(durations); err != nil {
+		return err
+	}
+
+	if c.Dir != "" {
+		o.Dir = c.Dir
+	}
+	if c.Bypass {
+		o.Bypass = true
+	}
+	return nil
+}
+
+// durationSetting is a configured duration and the option it overrides
+type durationSetting struct {
+	name  string
+	value string
+	field *time.Duration
+}
+
+// setDurations parses the configured durations, skipping empty values
+func setDurations(settings []durationSetting) error {
+	for _, d := range settings {
+		if d.value == "" {
+			continue
+		}
+		v, err := time.ParseDuration(d.value)
+		if err != nil {
+			return fmt.Errorf("invalid %s %q: %s", d.name, d.value, err.Error())
+		}
+		*d.field = v
+	}
+	return nil
+}
+
+// ReadConfigFile reads the Digital Ocean configuration file
+func ReadConfigFile(file string) (*Config, error) {
 	c, err := ioutil.ReadFile(file)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	config := &Config{}
 	err = json.Unmarshal(c, config)
+	if err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// ReadTokenFromJSONFile reads the Digital Ocean token from a config file
+func ReadTokenFromJSONFile(file string) (string, error) {
+	config, err := ReadConfigFile(file)
 	if err != nil {
 		return "", err
 	}
@@ -0,0 +1,127 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/StackPointCloud/digitalocean-flex-volume/pkg/digitalocean/cloud"
+	"github.com/StackPointCloud/digitalocean-flex-volume/pkg/digitalocean/plugin"
+)
+
+func TestGetManagerOptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "digitalocean.json")
+	os.Setenv(tokenFileEnv, file)
+	defer os.Unsetenv(tokenFileEnv)
+
+	// missing configuration file uses defaults
+	o, err := GetManagerOptions()
+	if err != nil {
+		t.Fatalf("unexpected error without configuration file: %s", err)
+	}
+	if o.ActionPoll != cloud.DefaultPollOptions() {
+		t.Errorf("expected default poll options but got %+v", o.ActionPoll)
+	}
+	if o.Retry != cloud.DefaultRetryOptions() {
+		t.Errorf("expected default retry options but got %+v", o.Retry)
+	}
+	if o.Cache != cloud.DefaultCacheOptions() {
+		t.Errorf("expected default cache options but got %+v", o.Cache)
+	}
+
+	content := `{"token":"abc","actionPoll":{"initialInterval":"500ms","jitter":0,"timeout":"5m"},"retry":{"maxRetries":0,"maxBackoff":"1m"},"nodeMatchers":["shortName","mappingFile"],"nodeMappingFile":"/etc/nodes.json","cache":{"dir":"/tmp/cache","ttl":"1m"}}`
+	if err := ioutil.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	o, err = GetManagerOptions()
+	if err != nil {
+		t.Fatalf("unexpected error reading configuration file: %s", err)
+	}
+	expected := cloud.DefaultPollOptions()
+	expected.InitialInterval = 500 * time.Millisecond
+	expected.Jitter = 0
+	expected.Timeout = 5 * time.Minute
+	if o.ActionPoll != expected {
+		t.Errorf("expected poll options %+v but got %+v", expected, o.ActionPoll)
+	}
+	expectedRetry := cloud.DefaultRetryOptions()
+	expectedRetry.MaxRetries = 0
+	expectedRetry.MaxBackoff = time.Minute
+	if o.Retry != expectedRetry {
+		t.Errorf("expected retry options %+v but got %+v", expectedRetry, o.Retry)
+	}
+	if len(o.NodeMatchers) != 2 || o.NodeMatchers[0] != cloud.NodeMatchShortName || o.NodeMappingFile != "/etc/nodes.json" {
+		t.Errorf("expected node matchers from configuration file but got %v, %q", o.NodeMatchers, o.NodeMappingFile)
+	}
+	expectedCache := cloud.CacheOptions{Dir: "/tmp/cache", TTL: time.Minute}
+	if o.Cache != expectedCache {
+		t.Errorf("expected cache options %+v but got %+v", expectedCache, o.Cache)
+	}
+
+	os.Setenv(cacheBypassEnv, "true")
+	defer os.Unsetenv(cacheBypassEnv)
+	o, err = GetManagerOptions()
+	if err != nil {
+		t.Fatalf("unexpected error bypassing cache: %s", err)
+	}
+	if !o.Cache.Bypass {
+		t.Errorf("expected cache bypass from environment")
+	}
+	os.Unsetenv(cacheBypassEnv)
+
+	content = `{"token":"abc","actionPoll":{"timeout":"5 minutes"}}`
+	if err := ioutil.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = GetManagerOptions(); err == nil {
+		t.Errorf("expected error for invalid timeout")
+	}
+}
+
+func TestGetPluginOptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "digitalocean.json")
+	os.Setenv(tokenFileEnv, file)
+	defer os.Unsetenv(tokenFileEnv)
+
+	o, err := GetPluginOptions()
+	if err != nil || o.Mounter != plugin.DefaultOptions().Mounter || o.Fsck != plugin.DefaultOptions().Fsck || o.MkfsOptions != nil {
+		t.Errorf("expected default plugin options but got %+v, %v", o, err)
+	}
+
+	if err := ioutil.WriteFile(file, []byte(`{"token":"abc","mounter":"exec","fsck":"fail-on-error","attachTimeout":"30s","luksKeyDir":"/etc/luks","mkfsOptions":{"xfs":["-i","size=512"]}}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	o, err = GetPluginOptions()
+	if err != nil || o.Mounter != plugin.MounterExec || o.Fsck != plugin.FsckFailOnError || o.AttachTimeout != 30*time.Second || o.KeyDir != "/etc/luks" {
+		t.Errorf("expected exec mounter, fsck policy and attach timeout from configuration file but got %+v, %v", o, err)
+	}
+	if args := o.MkfsOptions["xfs"]; len(args) != 2 || args[1] != "size=512" {
+		t.Errorf("expected xfs mkfs options from configuration file but got %v", o.MkfsOptions)
+	}
+
+	os.Setenv(mounterEnv, "native")
+	defer os.Unsetenv(mounterEnv)
+	o, err = GetPluginOptions()
+	if err != nil || o.Mounter != plugin.MounterNative {
+		t.Errorf("expected native mounter from environment but got %+v, %v", o, err)
+	}
+
+	os.Setenv(mounterEnv, "fuse")
+	if _, err = GetPluginOptions(); err == nil {
+		t.Errorf("expected error for invalid mounter")
+	}
+}
@@ -5,6 +5,8 @@ import (
 	"os"
 
 	"github.com/StackPointCloud/digitalocean-flex-volume/cmd/digitalocean-flex-volume/config"
+	"github.com/StackPointCloud/digitalocean-flex-volume/cmd/digitalocean-flex-volume/snapshot"
+	"github.com/StackPointCloud/digitalocean-flex-volume/cmd/digitalocean-flex-volume/stats"
 	"github.com/StackPointCloud/digitalocean-flex-volume/pkg/digitalocean/cloud"
 	"github.com/StackPointCloud/digitalocean-flex-volume/pkg/digitalocean/plugin"
 	"github.com/StackPointCloud/digitalocean-flex-volume/pkg/flex"
@@ -39,6 +41,19 @@ import (
 
 func main() {
 
+	// stats are read at the node without the DigitalOcean API
+	if len(os.Args) > 1 && os.Args[1] == stats.Command {
+		pluginOptions, err := config.GetPluginOptions()
+		if err == nil {
+			err = stats.Run(os.Args[2:], pluginOptions, os.Stdout)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+
 	// Create the digital ocean manager
 	token, err := config.GetDigitalOceanToken()
 	if err != nil {
@@ -46,15 +61,40 @@ func main() {
 		os.Exit(1)
 	}
 
+	options, err := config.GetManagerOptions()
+	if err != nil {
+		glog.Errorf("Error reading Digital Ocean configuration: %v", err.Error())
+		os.Exit(1)
+	}
+
 	glog.Info("Creating Digital Ocean client")
-	do, err := cloud.NewDigitalOceanManager(token)
+	do, err := cloud.NewDigitalOceanManager(token, options)
 	if err != nil {
 		glog.Errorf("Error creating Digital Ocean client: %v", err.Error())
 		os.Exit(1)
 	}
 
+	// snapshots are managed by administrators, not called by kubernetes
+	if len(os.Args) > 1 && os.Args[1] == snapshot.Command {
+		if err := snapshot.Run(do, os.Args[2:], os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+
+	pluginOptions, err := config.GetPluginOptions()
+	if err != nil {
+		glog.Errorf("Error reading Digital Ocean configuration: %v", err.Error())
+		os.Exit(1)
+	}
+
 	// create Digital Ocean flex volume instance
-	p := plugin.NewDigitalOceanVolumePlugin(do)
+	p, err := plugin.NewDigitalOceanVolumePlugin(do, pluginOptions)
+	if err != nil {
+		glog.Errorf("Error creating Digital Ocean flex plugin: %v", err.Error())
+		os.Exit(1)
+	}
 
 	// create flex Executor
 	manager := flex.NewManager(p, os.Stdout)
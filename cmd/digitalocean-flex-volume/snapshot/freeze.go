@@ -0,0 +1,170 @@
+package snapshot
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/StackPointCloud/digitalocean-flex-volume/pkg/digitalocean/cloud"
+	"github.com/StackPointCloud/digitalocean-flex-volume/pkg/mountinfo"
+	"github.com/digitalocean/godo"
+	"github.com/golang/glog"
+)
+
+// defaultFreezeTimeout is the longest a filesystem is kept frozen
+const defaultFreezeTimeout = 30 * time.Second
+
+// fsFreezer freezes and thaws mounted filesystems
+type fsFreezer interface {
+	// Sync flushes the filesystem data to the device
+	Sync(mountpoint string) error
+	// Freeze blocks writes to the filesystem until thawed
+	Freeze(mountpoint string) error
+	// Thaw allows writes to a frozen filesystem
+	Thaw(mountpoint string) error
+}
+
+// replaced by tests
+var (
+	freezer       fsFreezer = ioctlFreezer{}
+	mountInfoFile           = mountinfo.File
+	devicePrefix            = cloud.DevicePrefix
+	sysBlockDir             = "/sys/block"
+	mapperDir               = "/dev/mapper"
+	exit                    = os.Exit
+)
+
+// thawSignals are the signals that thaw the filesystem before exiting
+var thawSignals = []os.Signal{syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGQUIT}
+
+// createFrozen snapshots the volume with its filesystem frozen, so the
+// snapshot is consistent. It has to run at the node where it is mounted.
+// The filesystem is thawed when the snapshot is created, on failure, on
+// signals and when the timeout expires, whatever comes first.
+func createFrozen(p cloud.Provider, volumeID, name string, timeout time.Duration, out io.Writer) (*godo.Snapshot, error) {
+	vol, err := p.GetVolume(volumeID)
+	if err != nil {
+		return nil, err
+	}
+	if name == "" {
+		name = defaultName(vol)
+	}
+
+	mountpoint, err := findMountpoint(devicePrefix + vol.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := freezer.Sync(mountpoint); err != nil {
+		return nil, fmt.Errorf("could not sync filesystem at %s: %s", mountpoint, err.Error())
+	}
+	if err := freezer.Freeze(mountpoint); err != nil {
+		return nil, fmt.Errorf("could not freeze filesystem at %s: %s", mountpoint, err.Error())
+	}
+	fmt.Fprintf(out, "froze filesystem at %s\n", mountpoint)
+
+	var once sync.Once
+	var thawErr error
+	thaw := func() {
+		once.Do(func() {
+			if thawErr = freezer.Thaw(mountpoint); thawErr != nil {
+				glog.Errorf("could not thaw filesystem at %s: %s", mountpoint, thawErr.Error())
+				return
+			}
+			fmt.Fprintf(out, "thawed filesystem at %s\n", mountpoint)
+		})
+	}
+	defer thaw()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, thawSignals...)
+	defer signal.Stop(signals)
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	done := make(chan struct{})
+	defer close(done)
+	timedOut := make(chan struct{})
+
+	go func() {
+		select {
+		case s := <-signals:
+			glog.Errorf("received %s while the filesystem at %s is frozen, thawing it", s, mountpoint)
+			thaw()
+			exit(1)
+		case <-timer.C:
+			glog.Errorf("filesystem at %s was frozen for %s, thawing it", mountpoint, timeout)
+			thaw()
+			close(timedOut)
+		case <-done:
+		}
+	}()
+
+	snapshot, err := p.CreateSnapshot(volumeID, name, "created by digitalocean-flex-volume with a frozen filesystem")
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case <-timedOut:
+		return snapshot, fmt.Errorf("snapshot %s was created after the filesystem was thawed by the %s freeze timeout, it might not be consistent",
+			snapshot.ID, timeout)
+	default:
+	}
+
+	thaw()
+	if thawErr != nil {
+		return snapshot, fmt.Errorf("snapshot %s was created but the filesystem at %s could not be thawed: %s", snapshot.ID, mountpoint, thawErr.Error())
+	}
+	return snapshot, nil
+}
+
+// findMountpoint returns a mount point of the device, whose path is usually
+// a symbolic link to the mounted device, or of the device mapper device
+// holding it, such as the LUKS mapping of encrypted volumes
+func findMountpoint(device string) (string, error) {
+	target, err := filepath.EvalSymlinks(device)
+	if err != nil {
+		return "", fmt.Errorf("could not find device %s, the volume has to be attached to this node: %s", device, err.Error())
+	}
+
+	mounts, err := mountinfo.Read(mountInfoFile)
+	if err != nil {
+		return "", fmt.Errorf("could not read mount table: %s", err.Error())
+	}
+	sources := deviceSources(device, target)
+	for _, m := range mounts {
+		for _, s := range sources {
+			if m.Source == s {
+				return m.Mountpoint, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("device %s is not mounted at this node", device)
+}
+
+// deviceSources returns the paths the mount table may report for the
+// device: the link, its target, and the /dev/dm-N and /dev/mapper paths
+// of the device mapper devices holding the target
+func deviceSources(device, target string) []string {
+	sources := []string{device, target}
+	holders, err := ioutil.ReadDir(filepath.Join(sysBlockDir, filepath.Base(target), "holders"))
+	if err != nil {
+		return sources
+	}
+	for _, h := range holders {
+		sources = append(sources, filepath.Join(filepath.Dir(target), h.Name()))
+		if name, err := ioutil.ReadFile(filepath.Join(sysBlockDir, h.Name(), "dm", "name")); err == nil {
+			sources = append(sources, filepath.Join(mapperDir, strings.TrimSpace(string(name))))
+		}
+	}
+	return sources
+}
@@ -0,0 +1,208 @@
+package snapshot
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/StackPointCloud/digitalocean-flex-volume/pkg/digitalocean/cloud/fake"
+	"github.com/digitalocean/godo"
+)
+
+// fakeFreezer records the filesystem operations
+type fakeFreezer struct {
+	mu     sync.Mutex
+	calls  []string
+	thawed chan struct{}
+}
+
+func (f *fakeFreezer) record(call string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, call)
+}
+
+func (f *fakeFreezer) Calls() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return strings.Join(f.calls, ",")
+}
+
+func (f *fakeFreezer) Sync(mountpoint string) error {
+	f.record("sync " + mountpoint)
+	return nil
+}
+
+func (f *fakeFreezer) Freeze(mountpoint string) error {
+	f.record("freeze " + mountpoint)
+	return nil
+}
+
+func (f *fakeFreezer) Thaw(mountpoint string) error {
+	f.record("thaw " + mountpoint)
+	close(f.thawed)
+	return nil
+}
+
+// slowProvider runs hook before creating snapshots
+type slowProvider struct {
+	*fake.Provider
+	hook func()
+}
+
+func (p *slowProvider) CreateSnapshot(volumeID, name, description string) (*godo.Snapshot, error) {
+	p.hook()
+	return p.Provider.CreateSnapshot(volumeID, name, description)
+}
+
+// setupFreeze fakes a device for volume prueba mounted at /mnt/prueba
+func setupFreeze(t *testing.T) (*fakeFreezer, func()) {
+	dir, err := ioutil.TempDir("", "freeze")
+	if err != nil {
+		t.Fatal(err)
+	}
+	device := filepath.Join(dir, "sdb")
+	if err := ioutil.WriteFile(device, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(device, filepath.Join(dir, "scsi-0DO_Volume_prueba")); err != nil {
+		t.Fatal(err)
+	}
+	mounts := fmt.Sprintf("22 1 8:1 / / rw - ext4 /dev/sda1 rw\n40 22 8:16 / /mnt/prueba rw - ext4 %s rw\n", device)
+	if err := ioutil.WriteFile(filepath.Join(dir, "mountinfo"), []byte(mounts), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	f := &fakeFreezer{thawed: make(chan struct{})}
+	oldFreezer, oldMountInfo, oldPrefix, oldSys, oldMapper, oldExit := freezer, mountInfoFile, devicePrefix, sysBlockDir, mapperDir, exit
+	freezer = f
+	mountInfoFile = filepath.Join(dir, "mountinfo")
+	devicePrefix = filepath.Join(dir, "scsi-0DO_Volume_")
+	sysBlockDir = filepath.Join(dir, "sys")
+	mapperDir = filepath.Join(dir, "mapper")
+	return f, func() {
+		freezer, mountInfoFile, devicePrefix, sysBlockDir, mapperDir, exit = oldFreezer, oldMountInfo, oldPrefix, oldSys, oldMapper, oldExit
+		os.RemoveAll(dir)
+	}
+}
+
+func TestCreateFrozen(t *testing.T) {
+	f, cleanup := setupFreeze(t)
+	defer cleanup()
+
+	p := fake.NewProvider("nyc1")
+	p.AddVolume("id0123456789", "prueba", 10)
+	p.AddVolume("id9876543210", "unmounted", 10)
+
+	out := &bytes.Buffer{}
+	if err := Run(p, []string{"create", "-freeze", "id0123456789", "backup"}, out); err != nil {
+		t.Fatalf("unexpected error creating frozen snapshot: %s", err)
+	}
+	if calls := f.Calls(); calls != "sync /mnt/prueba,freeze /mnt/prueba,thaw /mnt/prueba" {
+		t.Errorf("unexpected filesystem calls %q", calls)
+	}
+	if n := p.Calls(fake.MethodCreateSnapshot); n != 1 {
+		t.Errorf("expected 1 snapshot but got %d", n)
+	}
+
+	if err := Run(p, []string{"create", "-freeze", "id9876543210"}, out); err == nil {
+		t.Errorf("expected error freezing an unmounted volume")
+	}
+}
+
+func TestCreateFrozenEncrypted(t *testing.T) {
+	f, cleanup := setupFreeze(t)
+	defer cleanup()
+
+	// encrypted volumes are mounted from the LUKS mapping dm-0 holding sdb
+	dir := filepath.Dir(mountInfoFile)
+	for _, d := range []string{"sys/sdb/holders/dm-0", "sys/dm-0/dm"} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "sys", "dm-0", "dm", "name"), []byte("id0123456789\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	mounts := fmt.Sprintf("22 1 8:1 / / rw - ext4 /dev/sda1 rw\n41 22 253:0 / /mnt/encrypted rw - ext4 %s rw\n", filepath.Join(mapperDir, "id0123456789"))
+	if err := ioutil.WriteFile(mountInfoFile, []byte(mounts), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	p := fake.NewProvider("nyc1")
+	p.AddVolume("id0123456789", "prueba", 10)
+	if err := Run(p, []string{"create", "-freeze", "id0123456789"}, &bytes.Buffer{}); err != nil {
+		t.Fatalf("unexpected error creating frozen snapshot: %s", err)
+	}
+	if calls := f.Calls(); calls != "sync /mnt/encrypted,freeze /mnt/encrypted,thaw /mnt/encrypted" {
+		t.Errorf("unexpected filesystem calls %q", calls)
+	}
+}
+
+func TestCreateFrozenThawsOnFailure(t *testing.T) {
+	f, cleanup := setupFreeze(t)
+	defer cleanup()
+
+	p := fake.NewProvider("nyc1")
+	p.AddVolume("id0123456789", "prueba", 10)
+	p.FailNext(fake.MethodCreateSnapshot, fmt.Errorf("snapshot failed"))
+
+	if _, err := createFrozen(p, "id0123456789", "", time.Minute, &bytes.Buffer{}); err == nil {
+		t.Errorf("expected snapshot error")
+	}
+	if calls := f.Calls(); !strings.HasSuffix(calls, "thaw /mnt/prueba") {
+		t.Errorf("expected filesystem to be thawed but got %q", calls)
+	}
+}
+
+func TestCreateFrozenTimeout(t *testing.T) {
+	f, cleanup := setupFreeze(t)
+	defer cleanup()
+
+	p := &slowProvider{Provider: fake.NewProvider("nyc1")}
+	p.AddVolume("id0123456789", "prueba", 10)
+	p.hook = func() { <-f.thawed }
+
+	snapshot, err := createFrozen(p, "id0123456789", "", 5*time.Millisecond, &bytes.Buffer{})
+	if err == nil || snapshot == nil {
+		t.Errorf("expected snapshot and timeout error but got %+v, %v", snapshot, err)
+	}
+	if calls := f.Calls(); calls != "sync /mnt/prueba,freeze /mnt/prueba,thaw /mnt/prueba" {
+		t.Errorf("expected a single thaw but got %q", calls)
+	}
+}
+
+func TestCreateFrozenSignal(t *testing.T) {
+	f, cleanup := setupFreeze(t)
+	defer cleanup()
+
+	exited := make(chan int, 1)
+	exit = func(code int) { exited <- code }
+
+	p := &slowProvider{Provider: fake.NewProvider("nyc1")}
+	p.AddVolume("id0123456789", "prueba", 10)
+	p.hook = func() {
+		syscall.Kill(os.Getpid(), syscall.SIGHUP)
+		<-f.thawed
+	}
+
+	createFrozen(p, "id0123456789", "", time.Minute, &bytes.Buffer{})
+	select {
+	case code := <-exited:
+		if code == 0 {
+			t.Errorf("expected failed exit code after signal")
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("expected exit after signal")
+	}
+	if calls := f.Calls(); calls != "sync /mnt/prueba,freeze /mnt/prueba,thaw /mnt/prueba" {
+		t.Errorf("expected a single thaw but got %q", calls)
+	}
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+// +build !linux
+
+package snapshot
+
+import (
+	"errors"
+)
+
+var errFreezeUnsupported = errors.New("filesystem freeze is only supported on linux")
+
+// ioctlFreezer is only available on linux
+type ioctlFreezer struct{}
+
+func (ioctlFreezer) Sync(mountpoint string) error   { return errFreezeUnsupported }
+func (ioctlFreezer) Freeze(mountpoint string) error { return errFreezeUnsupported }
+func (ioctlFreezer) Thaw(mountpoint string) error   { return errFreezeUnsupported }
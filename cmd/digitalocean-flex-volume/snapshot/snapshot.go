@@ -0,0 +1,168 @@
+// Package snapshot implements the snapshot subcommand of the driver binary,
+// used by administrators to back up and restore DigitalOcean volumes.
+package snapshot
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/StackPointCloud/digitalocean-flex-volume/pkg/digitalocean/cloud"
+	"github.com/StackPointCloud/digitalocean-flex-volume/pkg/digitalocean/plugin"
+	"github.com/digitalocean/godo"
+)
+
+// Command is the driver binary argument selecting the snapshot subcommand
+const Command = "snapshot"
+
+const usage = `usage:
+  snapshot create [-freeze] [-freeze-timeout 30s] <volumeID> [name]
+  snapshot list <volumeID>
+  snapshot delete <snapshotID>
+  snapshot restore <snapshotID> <volumeName> [sizeGigabytes]`
+
+// Run executes the snapshot subcommand, args exclude the subcommand itself
+func Run(p cloud.Provider, args []string, out io.Writer) error {
+	if len(args) < 2 {
+		return fmt.Errorf("missing arguments\n%s", usage)
+	}
+
+	switch args[0] {
+	case "create":
+		flags := flag.NewFlagSet("snapshot create", flag.ContinueOnError)
+		flags.SetOutput(ioutil.Discard)
+		freeze := flags.Bool("freeze", false, "freeze the mounted filesystem while the snapshot is created, only at the node where it is mounted")
+		freezeTimeout := flags.Duration("freeze-timeout", defaultFreezeTimeout, "longest time the filesystem is kept frozen")
+		if err := flags.Parse(args[1:]); err != nil {
+			return fmt.Errorf("%s\n%s", err.Error(), usage)
+		}
+		if flags.NArg() < 1 || flags.NArg() > 2 {
+			return fmt.Errorf("wrong number of arguments\n%s", usage)
+		}
+		if *freezeTimeout <= 0 {
+			return fmt.Errorf("invalid freeze timeout %s", *freezeTimeout)
+		}
+		volumeID, name := flags.Arg(0), flags.Arg(1)
+		if *freeze {
+			snapshot, err := createFrozen(p, volumeID, name, *freezeTimeout, out)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(out, "created snapshot %s named %q of volume %s\n", snapshot.ID, snapshot.Name, volumeID)
+			return nil
+		}
+		return create(p, volumeID, name, out)
+	case "list":
+		if len(args) != 2 {
+			return fmt.Errorf("too many arguments\n%s", usage)
+		}
+		return list(p, args[1], out)
+	case "delete":
+		if len(args) != 2 {
+			return fmt.Errorf("too many arguments\n%s", usage)
+		}
+		return remove(p, args[1], out)
+	case "restore":
+		if len(args) < 3 || len(args) > 4 {
+			return fmt.Errorf("wrong number of arguments\n%s", usage)
+		}
+		size := int64(0)
+		if len(args) == 4 {
+			var err error
+			size, err = strconv.ParseInt(args[3], 10, 64)
+			if err != nil || size < 1 {
+				return fmt.Errorf("invalid size in gigabytes %q", args[3])
+			}
+		}
+		return restore(p, args[1], args[2], size, out)
+	default:
+		return fmt.Errorf("unknown snapshot command %q\n%s", args[0], usage)
+	}
+}
+
+// create snapshots the volume, naming it after the volume and the current time by default
+func create(p cloud.Provider, volumeID, name string, out io.Writer) error {
+	if name == "" {
+		vol, err := p.GetVolume(volumeID)
+		if err != nil {
+			return err
+		}
+		name = defaultName(vol)
+	}
+
+	snapshot, err := p.CreateSnapshot(volumeID, name, "created by digitalocean-flex-volume")
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "created snapshot %s named %q of volume %s\n", snapshot.ID, snapshot.Name, volumeID)
+	return nil
+}
+
+// defaultName names snapshots after the volume and the current time
+func defaultName(vol *godo.Volume) string {
+	return fmt.Sprintf("%s-%s", vol.Name, time.Now().UTC().Format("20060102150405"))
+}
+
+func list(p cloud.Provider, volumeID string, out io.Writer) error {
+	snapshots, err := p.ListSnapshots(volumeID)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME\tMIN SIZE\tREGIONS\tCREATED")
+	for _, s := range snapshots {
+		fmt.Fprintf(w, "%s\t%s\t%dGB\t%s\t%s\n", s.ID, s.Name, s.MinDiskSize, strings.Join(s.Regions, ","), s.Created)
+	}
+	return w.Flush()
+}
+
+func remove(p cloud.Provider, snapshotID string, out io.Writer) error {
+	if err := p.DeleteSnapshot(snapshotID); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "deleted snapshot %s\n", snapshotID)
+	return nil
+}
+
+// restore creates a volume from the snapshot, at the snapshot region and
+// by default its size, and prints the persistent volume flex source for it
+func restore(p cloud.Provider, snapshotID, volumeName string, size int64, out io.Writer) error {
+	snapshot, err := p.GetSnapshot(snapshotID)
+	if err != nil {
+		return err
+	}
+	if len(snapshot.Regions) == 0 {
+		return fmt.Errorf("snapshot %s is not available at any region", snapshotID)
+	}
+	if size == 0 {
+		size = int64(snapshot.MinDiskSize)
+	}
+	if size < int64(snapshot.MinDiskSize) {
+		return fmt.Errorf("snapshot %s needs a volume of at least %dGB", snapshotID, snapshot.MinDiskSize)
+	}
+
+	vol, err := p.CreateVolume(&cloud.VolumeRequest{
+		Name:          volumeName,
+		Description:   fmt.Sprintf("restored from snapshot %s", snapshot.Name),
+		Region:        snapshot.Regions[0],
+		SizeGigabytes: size,
+		SnapshotID:    snapshotID,
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "# %dGB volume %s restored from snapshot %s at region %s\n", vol.SizeGigaBytes, vol.ID, snapshotID, snapshot.Regions[0])
+	fmt.Fprintf(out, "flexVolume:\n")
+	fmt.Fprintf(out, "  driver: %s\n", plugin.DriverName)
+	fmt.Fprintf(out, "  options:\n")
+	fmt.Fprintf(out, "    %s: %q\n", plugin.VolumeIDOption, vol.ID)
+	fmt.Fprintf(out, "    %s: %q\n", plugin.VolumeNameOption, vol.Name)
+	return nil
+}
@@ -0,0 +1,74 @@
+package snapshot
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/StackPointCloud/digitalocean-flex-volume/pkg/digitalocean/cloud/fake"
+)
+
+func TestSnapshotCommands(t *testing.T) {
+	p := fake.NewProvider("nyc1")
+	p.AddVolume("id0123456789", "prueba", 10)
+
+	out := &bytes.Buffer{}
+	if err := Run(p, []string{"create", "id0123456789"}, out); err != nil {
+		t.Fatalf("unexpected error creating snapshot: %s", err)
+	}
+	if !strings.Contains(out.String(), "named \"prueba-") {
+		t.Errorf("expected snapshot named after the volume but got %q", out.String())
+	}
+
+	out.Reset()
+	if err := Run(p, []string{"list", "id0123456789"}, out); err != nil {
+		t.Fatalf("unexpected error listing snapshots: %s", err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[1], "fake-snapshot-1 ") || !strings.Contains(lines[1], "10GB") {
+		t.Errorf("expected one listed snapshot but got %q", out.String())
+	}
+
+	out.Reset()
+	if err := Run(p, []string{"restore", "fake-snapshot-1", "restored"}, out); err != nil {
+		t.Fatalf("unexpected error restoring snapshot: %s", err)
+	}
+	for _, expected := range []string{"driver: digitalocean/flex-volume", `volumeID: "fake-volume-1"`, `volumeName: "restored"`} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("expected restore output to contain %q but got %q", expected, out.String())
+		}
+	}
+	request, _ := p.CreateRequest("fake-volume-1")
+	if request.SnapshotID != "fake-snapshot-1" || request.SizeGigabytes != 10 || request.Region != "nyc1" {
+		t.Errorf("unexpected restore request %+v", request)
+	}
+
+	if err := Run(p, []string{"restore", "fake-snapshot-1", "small", "5"}, out); err == nil {
+		t.Errorf("expected error restoring to a smaller volume")
+	}
+
+	out.Reset()
+	if err := Run(p, []string{"delete", "fake-snapshot-1"}, out); err != nil {
+		t.Fatalf("unexpected error deleting snapshot: %s", err)
+	}
+	if err := Run(p, []string{"delete", "fake-snapshot-1"}, out); err == nil {
+		t.Errorf("expected error deleting a deleted snapshot")
+	}
+}
+
+func TestSnapshotUsage(t *testing.T) {
+	p := fake.NewProvider("nyc1")
+	cases := [][]string{
+		{},
+		{"create"},
+		{"list", "a", "b"},
+		{"restore", "a"},
+		{"restore", "a", "b", "big"},
+		{"clone", "a"},
+	}
+	for _, args := range cases {
+		if err := Run(p, args, &bytes.Buffer{}); err == nil {
+			t.Errorf("expected error for arguments %v", args)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+// Package stats implements the stats subcommand of the driver binary,
+// reporting the usage and I/O statistics of the volumes mounted at the node.
+package stats
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/StackPointCloud/digitalocean-flex-volume/pkg/digitalocean/plugin"
+)
+
+// Command is the driver binary argument selecting the stats subcommand
+const Command = "stats"
+
+const (
+	// FormatJSON writes the statistics as a JSON list
+	FormatJSON = "json"
+	// FormatPrometheus writes the statistics in the Prometheus text format
+	FormatPrometheus = "prometheus"
+)
+
+const usage = `usage:
+  stats [-format json|prometheus] <mountdir>...`
+
+// Run executes the stats subcommand, args exclude the subcommand itself
+func Run(args []string, options *plugin.Options, out io.Writer) error {
+	flags := flag.NewFlagSet("stats", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	format := flags.String("format", FormatJSON, "output format, json or prometheus")
+	if err := flags.Parse(args); err != nil {
+		return fmt.Errorf("%s\n%s", err.Error(), usage)
+	}
+	if flags.NArg() < 1 {
+		return fmt.Errorf("missing mount directory\n%s", usage)
+	}
+	if *format != FormatJSON && *format != FormatPrometheus {
+		return fmt.Errorf("unknown format %q\n%s", *format, usage)
+	}
+
+	stats := []*plugin.VolumeStats{}
+	for _, dir := range flags.Args() {
+		s, err := plugin.ReadVolumeStats(dir, options)
+		if err != nil {
+			return err
+		}
+		stats = append(stats, s)
+	}
+
+	if *format == FormatPrometheus {
+		return writePrometheus(stats, out)
+	}
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(stats)
+}
+
+// metric is a Prometheus metric of the volumes
+type metric struct {
+	name  string
+	help  string
+	kind  string
+	value func(s *plugin.VolumeStats) (float64, bool)
+}
+
+// filesystemMetric returns a gauge of the filesystem statistics
+func filesystemMetric(name, help string, value func(fs *plugin.FilesystemStats) uint64) metric {
+	return metric{name, help, "gauge", func(s *plugin.VolumeStats) (float64, bool) {
+		if s.Filesystem == nil {
+			return 0, false
+		}
+		return float64(value(s.Filesystem)), true
+	}}
+}
+
+// ioMetric returns a metric of the device I/O counters
+func ioMetric(name, help, kind string, value func(c *plugin.IOStats) float64) metric {
+	return metric{name, help, kind, func(s *plugin.VolumeStats) (float64, bool) {
+		if s.IO == nil {
+			return 0, false
+		}
+		return value(s.IO), true
+	}}
+}
+
+// seconds converts milliseconds to seconds
+func seconds(ms uint64) float64 {
+	return float64(ms) / 1000
+}
+
+var metrics = []metric{
+	filesystemMetric("digitalocean_volume_capacity_bytes", "Size of the filesystem in bytes.",
+		func(fs *plugin.FilesystemStats) uint64 { return fs.CapacityBytes }),
+	filesystemMetric("digitalocean_volume_used_bytes", "Used space of the filesystem in bytes.",
+		func(fs *plugin.FilesystemStats) uint64 { return fs.UsedBytes }),
+	filesystemMetric("digitalocean_volume_available_bytes", "Space of the filesystem available to users in bytes.",
+		func(fs *plugin.FilesystemStats) uint64 { return fs.AvailableBytes }),
+	filesystemMetric("digitalocean_volume_inodes", "Number of inodes of the filesystem.",
+		func(fs *plugin.FilesystemStats) uint64 { return fs.Inodes }),
+	filesystemMetric("digitalocean_volume_inodes_used", "Number of used inodes of the filesystem.",
+		func(fs *plugin.FilesystemStats) uint64 { return fs.InodesUsed }),
+	filesystemMetric("digitalocean_volume_inodes_free", "Number of free inodes of the filesystem.",
+		func(fs *plugin.FilesystemStats) uint64 { return fs.InodesFree }),
+	ioMetric("digitalocean_volume_reads_completed_total", "Number of reads completed by the device.", "counter",
+		func(c *plugin.IOStats) float64 { return float64(c.ReadsCompleted) }),
+	ioMetric("digitalocean_volume_reads_merged_total", "Number of adjacent reads merged by the device.", "counter",
+		func(c *plugin.IOStats) float64 { return float64(c.ReadsMerged) }),
+	ioMetric("digitalocean_volume_read_bytes_total", "Number of bytes read by the device.", "counter",
+		func(c *plugin.IOStats) float64 { return float64(c.ReadBytes) }),
+	ioMetric("digitalocean_volume_read_time_seconds_total", "Time spent by the device reading in seconds.", "counter",
+		func(c *plugin.IOStats) float64 { return seconds(c.ReadTimeMs) }),
+	ioMetric("digitalocean_volume_writes_completed_total", "Number of writes completed by the device.", "counter",
+		func(c *plugin.IOStats) float64 { return float64(c.WritesCompleted) }),
+	ioMetric("digitalocean_volume_writes_merged_total", "Number of adjacent writes merged by the device.", "counter",
+		func(c *plugin.IOStats) float64 { return float64(c.WritesMerged) }),
+	ioMetric("digitalocean_volume_written_bytes_total", "Number of bytes written by the device.", "counter",
+		func(c *plugin.IOStats) float64 { return float64(c.WrittenBytes) }),
+	ioMetric("digitalocean_volume_write_time_seconds_total", "Time spent by the device writing in seconds.", "counter",
+		func(c *plugin.IOStats) float64 { return seconds(c.WriteTimeMs) }),
+	ioMetric("digitalocean_volume_io_now", "Number of I/Os in progress at the device.", "gauge",
+		func(c *plugin.IOStats) float64 { return float64(c.InFlight) }),
+	ioMetric("digitalocean_volume_io_time_seconds_total", "Time the device had I/Os in progress in seconds.", "counter",
+		func(c *plugin.IOStats) float64 { return seconds(c.IOTimeMs) }),
+	ioMetric("digitalocean_volume_io_time_weighted_seconds_total", "Time spent by the device doing I/Os, weighted by the I/Os in progress, in seconds.", "counter",
+		func(c *plugin.IOStats) float64 { return seconds(c.WeightedIOTimeMs) }),
+}
+
+// labelEscaper escapes Prometheus label values
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// writePrometheus writes the statistics in the Prometheus text exposition
+// format, labeling samples with the volume name, device and mount directory
+func writePrometheus(stats []*plugin.VolumeStats, out io.Writer) error {
+	for _, m := range metrics {
+		header := false
+		for _, s := range stats {
+			value, ok := m.value(s)
+			if !ok {
+				continue
+			}
+			if !header {
+				if _, err := fmt.Fprintf(out, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind); err != nil {
+					return err
+				}
+				header = true
+			}
+			if _, err := fmt.Fprintf(out, "%s{volume=\"%s\",device=\"%s\",mountdir=\"%s\"} %g\n", m.name,
+				labelEscaper.Replace(s.VolumeName), labelEscaper.Replace(s.Device), labelEscaper.Replace(s.MountDir), value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
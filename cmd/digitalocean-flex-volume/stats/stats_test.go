@@ -0,0 +1,56 @@
+package stats
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/StackPointCloud/digitalocean-flex-volume/pkg/digitalocean/plugin"
+)
+
+func TestWritePrometheus(t *testing.T) {
+	stats := []*plugin.VolumeStats{
+		{
+			MountDir:   "/var/lib/kubelet/mounts/id0123456789",
+			Device:     "/dev/sda",
+			VolumeName: "prueba",
+			Filesystem: &plugin.FilesystemStats{CapacityBytes: 10737418240, UsedBytes: 1024, InodesFree: 3},
+			IO:         &plugin.IOStats{ReadsCompleted: 12, ReadTimeMs: 1500},
+		},
+		{
+			// raw block volume
+			MountDir: `/mnt/"block"`,
+			Device:   "/dev/sdb",
+			IO:       &plugin.IOStats{ReadsCompleted: 3},
+		},
+	}
+
+	out := &bytes.Buffer{}
+	if err := writePrometheus(stats, out); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	for _, expected := range []string{
+		"# HELP digitalocean_volume_capacity_bytes Size of the filesystem in bytes.\n# TYPE digitalocean_volume_capacity_bytes gauge\n" +
+			`digitalocean_volume_capacity_bytes{volume="prueba",device="/dev/sda",mountdir="/var/lib/kubelet/mounts/id0123456789"} 1.073741824e+10` + "\n# HELP",
+		`digitalocean_volume_inodes_free{volume="prueba",device="/dev/sda",mountdir="/var/lib/kubelet/mounts/id0123456789"} 3`,
+		"# TYPE digitalocean_volume_reads_completed_total counter\n" +
+			`digitalocean_volume_reads_completed_total{volume="prueba",device="/dev/sda",mountdir="/var/lib/kubelet/mounts/id0123456789"} 12` + "\n" +
+			`digitalocean_volume_reads_completed_total{volume="",device="/dev/sdb",mountdir="/mnt/\"block\""} 3` + "\n",
+		`digitalocean_volume_read_time_seconds_total{volume="prueba",device="/dev/sda",mountdir="/var/lib/kubelet/mounts/id0123456789"} 1.5`,
+	} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("expected output to contain %q but got %q", expected, out.String())
+		}
+	}
+	if strings.Count(out.String(), "# TYPE digitalocean_volume_reads_completed_total") != 1 {
+		t.Errorf("expected one header per metric but got %q", out.String())
+	}
+}
+
+func TestStatsUsage(t *testing.T) {
+	for _, args := range [][]string{{}, {"-format", "xml", "/mnt"}, {"-unknown", "/mnt"}} {
+		if err := Run(args, nil, &bytes.Buffer{}); err == nil || !strings.Contains(err.Error(), "usage:") {
+			t.Errorf("expected usage error for %q but got %v", args, err)
+		}
+	}
+}
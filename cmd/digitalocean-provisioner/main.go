@@ -0,0 +1,79 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/StackPointCloud/digitalocean-flex-volume/cmd/digitalocean-flex-volume/config"
+	"github.com/StackPointCloud/digitalocean-flex-volume/pkg/digitalocean/cloud"
+	"github.com/StackPointCloud/digitalocean-flex-volume/pkg/digitalocean/provisioner"
+	"github.com/golang/glog"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+var (
+	master     = flag.String("master", "", "kubernetes API server address, empty to use the in-cluster configuration")
+	kubeconfig = flag.String("kubeconfig", "", "kubeconfig file path, empty to use the in-cluster configuration")
+	name       = flag.String("name", provisioner.DefaultName, "storage class provisioner name handled")
+	driver     = flag.String("driver", provisioner.DefaultDriver, "flex driver name set at provisioned persistent volumes")
+	resync     = flag.Duration("resync", 5*time.Minute, "interval every claim and volume is checked again")
+	workers    = flag.Int("workers", 2, "number of claims and volumes processed concurrently")
+)
+
+func main() {
+	flag.Parse()
+
+	token, err := config.GetDigitalOceanToken()
+	if err != nil {
+		glog.Errorf("Error retrieving Digital Ocean token: %v", err.Error())
+		os.Exit(1)
+	}
+
+	options, err := config.GetManagerOptions()
+	if err != nil {
+		glog.Errorf("Error reading Digital Ocean configuration: %v", err.Error())
+		os.Exit(1)
+	}
+	// the on-node cache is meant to be shared by short lived flex calls
+	options.Cache = cloud.CacheOptions{}
+
+	do, err := cloud.NewDigitalOceanManager(token, options)
+	if err != nil {
+		glog.Errorf("Error creating Digital Ocean client: %v", err.Error())
+		os.Exit(1)
+	}
+
+	restConfig, err := clientcmd.BuildConfigFromFlags(*master, *kubeconfig)
+	if err != nil {
+		glog.Errorf("Error creating kubernetes client configuration: %v", err.Error())
+		os.Exit(1)
+	}
+	client, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		glog.Errorf("Error creating kubernetes client: %v", err.Error())
+		os.Exit(1)
+	}
+
+	p := provisioner.NewProvisioner(client, do, provisioner.Options{
+		Name:         *name,
+		Driver:       *driver,
+		ResyncPeriod: *resync,
+	})
+
+	stopCh := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-signals
+		close(stopCh)
+	}()
+
+	if err := p.Run(*workers, stopCh); err != nil {
+		glog.Errorf("Error running provisioner: %v", err.Error())
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,248 @@
+package cloud
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	defaultCacheDir = "/var/lib/digitalocean-flex-volume/cache"
+	defaultCacheTTL = 30 * time.Second
+
+	cacheFile     = "cache.json"
+	cacheLockFile = "cache.lock"
+
+	cacheKeyDroplets = "droplets"
+)
+
+// CacheOptions configures the on-node cache shared by driver invocations
+// for droplet and volume lookups. An empty directory is replaced by the
+// default, a zero TTL disables the cache.
+type CacheOptions struct {
+	// Dir is the directory holding the cache and its lock file
+	Dir string
+	// TTL is the time cached lookups are valid
+	TTL time.Duration
+	// Bypass skips cached lookups. Results are still stored and
+	// the cache is still invalidated by storage actions.
+	Bypass bool
+}
+
+// DefaultCacheOptions returns the default cache options
+func DefaultCacheOptions() CacheOptions {
+	return CacheOptions{
+		Dir: defaultCacheDir,
+		TTL: defaultCacheTTL,
+	}
+}
+
+// withDefaults returns a copy of the options with defaults for unset values
+func (o CacheOptions) withDefaults() CacheOptions {
+	if o.Dir == "" {
+		o.Dir = defaultCacheDir
+	}
+	if o.TTL < 0 {
+		o.TTL = 0
+	}
+	return o
+}
+
+// cacheEntry is a cached lookup result
+type cacheEntry struct {
+	Expires time.Time       `json:"expires"`
+	Value   json.RawMessage `json:"value"`
+}
+
+// diskCache is a TTL cache stored in a single file. Concurrent driver
+// invocations are serialized with an advisory lock on a separate file,
+// so the cache file itself can be atomically replaced.
+// Cache failures are logged and never fail the lookup.
+// A nil diskCache is a disabled cache.
+type diskCache struct {
+	options CacheOptions
+	now     func() time.Time
+}
+
+// newDiskCache returns the cache, or nil if disabled
+func newDiskCache(options CacheOptions) *diskCache {
+	options = options.withDefaults()
+	if options.TTL == 0 {
+		return nil
+	}
+	return &diskCache{
+		options: options,
+		now:     time.Now,
+	}
+}
+
+// get decodes the cached value for key into v, returning false
+// if it is missing, expired or the cache is bypassed
+func (c *diskCache) get(key string, v interface{}) bool {
+	if c == nil || c.options.Bypass {
+		return false
+	}
+
+	lock, err := c.lock(unix.LOCK_SH)
+	if err != nil {
+		glog.Warningf("could not lock cache: %s", err.Error())
+		return false
+	}
+	defer c.unlock(lock)
+
+	entries, err := c.read()
+	if err != nil {
+		glog.Warningf("could not read cache: %s", err.Error())
+		return false
+	}
+
+	e, ok := entries[key]
+	if !ok || !c.now().Before(e.Expires) {
+		return false
+	}
+	if err := json.Unmarshal(e.Value, v); err != nil {
+		glog.Warningf("could not decode cached %s: %s", key, err.Error())
+		return false
+	}
+	glog.V(2).Infof("using cached %s", key)
+	return true
+}
+
+// set stores v for key, dropping expired entries
+func (c *diskCache) set(key string, v interface{}) {
+	if c == nil {
+		return
+	}
+
+	value, err := json.Marshal(v)
+	if err != nil {
+		glog.Warningf("could not encode %s for cache: %s", key, err.Error())
+		return
+	}
+
+	lock, err := c.lock(unix.LOCK_EX)
+	if err != nil {
+		glog.Warningf("could not lock cache: %s", err.Error())
+		return
+	}
+	defer c.unlock(lock)
+
+	entries, err := c.read()
+	if err != nil {
+		glog.Warningf("could not read cache, replacing it: %s", err.Error())
+		entries = map[string]cacheEntry{}
+	}
+
+	now := c.now()
+	for k, e := range entries {
+		if !now.Before(e.Expires) {
+			delete(entries, k)
+		}
+	}
+	entries[key] = cacheEntry{Expires: now.Add(c.options.TTL), Value: value}
+
+	if err := c.write(entries); err != nil {
+		glog.Warningf("could not write cache: %s", err.Error())
+	}
+}
+
+// invalidate drops every cached entry
+func (c *diskCache) invalidate() {
+	if c == nil {
+		return
+	}
+
+	lock, err := c.lock(unix.LOCK_EX)
+	if err != nil {
+		glog.Warningf("could not lock cache: %s", err.Error())
+		return
+	}
+	defer c.unlock(lock)
+
+	err = os.Remove(filepath.Join(c.options.Dir, cacheFile))
+	if err != nil && !os.IsNotExist(err) {
+		glog.Warningf("could not invalidate cache: %s", err.Error())
+		return
+	}
+	glog.V(2).Infof("cache invalidated")
+}
+
+// lock acquires the cache lock, creating the cache directory if needed
+func (c *diskCache) lock(how int) (*os.File, error) {
+	if err := os.MkdirAll(c.options.Dir, 0700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(c.options.Dir, cacheLockFile), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		err = unix.Flock(int(f.Fd()), how)
+		if err != unix.EINTR {
+			break
+		}
+	}
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("flock %s: %s", f.Name(), err.Error())
+	}
+	return f, nil
+}
+
+// unlock releases the cache lock
+func (c *diskCache) unlock(f *os.File) {
+	unix.Flock(int(f.Fd()), unix.LOCK_UN)
+	f.Close()
+}
+
+// read returns the cache entries, a missing cache file is an empty cache
+func (c *diskCache) read() (map[string]cacheEntry, error) {
+	entries := map[string]cacheEntry{}
+	content, err := ioutil.ReadFile(filepath.Join(c.options.Dir, cacheFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return entries, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(content, &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// write atomically replaces the cache file
+func (c *diskCache) write(entries map[string]cacheEntry) error {
+	content, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(c.options.Dir, cacheFile+".")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(c.options.Dir, cacheFile))
+}
+
+func dropletCacheKey(dropletID int) string {
+	return fmt.Sprintf("droplet/%d", dropletID)
+}
+
+func volumeCacheKey(volumeID string) string {
+	return "volume/" + volumeID
+}
@@ -0,0 +1,111 @@
+package cloud
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestCache(t *testing.T) (*diskCache, func()) {
+	dir, err := ioutil.TempDir("", "cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newDiskCache(CacheOptions{Dir: filepath.Join(dir, "cache"), TTL: time.Minute})
+	return c, func() { os.RemoveAll(dir) }
+}
+
+func TestDiskCache(t *testing.T) {
+	c, cleanup := newTestCache(t)
+	defer cleanup()
+
+	now := time.Now()
+	c.now = func() time.Time { return now }
+
+	var v string
+	if c.get("key", &v) {
+		t.Errorf("expected miss on empty cache")
+	}
+
+	c.set("key", "value")
+	if !c.get("key", &v) || v != "value" {
+		t.Errorf("expected cached value but got %q", v)
+	}
+
+	// entries expire after the TTL
+	now = now.Add(time.Minute)
+	if c.get("key", &v) {
+		t.Errorf("expected miss on expired entry")
+	}
+
+	c.set("key", "value")
+	c.set("other", "value")
+	c.invalidate()
+	if c.get("key", &v) || c.get("other", &v) {
+		t.Errorf("expected miss after invalidation")
+	}
+
+	// bypassed caches are still written
+	c.set("key", "value")
+	c.options.Bypass = true
+	if c.get("key", &v) {
+		t.Errorf("expected miss on bypassed cache")
+	}
+	c.options.Bypass = false
+	if !c.get("key", &v) {
+		t.Errorf("expected cached value written while bypassed")
+	}
+
+	// corrupted caches are replaced
+	if err := ioutil.WriteFile(filepath.Join(c.options.Dir, cacheFile), []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if c.get("key", &v) {
+		t.Errorf("expected miss on corrupted cache")
+	}
+	c.set("key", "value")
+	if !c.get("key", &v) {
+		t.Errorf("expected cached value after replacing corrupted cache")
+	}
+}
+
+func TestDiskCacheDisabled(t *testing.T) {
+	c := newDiskCache(CacheOptions{Dir: "/nonexistent"})
+	if c != nil {
+		t.Fatalf("expected disabled cache with zero TTL")
+	}
+
+	// a disabled cache is a no-op
+	var v string
+	c.set("key", "value")
+	c.invalidate()
+	if c.get("key", &v) {
+		t.Errorf("expected miss on disabled cache")
+	}
+}
+
+func TestDiskCacheConcurrency(t *testing.T) {
+	c, cleanup := newTestCache(t)
+	defer cleanup()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			c.set(fmt.Sprintf("key-%d", i), i)
+		}(i)
+	}
+	wg.Wait()
+
+	for i := 0; i < 10; i++ {
+		var v int
+		if !c.get(fmt.Sprintf("key-%d", i), &v) || v != i {
+			t.Errorf("expected cached value %d but got %d", i, v)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package cloud
+
+import (
+	"net/http"
+
+	"github.com/StackPointCloud/digitalocean-flex-volume/pkg/flex"
+	"github.com/digitalocean/godo"
+)
+
+// apiError converts an error returned by godo into a driver error,
+// classifying it by the HTTP status returned from the DigitalOcean API
+func apiError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	errResp, ok := err.(*godo.ErrorResponse)
+	if !ok || errResp.Response == nil {
+		// the request did not reach the API or the response could not be read
+		return flex.NewRetryableError(flex.ErrorCodeAPIUnavailable, "DigitalOcean API request failed: %s", err.Error())
+	}
+
+	e := &flex.Error{
+		Code:      flex.ErrorCodeAPIError,
+		Message:   err.Error(),
+		RequestID: errResp.RequestID,
+	}
+
+	switch status := errResp.Response.StatusCode; {
+	case status == http.StatusTooManyRequests:
+		e.Code = flex.ErrorCodeRateLimited
+		e.Retryable = true
+	case status >= http.StatusInternalServerError:
+		e.Code = flex.ErrorCodeAPIUnavailable
+		e.Retryable = true
+	case status == http.StatusNotFound:
+		e.Code = flex.ErrorCodeNotFound
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		e.Code = flex.ErrorCodeUnauthorized
+	}
+
+	return e
+}
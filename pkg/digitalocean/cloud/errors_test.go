@@ -0,0 +1,55 @@
+package cloud
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/StackPointCloud/digitalocean-flex-volume/pkg/flex"
+	"github.com/digitalocean/godo"
+)
+
+func newErrorResponse(status int, requestID string) *godo.ErrorResponse {
+	u, _ := url.Parse("https://api.digitalocean.com/v2/volumes/id0123456789")
+	return &godo.ErrorResponse{
+		Response: &http.Response{
+			StatusCode: status,
+			Request:    &http.Request{Method: http.MethodGet, URL: u},
+		},
+		Message:   http.StatusText(status),
+		RequestID: requestID,
+	}
+}
+
+func TestAPIError(t *testing.T) {
+	cases := []struct {
+		err               error
+		expectedCode      string
+		expectedRetryable bool
+		expectedRequestID string
+	}{
+		{newErrorResponse(http.StatusTooManyRequests, "req-429"), flex.ErrorCodeRateLimited, true, "req-429"},
+		{newErrorResponse(http.StatusServiceUnavailable, "req-503"), flex.ErrorCodeAPIUnavailable, true, "req-503"},
+		{newErrorResponse(http.StatusNotFound, "req-404"), flex.ErrorCodeNotFound, false, "req-404"},
+		{newErrorResponse(http.StatusUnauthorized, ""), flex.ErrorCodeUnauthorized, false, ""},
+		{newErrorResponse(http.StatusUnprocessableEntity, "req-422"), flex.ErrorCodeAPIError, false, "req-422"},
+		{fmt.Errorf("dial tcp: connection refused"), flex.ErrorCodeAPIUnavailable, true, ""},
+	}
+
+	for _, c := range cases {
+		e, ok := apiError(c.err).(*flex.Error)
+		if !ok {
+			t.Errorf("error %q was not converted to a driver error", c.err)
+			continue
+		}
+		if e.Code != c.expectedCode || e.Retryable != c.expectedRetryable || e.RequestID != c.expectedRequestID {
+			t.Errorf("error %q expected code %q, retryable %t and request %q but got %+v",
+				c.err, c.expectedCode, c.expectedRetryable, c.expectedRequestID, e)
+		}
+	}
+
+	if apiError(nil) != nil {
+		t.Errorf("expected nil error to be kept as nil")
+	}
+}
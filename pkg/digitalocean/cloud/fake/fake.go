@@ -0,0 +1,573 @@
+// Package fake provides an in-memory DigitalOcean backend implementing
+// cloud.Provider, to be used in tests that need no API token.
+package fake
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/StackPointCloud/digitalocean-flex-volume/pkg/digitalocean/cloud"
+	"github.com/StackPointCloud/digitalocean-flex-volume/pkg/flex"
+	"github.com/digitalocean/godo"
+)
+
+// Provider methods that can be set to fail using FailNext
+const (
+	MethodGetDroplet              = "GetDroplet"
+	MethodFetchDroplet            = "FetchDroplet"
+	MethodFindDropletFromNodeName = "FindDropletFromNodeName"
+	MethodGetVolume               = "GetVolume"
+	MethodGetVolumeByName         = "GetVolumeByName"
+	MethodAttachVolumeAndWait     = "AttachVolumeAndWait"
+	MethodDetachVolumeAndWait     = "DetachVolumeAndWait"
+	MethodResizeVolumeAndWait     = "ResizeVolumeAndWait"
+	MethodCreateVolume            = "CreateVolume"
+	MethodDeleteVolume            = "DeleteVolume"
+	MethodCreateSnapshot          = "CreateSnapshot"
+	MethodListSnapshots           = "ListSnapshots"
+	MethodGetSnapshot             = "GetSnapshot"
+	MethodDeleteSnapshot          = "DeleteSnapshot"
+)
+
+const providerIDPrefix = "digitalocean://"
+
+// Provider is an in-memory DigitalOcean backend
+type Provider struct {
+	// ActionLatency is the time storage actions take to complete
+	ActionLatency time.Duration
+	// Timeout is the time waited for storage actions, if set actions slower
+	// than it fail with a timeout error but, as at DigitalOcean, are still applied
+	Timeout time.Duration
+	// Sleep waits for the action latency or timeout, time.Sleep by default
+	Sleep func(time.Duration)
+
+	mu        sync.Mutex
+	region    string
+	droplets  map[int]*godo.Droplet
+	volumes   map[string]*godo.Volume
+	failures  map[string][]error
+	calls     map[string]int
+	requests  map[string]cloud.VolumeRequest
+	snapshots map[string]*godo.Snapshot
+
+	actionSeq   int
+	volumeSeq   int
+	snapshotSeq int
+}
+
+var _ cloud.Provider = &Provider{}
+
+// NewProvider returns an empty in-memory backend at the given region
+func NewProvider(region string) *Provider {
+	return &Provider{
+		Sleep:     time.Sleep,
+		region:    region,
+		droplets:  map[int]*godo.Droplet{},
+		volumes:   map[string]*godo.Volume{},
+		failures:  map[string][]error{},
+		calls:     map[string]int{},
+		requests:  map[string]cloud.VolumeRequest{},
+		snapshots: map[string]*godo.Snapshot{},
+	}
+}
+
+// AddDroplet creates a droplet, IP addresses are optional
+func (p *Provider) AddDroplet(id int, name, privateIP, publicIP string) *godo.Droplet {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	d := &godo.Droplet{
+		ID:        id,
+		Name:      name,
+		Region:    &godo.Region{Slug: p.region},
+		Networks:  &godo.Networks{},
+		VolumeIDs: []string{},
+	}
+	if privateIP != "" {
+		d.Networks.V4 = append(d.Networks.V4, godo.NetworkV4{IPAddress: privateIP, Type: "private"})
+	}
+	if publicIP != "" {
+		d.Networks.V4 = append(d.Networks.V4, godo.NetworkV4{IPAddress: publicIP, Type: "public"})
+	}
+	p.droplets[id] = d
+	return copyDroplet(d)
+}
+
+// AddVolume creates a detached volume
+func (p *Provider) AddVolume(id, name string, sizeGigabytes int64) *godo.Volume {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	v := &godo.Volume{
+		ID:            id,
+		Name:          name,
+		Region:        &godo.Region{Slug: p.region},
+		SizeGigaBytes: sizeGigabytes,
+		DropletIDs:    []int{},
+		CreatedAt:     time.Now(),
+	}
+	p.volumes[id] = v
+	return copyVolume(v)
+}
+
+// Volumes returns the stored volumes sorted by ID
+func (p *Provider) Volumes() []*godo.Volume {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	ids := []string{}
+	for id := range p.volumes {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	volumes := []*godo.Volume{}
+	for _, id := range ids {
+		volumes = append(volumes, copyVolume(p.volumes[id]))
+	}
+	return volumes
+}
+
+// CreateRequest returns the request a volume was created with
+func (p *Provider) CreateRequest(volumeID string) (cloud.VolumeRequest, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	r, ok := p.requests[volumeID]
+	return r, ok
+}
+
+// FailNext queues an error to be returned by the next call to method
+func (p *Provider) FailNext(method string, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.failures[method] = append(p.failures[method], err)
+}
+
+// Calls returns the number of times method was called
+func (p *Provider) Calls(method string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.calls[method]
+}
+
+// GetDroplet retrieves the droplet by ID
+func (p *Provider) GetDroplet(dropletID int) (*godo.Droplet, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.call(MethodGetDroplet); err != nil {
+		return nil, err
+	}
+
+	d, ok := p.droplets[dropletID]
+	if !ok {
+		return nil, flex.NewError(flex.ErrorCodeNotFound, "droplet %d not found", dropletID)
+	}
+	return copyDroplet(d), nil
+}
+
+// FetchDroplet retrieves the droplet by ID, the fake has no cache to skip
+func (p *Provider) FetchDroplet(dropletID int) (*godo.Droplet, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.call(MethodFetchDroplet); err != nil {
+		return nil, err
+	}
+
+	d, ok := p.droplets[dropletID]
+	if !ok {
+		return nil, flex.NewError(flex.ErrorCodeNotFound, "droplet %d not found", dropletID)
+	}
+	return copyDroplet(d), nil
+}
+
+// FindDropletFromNodeName resolves provider IDs and matches the node name to the
+// droplet name, private IP or public IP. Droplets found by name or IP lack
+// volumes, as droplets returned by the list API call.
+func (p *Provider) FindDropletFromNodeName(node string) (*godo.Droplet, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.call(MethodFindDropletFromNodeName); err != nil {
+		return nil, err
+	}
+
+	if strings.HasPrefix(node, providerIDPrefix) {
+		id, err := strconv.Atoi(strings.TrimPrefix(node, providerIDPrefix))
+		if err != nil {
+			return nil, flex.NewError(flex.ErrorCodeInvalidOptions, "could not parse droplet ID from provider ID %q", node)
+		}
+		d, ok := p.droplets[id]
+		if !ok {
+			return nil, flex.NewError(flex.ErrorCodeNotFound, "droplet %d not found", id)
+		}
+		return copyDroplet(d), nil
+	}
+
+	ids := []int{}
+	for id := range p.droplets {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	for _, id := range ids {
+		if p.droplets[id].Name == node {
+			return listedDroplet(p.droplets[id]), nil
+		}
+	}
+	for _, id := range ids {
+		d := p.droplets[id]
+		for _, n := range d.Networks.V4 {
+			if n.IPAddress == node {
+				return listedDroplet(d), nil
+			}
+		}
+	}
+
+	return nil, flex.NewError(flex.ErrorCodeNotFound, "could not match node name %q to droplet name, private IP or public IP", node)
+}
+
+// GetVolume given an unique Digital Ocean identifier returns the volume
+func (p *Provider) GetVolume(volumeID string) (*godo.Volume, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.call(MethodGetVolume); err != nil {
+		return nil, err
+	}
+
+	v, ok := p.volumes[volumeID]
+	if !ok {
+		return nil, flex.NewError(flex.ErrorCodeNotFound, "volume %q not found", volumeID)
+	}
+	return copyVolume(v), nil
+}
+
+// GetVolumeByName retrieves a volume given the name and region,
+// the region defaults to the provider region
+func (p *Provider) GetVolumeByName(name, region string) (*godo.Volume, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.call(MethodGetVolumeByName); err != nil {
+		return nil, err
+	}
+
+	if region == "" {
+		region = p.region
+	}
+	for _, v := range p.volumes {
+		if v.Name == name && v.Region.Slug == region {
+			return copyVolume(v), nil
+		}
+	}
+	return nil, flex.NewError(flex.ErrorCodeNotFound, "could not find volume named %q at region %q", name, region)
+}
+
+// AttachVolumeAndWait attaches volume to given droplet
+func (p *Provider) AttachVolumeAndWait(volumeID string, dropletID int) (*godo.Action, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.call(MethodAttachVolumeAndWait); err != nil {
+		return nil, err
+	}
+
+	v, d, err := p.volumeAndDroplet(volumeID, dropletID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, id := range v.DropletIDs {
+		if id == dropletID {
+			return nil, nil
+		}
+	}
+	if len(v.DropletIDs) > 0 {
+		return nil, flex.NewError(flex.ErrorCodeAPIError, "volume %q is already attached to droplet %d", volumeID, v.DropletIDs[0])
+	}
+
+	v.DropletIDs = append(v.DropletIDs, dropletID)
+	d.VolumeIDs = append(d.VolumeIDs, volumeID)
+
+	return p.wait(volumeID, "attach")
+}
+
+// DetachVolumeAndWait detaches a volume from given droplet
+func (p *Provider) DetachVolumeAndWait(volumeID string, dropletID int) (*godo.Action, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.call(MethodDetachVolumeAndWait); err != nil {
+		return nil, err
+	}
+
+	v, d, err := p.volumeAndDroplet(volumeID, dropletID)
+	if err != nil {
+		return nil, err
+	}
+
+	attached := false
+	for i, id := range v.DropletIDs {
+		if id == dropletID {
+			v.DropletIDs = append(v.DropletIDs[:i], v.DropletIDs[i+1:]...)
+			attached = true
+			break
+		}
+	}
+	if !attached {
+		return nil, nil
+	}
+	for i, id := range d.VolumeIDs {
+		if id == volumeID {
+			d.VolumeIDs = append(d.VolumeIDs[:i], d.VolumeIDs[i+1:]...)
+			break
+		}
+	}
+
+	return p.wait(volumeID, "detach")
+}
+
+// ResizeVolumeAndWait grows the volume to the given size in gigabytes
+func (p *Provider) ResizeVolumeAndWait(volumeID string, sizeGigabytes int) (*godo.Action, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.call(MethodResizeVolumeAndWait); err != nil {
+		return nil, err
+	}
+
+	v, ok := p.volumes[volumeID]
+	if !ok {
+		return nil, flex.NewError(flex.ErrorCodeNotFound, "volume %q not found", volumeID)
+	}
+	if v.SizeGigaBytes >= int64(sizeGigabytes) {
+		return nil, nil
+	}
+
+	v.SizeGigaBytes = int64(sizeGigabytes)
+	return p.wait(volumeID, "resize")
+}
+
+// CreateVolume creates a detached volume, the region defaults to the provider region
+func (p *Provider) CreateVolume(request *cloud.VolumeRequest) (*godo.Volume, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.call(MethodCreateVolume); err != nil {
+		return nil, err
+	}
+
+	region := request.Region
+	if region == "" {
+		region = p.region
+	}
+	for _, v := range p.volumes {
+		if v.Name == request.Name && v.Region.Slug == region {
+			return nil, flex.NewError(flex.ErrorCodeAPIError, "volume named %q already exists at region %q", request.Name, region)
+		}
+	}
+	if request.SnapshotID != "" {
+		s, ok := p.snapshots[request.SnapshotID]
+		if !ok {
+			return nil, flex.NewError(flex.ErrorCodeNotFound, "snapshot %q not found", request.SnapshotID)
+		}
+		if s.Regions[0] != region || request.SizeGigabytes < int64(s.MinDiskSize) {
+			return nil, flex.NewError(flex.ErrorCodeAPIError, "snapshot %q can only be restored at region %q to volumes of at least %dGB",
+				s.ID, s.Regions[0], s.MinDiskSize)
+		}
+	}
+
+	p.volumeSeq++
+	v := &godo.Volume{
+		ID:            fmt.Sprintf("fake-volume-%d", p.volumeSeq),
+		Name:          request.Name,
+		Description:   request.Description,
+		Region:        &godo.Region{Slug: region},
+		SizeGigaBytes: request.SizeGigabytes,
+		DropletIDs:    []int{},
+		CreatedAt:     time.Now(),
+	}
+	p.volumes[v.ID] = v
+	p.requests[v.ID] = *request
+	return copyVolume(v), nil
+}
+
+// DeleteVolume deletes a detached volume
+func (p *Provider) DeleteVolume(volumeID string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.call(MethodDeleteVolume); err != nil {
+		return err
+	}
+
+	v, ok := p.volumes[volumeID]
+	if !ok {
+		return flex.NewError(flex.ErrorCodeNotFound, "volume %q not found", volumeID)
+	}
+	if len(v.DropletIDs) > 0 {
+		return flex.NewError(flex.ErrorCodeAPIError, "volume %q is attached to droplet %d", volumeID, v.DropletIDs[0])
+	}
+	delete(p.volumes, volumeID)
+	delete(p.requests, volumeID)
+	return nil
+}
+
+// CreateSnapshot creates a snapshot of the volume
+func (p *Provider) CreateSnapshot(volumeID, name, description string) (*godo.Snapshot, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.call(MethodCreateSnapshot); err != nil {
+		return nil, err
+	}
+
+	v, ok := p.volumes[volumeID]
+	if !ok {
+		return nil, flex.NewError(flex.ErrorCodeNotFound, "volume %q not found", volumeID)
+	}
+
+	p.snapshotSeq++
+	s := &godo.Snapshot{
+		ID:           fmt.Sprintf("fake-snapshot-%d", p.snapshotSeq),
+		Name:         name,
+		ResourceID:   volumeID,
+		ResourceType: "volume",
+		Regions:      []string{v.Region.Slug},
+		MinDiskSize:  int(v.SizeGigaBytes),
+		Created:      time.Now().UTC().Format(time.RFC3339),
+	}
+	p.snapshots[s.ID] = s
+	return copySnapshot(s), nil
+}
+
+// ListSnapshots returns the snapshots of the volume sorted by ID
+func (p *Provider) ListSnapshots(volumeID string) ([]godo.Snapshot, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.call(MethodListSnapshots); err != nil {
+		return nil, err
+	}
+
+	if _, ok := p.volumes[volumeID]; !ok {
+		return nil, flex.NewError(flex.ErrorCodeNotFound, "volume %q not found", volumeID)
+	}
+
+	ids := []string{}
+	for id, s := range p.snapshots {
+		if s.ResourceID == volumeID {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+
+	snapshots := []godo.Snapshot{}
+	for _, id := range ids {
+		snapshots = append(snapshots, *copySnapshot(p.snapshots[id]))
+	}
+	return snapshots, nil
+}
+
+// GetSnapshot retrieves the snapshot by ID
+func (p *Provider) GetSnapshot(snapshotID string) (*godo.Snapshot, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.call(MethodGetSnapshot); err != nil {
+		return nil, err
+	}
+
+	s, ok := p.snapshots[snapshotID]
+	if !ok {
+		return nil, flex.NewError(flex.ErrorCodeNotFound, "snapshot %q not found", snapshotID)
+	}
+	return copySnapshot(s), nil
+}
+
+// DeleteSnapshot deletes the snapshot
+func (p *Provider) DeleteSnapshot(snapshotID string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.call(MethodDeleteSnapshot); err != nil {
+		return err
+	}
+
+	if _, ok := p.snapshots[snapshotID]; !ok {
+		return flex.NewError(flex.ErrorCodeNotFound, "snapshot %q not found", snapshotID)
+	}
+	delete(p.snapshots, snapshotID)
+	return nil
+}
+
+// call records the call and returns the next queued failure, if any
+func (p *Provider) call(method string) error {
+	p.calls[method]++
+	if errs := p.failures[method]; len(errs) > 0 {
+		p.failures[method] = errs[1:]
+		return errs[0]
+	}
+	return nil
+}
+
+// wait simulates waiting for a storage action to complete. It is called
+// holding p.mu, which is released while sleeping so that other calls
+// are not blocked by the action latency.
+func (p *Provider) wait(volumeID, actionType string) (*godo.Action, error) {
+	p.actionSeq++
+	action := &godo.Action{
+		ID:           p.actionSeq,
+		Status:       godo.ActionCompleted,
+		Type:         actionType,
+		ResourceType: "volume",
+		RegionSlug:   p.region,
+	}
+
+	if p.ActionLatency <= 0 {
+		return action, nil
+	}
+	if p.Timeout > 0 && p.ActionLatency > p.Timeout {
+		p.sleep(p.Timeout)
+		action.Status = godo.ActionInProgress
+		return action, flex.NewRetryableError(flex.ErrorCodeTimeout, "%s action at DigitalOcean for volume %q timed out", actionType, volumeID)
+	}
+	p.sleep(p.ActionLatency)
+	return action, nil
+}
+
+// sleep releases p.mu while sleeping
+func (p *Provider) sleep(d time.Duration) {
+	p.mu.Unlock()
+	defer p.mu.Lock()
+	p.Sleep(d)
+}
+
+func (p *Provider) volumeAndDroplet(volumeID string, dropletID int) (*godo.Volume, *godo.Droplet, error) {
+	v, ok := p.volumes[volumeID]
+	if !ok {
+		return nil, nil, flex.NewError(flex.ErrorCodeNotFound, "volume %q not found", volumeID)
+	}
+	d, ok := p.droplets[dropletID]
+	if !ok {
+		return nil, nil, flex.NewError(flex.ErrorCodeNotFound, "droplet %d not found", dropletID)
+	}
+	return v, d, nil
+}
+
+func copyDroplet(d *godo.Droplet) *godo.Droplet {
+	c := *d
+	c.VolumeIDs = append([]string{}, d.VolumeIDs...)
+	return &c
+}
+
+// listedDroplet returns the droplet as returned by the list call, lacking volumes
+func listedDroplet(d *godo.Droplet) *godo.Droplet {
+	c := *d
+	c.VolumeIDs = nil
+	return &c
+}
+
+func copySnapshot(s *godo.Snapshot) *godo.Snapshot {
+	c := *s
+	c.Regions = append([]string{}, s.Regions...)
+	return &c
+}
+
+func copyVolume(v *godo.Volume) *godo.Volume {
+	c := *v
+	c.DropletIDs = append([]int{}, v.DropletIDs...)
+	return &c
+}
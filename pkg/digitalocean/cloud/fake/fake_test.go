@@ -0,0 +1,54 @@
+package fake
+
+import (
+	"testing"
+	"time"
+)
+
+func TestActionLatencyDoesNotBlockCalls(t *testing.T) {
+	p := NewProvider("nyc1")
+	p.AddDroplet(1, "node-1", "10.0.0.1", "")
+	p.AddVolume("id0123456789", "prueba", 10)
+	p.ActionLatency = time.Second
+
+	// the attach sleeps until woken up
+	sleeping := make(chan time.Duration)
+	wake := make(chan struct{})
+	p.Sleep = func(d time.Duration) {
+		sleeping <- d
+		<-wake
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := p.AttachVolumeAndWait("id0123456789", 1)
+		done <- err
+	}()
+	if d := <-sleeping; d != p.ActionLatency {
+		t.Errorf("expected to sleep for the action latency %s but got %s", p.ActionLatency, d)
+	}
+
+	got := make(chan []int, 1)
+	go func() {
+		v, err := p.GetVolume("id0123456789")
+		if err != nil {
+			t.Errorf("unexpected error: %s", err)
+			got <- nil
+			return
+		}
+		got <- v.DropletIDs
+	}()
+	select {
+	case ids := <-got:
+		if len(ids) != 1 {
+			t.Errorf("expected volume attached while the action completes but got %v", ids)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("expected calls not to wait for pending actions")
+	}
+
+	close(wake)
+	if err := <-done; err != nil {
+		t.Errorf("unexpected error attaching: %s", err)
+	}
+}
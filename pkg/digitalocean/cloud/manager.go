@@ -20,29 +20,58 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"net/http"
+	"os"
+	"strconv"
 	"strings"
-	"time"
 
+	"github.com/StackPointCloud/digitalocean-flex-volume/pkg/flex"
 	"github.com/digitalocean/godo"
 	doctx "github.com/digitalocean/godo/context"
+	"github.com/golang/glog"
 	"golang.org/x/oauth2"
 )
 
 const (
-	godoActionErrored   = "errored"
-	godoActionCheckTick = 1000
+	godoActionErrored = "errored"
 
 	// DevicePrefix for Digital Ocean mounts
-	DevicePrefix             = "/dev/disk/by-id/scsi-0DO_Volume_"
-	dropletRegionMetadataURL = "http://169.254.169.254/metadata/v1/region"
+	DevicePrefix = "/dev/disk/by-id/scsi-0DO_Volume_"
+
+	providerIDPrefix = "digitalocean://"
 )
 
 // DigitalOceanManager communicates with the DO API
 type DigitalOceanManager struct {
-	client *godo.Client
-	region string
+	client       *godo.Client
+	region       string
+	metadataURL  string
+	pollOptions  PollOptions
+	nodeMatchers []namedNodeMatcher
+	cache        *diskCache
+	// hostname of the machine running this process, used to tell
+	// calls about the local node from those made at the controller
+	hostname string
+}
+
+// ManagerOptions configures the DigitalOcean manager, empty values use defaults
+type ManagerOptions struct {
+	// APIURL is the DigitalOcean API base URL
+	APIURL string
+	// MetadataURL is the droplet metadata service base URL
+	MetadataURL string
+	// ActionPoll configures how storage actions are waited for
+	ActionPoll PollOptions
+	// Retry configures how rate limited and failed API requests are retried
+	Retry RetryOptions
+	// NodeMatchers are the ordered strategies used to find the droplet
+	// for a node name, nil uses DefaultNodeMatchers
+	NodeMatchers []string
+	// NodeMappingFile is a JSON file of node names to droplet IDs
+	// used by the mappingFile strategy
+	NodeMappingFile string
+	// Cache configures the on-node lookup cache, a zero TTL disables it
+	Cache CacheOptions
 }
 
 // TokenSource represents and oauth2 token source
@@ -59,22 +88,64 @@ func (t *tokenSource) Token() (*oauth2.Token, error) {
 }
 
 // NewDigitalOceanManager returns a Digitial Ocean manager
-func NewDigitalOceanManager(token string) (*DigitalOceanManager, error) {
+// options might be nil to use the default DigitalOcean endpoints
+func NewDigitalOceanManager(token string, options *ManagerOptions) (*DigitalOceanManager, error) {
 
 	if token == "" {
 		return nil, errors.New("DigitalOcean token is empty")
 	}
 
+	if options == nil {
+		options = &ManagerOptions{
+			ActionPoll: DefaultPollOptions(),
+			Retry:      DefaultRetryOptions(),
+			Cache:      DefaultCacheOptions(),
+		}
+	}
+
+	matcherNames := options.NodeMatchers
+	if matcherNames == nil {
+		matcherNames = DefaultNodeMatchers()
+	}
+	matchers, err := newNodeMatchers(matcherNames, options.NodeMappingFile)
+	if err != nil {
+		return nil, err
+	}
+
+	// the oauth2 client uses the rate limit aware client as its base transport
+	baseClient := &http.Client{
+		Transport: newRateLimitTransport(http.DefaultTransport, options.Retry),
+	}
+	ctx := context.WithValue(oauth2.NoContext, oauth2.HTTPClient, baseClient)
+
 	tokenSource := &tokenSource{AccessToken: token}
-	oauthClient := oauth2.NewClient(oauth2.NoContext, tokenSource)
-	client := godo.NewClient(oauthClient)
+	oauthClient := oauth2.NewClient(ctx, tokenSource)
+
+	clientOpts := []godo.ClientOpt{}
+	if options.APIURL != "" {
+		clientOpts = append(clientOpts, godo.SetBaseURL(options.APIURL))
+	}
+	client, err := godo.New(oauthClient, clientOpts...)
+	if err != nil {
+		return nil, err
+	}
 
 	m := &DigitalOceanManager{
-		client: client,
+		client:       client,
+		metadataURL:  defaultMetadataURL,
+		pollOptions:  options.ActionPoll,
+		nodeMatchers: matchers,
+		cache:        newDiskCache(options.Cache),
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		m.hostname = hostname
+	}
+	if options.MetadataURL != "" {
+		m.metadataURL = options.MetadataURL
 	}
 
 	// generate client and test retrieving account info
-	_, err := m.GetAccount()
+	_, err = m.GetAccount()
 	if err != nil {
 		return nil, err
 	}
@@ -86,28 +157,43 @@ func NewDigitalOceanManager(token string) (*DigitalOceanManager, error) {
 func (m *DigitalOceanManager) GetAccount() (*godo.Account, error) {
 	account, _, err := m.client.Account.Get(doctx.TODO())
 	if err != nil {
-		return nil, err
+		return nil, apiError(err)
 	}
 	return account, nil
 }
 
 // GetDroplet retrieves the droplet by ID
 func (m *DigitalOceanManager) GetDroplet(dropletID int) (*godo.Droplet, error) {
+	droplet := &godo.Droplet{}
+	if m.cache.get(dropletCacheKey(dropletID), droplet) {
+		return droplet, nil
+	}
+	return m.FetchDroplet(dropletID)
+}
+
+// FetchDroplet retrieves the droplet skipping the cache, for decisions
+// that must not rely on stale attached volumes
+func (m *DigitalOceanManager) FetchDroplet(dropletID int) (*godo.Droplet, error) {
 	droplet, _, err := m.client.Droplets.Get(doctx.TODO(), dropletID)
 	if err != nil {
-		return nil, err
+		return nil, apiError(err)
 	}
-	return droplet, err
+	m.cache.set(dropletCacheKey(dropletID), droplet)
+	return droplet, nil
 }
 
 // DropletList return all droplets
 func (m *DigitalOceanManager) DropletList() ([]godo.Droplet, error) {
 	list := []godo.Droplet{}
+	if m.cache.get(cacheKeyDroplets, &list) {
+		return list, nil
+	}
+
 	opt := &godo.ListOptions{}
 	for {
 		droplets, resp, err := m.client.Droplets.List(doctx.TODO(), opt)
 		if err != nil {
-			return nil, err
+			return nil, apiError(err)
 		}
 
 		for _, d := range droplets {
@@ -122,24 +208,38 @@ func (m *DigitalOceanManager) DropletList() ([]godo.Droplet, error) {
 		}
 		opt.Page = page + 1
 	}
+	m.cache.set(cacheKeyDroplets, list)
 	return list, nil
 }
 
 // GetVolume given an unique Digital Ocean identifier returns the volume
 func (m *DigitalOceanManager) GetVolume(volumeID string) (*godo.Volume, error) {
+	vol := &godo.Volume{}
+	if m.cache.get(volumeCacheKey(volumeID), vol) {
+		return vol, nil
+	}
+	return m.fetchVolume(volumeID)
+}
+
+// fetchVolume retrieves the volume skipping the cache, for decisions
+// that must not rely on a stale attachment state or size
+func (m *DigitalOceanManager) fetchVolume(volumeID string) (*godo.Volume, error) {
 	vol, _, err := m.client.Storage.GetVolume(doctx.TODO(), volumeID)
 	if err != nil {
-		return nil, err
+		return nil, apiError(err)
 	}
+	m.cache.set(volumeCacheKey(volumeID), vol)
 	return vol, nil
 }
 
-// GetVolumeByName retrieves a volume given the name
-// region will be obtained using this droplet's metadata
-func (m *DigitalOceanManager) GetVolumeByName(name string) (*godo.Volume, error) {
-	region, err := currentRegion()
-	if err != nil {
-		return nil, err
+// GetVolumeByName retrieves a volume given the name and region,
+// an empty region will be obtained using this droplet's metadata
+func (m *DigitalOceanManager) GetVolumeByName(name, region string) (*godo.Volume, error) {
+	if region == "" {
+		var err error
+		if region, err = m.currentRegion(); err != nil {
+			return nil, err
+		}
 	}
 	p := &godo.ListVolumeParams{
 		Name:   name,
@@ -147,31 +247,130 @@ func (m *DigitalOceanManager) GetVolumeByName(name string) (*godo.Volume, error)
 	}
 	vol, _, err := m.client.Storage.ListVolumes(doctx.TODO(), p)
 	if err != nil {
-		return nil, err
+		return nil, apiError(err)
 	}
 
+	if len(vol) == 0 {
+		return nil, flex.NewError(flex.ErrorCodeNotFound, "could not find volume named %q at region %q", name, region)
+	}
 	if len(vol) != 1 {
-		return nil, fmt.Errorf("found more than one volume named %q at region %q", name, region)
+		return nil, flex.NewError(flex.ErrorCodeAPIError, "found more than one volume named %q at region %q", name, region)
 	}
 
 	return &vol[0], nil
 }
 
+// VolumeRequest describes a volume to be created
+type VolumeRequest struct {
+	Name        string
+	Description string
+	// Region defaults to this droplet's region
+	Region        string
+	SizeGigabytes int64
+	// FilesystemType formats the volume when created, such as ext4 or xfs
+	FilesystemType string
+	Tags           []string
+	// SnapshotID restores the snapshot to the volume, which
+	// must be at the snapshot region and at least its size
+	SnapshotID string
+}
+
+// volumeCreateRequest is the volume creation API request,
+// including the fields not supported by godo
+type volumeCreateRequest struct {
+	godo.VolumeCreateRequest
+	FilesystemType string   `json:"filesystem_type,omitempty"`
+	Tags           []string `json:"tags,omitempty"`
+}
+
+// CreateVolume creates a detached volume
+func (m *DigitalOceanManager) CreateVolume(request *VolumeRequest) (*godo.Volume, error) {
+	region := request.Region
+	if region == "" {
+		var err error
+		region, err = m.currentRegion()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	body := &volumeCreateRequest{
+		VolumeCreateRequest: godo.VolumeCreateRequest{
+			Region:        region,
+			Name:          request.Name,
+			Description:   request.Description,
+			SizeGigaBytes: request.SizeGigabytes,
+			SnapshotID:    request.SnapshotID,
+		},
+		FilesystemType: request.FilesystemType,
+		Tags:           request.Tags,
+	}
+	req, err := m.client.NewRequest(doctx.TODO(), http.MethodPost, "v2/volumes", body)
+	if err != nil {
+		return nil, err
+	}
+
+	root := struct {
+		Volume *godo.Volume `json:"volume"`
+	}{}
+	if _, err := m.client.Do(doctx.TODO(), req, &root); err != nil {
+		return nil, apiError(err)
+	}
+
+	glog.Infof("created %dGB volume %q named %q at region %q", request.SizeGigabytes, root.Volume.ID, request.Name, region)
+	return root.Volume, nil
+}
+
+// DeleteVolume deletes a detached volume
+func (m *DigitalOceanManager) DeleteVolume(volumeID string) error {
+	defer m.cache.invalidate()
+
+	if _, err := m.client.Storage.DeleteVolume(doctx.TODO(), volumeID); err != nil {
+		return apiError(err)
+	}
+
+	glog.Infof("deleted volume %q", volumeID)
+	return nil
+}
+
 // AttachVolumeAndWait attaches volume to given droplet
-// it will wait until the attach action is completed
-func (m *DigitalOceanManager) AttachVolumeAndWait(volumeID string, dropletID int, timeout time.Duration) error {
+// it will wait until the attach action is completed and return it
+func (m *DigitalOceanManager) AttachVolumeAndWait(volumeID string, dropletID int) (*godo.Action, error) {
+	defer m.cache.invalidate()
+
 	action, _, err := m.client.StorageActions.Attach(doctx.TODO(), volumeID, dropletID)
 	if err != nil {
-		return err
+		return nil, apiError(err)
+	}
+
+	return m.waitVolumeActionCompleted(volumeID, action)
+}
+
+// ResizeVolumeAndWait grows the volume to the given size in gigabytes
+// it will wait until the resize action is completed and return it,
+// no action is returned if the volume is already big enough
+func (m *DigitalOceanManager) ResizeVolumeAndWait(volumeID string, sizeGigabytes int) (*godo.Action, error) {
+	vol, err := m.fetchVolume(volumeID)
+	if err != nil {
+		return nil, err
 	}
 
-	err = m.waitVolumeActionCompleted(volumeID, action.ID, timeout)
+	if vol.SizeGigaBytes >= int64(sizeGigabytes) {
+		return nil, nil
+	}
+
+	if vol.Region == nil {
+		return nil, fmt.Errorf("could not find region for volume %q", volumeID)
+	}
+
+	defer m.cache.invalidate()
+
+	action, _, err := m.client.StorageActions.Resize(doctx.TODO(), volumeID, sizeGigabytes, vol.Region.Slug)
 	if err != nil {
-		return err
+		return nil, apiError(err)
 	}
 
-	return nil
-	// DevicePrefix + vol.Name, nil
+	return m.waitVolumeActionCompleted(volumeID, action)
 }
 
 // VolumeNameFromDevicePath given a device path returns a volume name
@@ -192,10 +391,14 @@ func (m *DigitalOceanManager) DeviceFromVolumeID(volumeID string) (string, error
 }
 
 // DetachVolumeAndWait detaches a disk to given droplet
-func (m *DigitalOceanManager) DetachVolumeAndWait(volumeID string, dropletID int, timeout time.Duration) error {
-	vol, err := m.GetVolume(volumeID)
+// it will wait until the detach action is completed and return it,
+// no action is returned if the volume was not attached to the droplet
+func (m *DigitalOceanManager) DetachVolumeAndWait(volumeID string, dropletID int) (*godo.Action, error) {
+	defer m.cache.invalidate()
+
+	vol, err := m.fetchVolume(volumeID)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	needDetach := false
@@ -205,136 +408,137 @@ func (m *DigitalOceanManager) DetachVolumeAndWait(volumeID string, dropletID int
 		}
 	}
 
-	if needDetach {
-		action, _, err := m.client.StorageActions.DetachByDropletID(doctx.TODO(), volumeID, dropletID)
-		if err != nil {
-			return err
-		}
-
-		err = m.waitVolumeActionCompleted(volumeID, action.ID, timeout)
-		if err != nil {
-			return err
-		}
+	if !needDetach {
+		return nil, nil
 	}
 
-	return nil
+	action, _, err := m.client.StorageActions.DetachByDropletID(doctx.TODO(), volumeID, dropletID)
+	if err != nil {
+		return nil, apiError(err)
+	}
 
+	return m.waitVolumeActionCompleted(volumeID, action)
 }
 
-// FindDropletFromNodeName retrieves the droplet given the kubernetes node name
-// Droplet name and Node name should match.
-// If not, we will try to match the name with private and public IP
+// FindDropletFromNodeName retrieves the droplet given the kubernetes node name.
+// Provider IDs of the form digitalocean://<id> are resolved directly.
+// When the node is the local host the droplet ID is obtained from the
+// metadata service. Otherwise droplets are listed to find one matching
+// the node name using the configured strategies.
 func (m *DigitalOceanManager) FindDropletFromNodeName(node string) (*godo.Droplet, error) {
 
-	// try to find droplet with same name as the kubernetes node
+	if strings.HasPrefix(node, providerIDPrefix) {
+		id, err := strconv.Atoi(strings.TrimPrefix(node, providerIDPrefix))
+		if err != nil {
+			return nil, flex.NewError(flex.ErrorCodeInvalidOptions, "could not parse droplet ID from provider ID %q", node)
+		}
+		return m.GetDroplet(id)
+	}
+
+	// calls made at the node itself are about the local droplet, the
+	// controller manager would only pay an extra request for each of them
+	if m.isLocalNode(node) {
+		id, err := m.localDropletID()
+		if err == nil {
+			droplet, err := m.GetDroplet(id)
+			if err != nil {
+				return nil, err
+			}
+			if d := m.matchDroplet(node, []godo.Droplet{*droplet}); d != nil {
+				return d, nil
+			}
+		} else {
+			glog.V(2).Infof("could not retrieve local droplet ID, listing droplets: %s", err.Error())
+		}
+	}
+
 	droplets, err := m.DropletList()
 	if err != nil {
 		return nil, err
 	}
 
-	for _, droplet := range droplets {
-		if droplet.Name == node {
-			return &droplet, nil
-		}
+	if d := m.matchDroplet(node, droplets); d != nil {
+		return d, nil
 	}
 
-	// Alternative: if not found,
-	// Internal or External IP seems to be our safest bet when names doesn't match
-	for _, droplet := range droplets {
-		ip, err := droplet.PrivateIPv4()
-		if err != nil {
-			return nil, err
-		}
-		if ip == node {
-			return &droplet, nil
-		}
-		ip, err = droplet.PublicIPv4()
+	names := []string{}
+	for _, matcher := range m.nodeMatchers {
+		names = append(names, matcher.name)
+	}
+	return nil, flex.NewError(flex.ErrorCodeNotFound, "could not match node name %q to a droplet using strategies %s", node, strings.Join(names, ", "))
+}
+
+// isLocalNode returns true if the node name is the local hostname,
+// either fully qualified or not
+func (m *DigitalOceanManager) isLocalNode(node string) bool {
+	if m.hostname == "" {
+		return false
+	}
+	short := strings.SplitN(m.hostname, ".", 2)[0]
+	return strings.EqualFold(node, m.hostname) || strings.EqualFold(node, short)
+}
+
+// matchDroplet applies the node matching strategies in order,
+// skipping those that fail
+func (m *DigitalOceanManager) matchDroplet(node string, droplets []godo.Droplet) *godo.Droplet {
+	for _, matcher := range m.nodeMatchers {
+		d, err := matcher.match(node, droplets)
 		if err != nil {
-			return nil, err
+			glog.Warningf("skipping node matching strategy %q: %s", matcher.name, err.Error())
+			continue
 		}
-		if ip == node {
-			return &droplet, nil
+		if d != nil {
+			glog.V(2).Infof("node %q matched droplet %d using strategy %q", node, d.ID, matcher.name)
+			return d
 		}
 	}
-
-	return nil, fmt.Errorf("could not match node name to droplet name, private IP or public IP")
+	return nil
 }
 
-func (m *DigitalOceanManager) waitVolumeActionCompleted(volumeID string, actionID int, timeout time.Duration) error {
+// waitVolumeActionCompleted polls the storage action until it is completed,
+// returning the last known action state
+func (m *DigitalOceanManager) waitVolumeActionCompleted(volumeID string, action *godo.Action) (*godo.Action, error) {
 	var lastError error
 
-	ctx, cancel := context.WithTimeout(context.TODO(), timeout)
-	defer cancel()
-	ticker := time.NewTicker(time.Second * godoActionCheckTick)
-	defer ticker.Stop()
-	for {
-		select {
-		case <-ticker.C:
-			action, _, err := m.client.StorageActions.Get(ctx, volumeID, actionID)
-			if err != nil {
-				lastError = err
-			}
+	p := newPoller(m.pollOptions)
+	err := p.poll(context.TODO(), func(ctx context.Context, attempt int) (bool, error) {
+		a, _, err := m.client.StorageActions.Get(ctx, volumeID, action.ID)
+		if err != nil {
+			lastError = apiError(err)
+			glog.Warningf("polling %s action %d for volume %q, attempt %d failed: %s", action.Type, action.ID, volumeID, attempt, err.Error())
+			return false, nil
+		}
 
-			if action.Status == godo.ActionCompleted {
-				return nil
-			}
-			if action.Status == godoActionErrored {
-				return fmt.Errorf("there was and storage action error at DigitalOcean: %s", action.String())
-			}
-			if action.Status != godo.ActionInProgress {
-				return fmt.Errorf("received unexpected action status %q from DigitalOcean", action.Status)
-			}
-		case <-ctx.Done():
-			msg := fmt.Sprintf("storage creation at DigitalOcean for volume %q timed out", volumeID)
-			if lastError != nil {
-				msg += ": " + lastError.Error()
+		action = a
+		glog.V(2).Infof("polling %s action %d for volume %q, attempt %d: %s", action.Type, action.ID, volumeID, attempt, action.Status)
+
+		switch action.Status {
+		case godo.ActionCompleted:
+			return true, nil
+		case godo.ActionInProgress:
+			return false, nil
+		case godoActionErrored:
+			return false, flex.NewError(flex.ErrorCodeActionFailed, "there was and storage action error at DigitalOcean: %s", action.String())
+		default:
+			return false, flex.NewError(flex.ErrorCodeActionFailed, "received unexpected action status %q from DigitalOcean", action.Status)
+		}
+	})
+
+	if err == context.DeadlineExceeded {
+		e := flex.NewRetryableError(flex.ErrorCodeTimeout, "%s action %d at DigitalOcean for volume %q timed out after %s with status %q",
+			action.Type, action.ID, volumeID, p.options.Timeout, action.Status)
+		if lastError != nil {
+			e.Message += ": " + lastError.Error()
+			if fe, ok := lastError.(*flex.Error); ok {
+				e.RequestID = fe.RequestID
 			}
-			return fmt.Errorf(msg)
 		}
+		return action, e
 	}
-
-	// for {
-	// 	action, _, err := m.client.StorageActions.Get(doctx.TODO(), volumeID, actionID)
-	// 	if err != nil {
-	// 		lastError = err
-	// 	}
-	// 	switch action.Status {
-	// 	case godo.ActionCompleted:
-	// 		return nil
-	// 	case godoActionErrored:
-	// 		return fmt.Errorf("There was and storage action error at Digital Ocean: %s", action.String())
-	// 	case godo.ActionInProgress:
-	// 	default:
-	// 		return fmt.Errorf("Received unexpected action status %q from Digital Ocean", action.Status)
-	// 	}
-	// 	if time.Second*timeout < time.Since(start) {
-	// 		errMsg := "Timeout attaching volume " + volumeID
-	// 		if lastError != nil {
-	// 			errMsg += lastError.Error()
-	// 		}
-	// 		return fmt.Errorf(errMsg)
-	// 	}
-	// 	time.Sleep(godoActionTimeSpan * time.Millisecond)
-	// }
-}
-
-// currentRegion returns the current region for the droplet
-func currentRegion() (string, error) {
-	resp, err := http.Get(dropletRegionMetadataURL)
-	if err != nil {
-		return "", err
-	}
-
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("error retrieving droplet region: %d", resp.StatusCode)
-	}
-
-	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return "", err
+		return action, err
 	}
 
-	return string(body), nil
+	glog.Infof("%s action %d for volume %q completed", action.Type, action.ID, volumeID)
+	return action, nil
 }
@@ -0,0 +1,509 @@
+package cloud
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/StackPointCloud/digitalocean-flex-volume/pkg/digitalocean/cloud/stub"
+	"github.com/StackPointCloud/digitalocean-flex-volume/pkg/flex"
+)
+
+func newStubManager(t *testing.T, s *stub.Server) *DigitalOceanManager {
+	m, err := NewDigitalOceanManager("token", &ManagerOptions{
+		APIURL:      s.APIURL(),
+		MetadataURL: s.MetadataURL(),
+		ActionPoll: PollOptions{
+			InitialInterval: time.Millisecond,
+			MaxInterval:     5 * time.Millisecond,
+			Timeout:         time.Second,
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error creating manager against stub server: %s", err)
+	}
+	return m
+}
+
+func TestDropletListPagination(t *testing.T) {
+	s := stub.NewServer("nyc1", 1)
+	defer s.Close()
+	s.PerPage = 2
+	for i := 1; i <= 5; i++ {
+		s.AddDroplet(i, fmt.Sprintf("node-%d", i), fmt.Sprintf("10.0.0.%d", i), "")
+	}
+
+	m := newStubManager(t, s)
+	droplets, err := m.DropletList()
+	if err != nil {
+		t.Fatalf("unexpected error listing droplets: %s", err)
+	}
+	if len(droplets) != 5 {
+		t.Errorf("expected 5 droplets but got %d", len(droplets))
+	}
+	for i, d := range droplets {
+		if d.ID != i+1 {
+			t.Errorf("expected droplet %d at position %d but got %d", i+1, i, d.ID)
+		}
+	}
+	if n := s.CountRequests("GET /v2/droplets"); n != 3 {
+		t.Errorf("expected 3 droplet list requests but got %d", n)
+	}
+}
+
+func TestFindDropletFromNodeName(t *testing.T) {
+	s := stub.NewServer("nyc1", 1)
+	defer s.Close()
+	s.PerPage = 1
+	s.AddDroplet(1, "node-1", "10.0.0.1", "192.0.2.1")
+	s.AddDroplet(2, "node-2", "10.0.0.2", "192.0.2.2")
+
+	m := newStubManager(t, s)
+	cases := []struct {
+		node       string
+		expectedID int
+	}{
+		{"node-2", 2},
+		{"10.0.0.1", 1},
+		{"192.0.2.2", 2},
+	}
+	for _, c := range cases {
+		d, err := m.FindDropletFromNodeName(c.node)
+		if err != nil {
+			t.Errorf("unexpected error finding droplet for node %q: %s", c.node, err)
+			continue
+		}
+		if d.ID != c.expectedID {
+			t.Errorf("node %q expected droplet %d but got %d", c.node, c.expectedID, d.ID)
+		}
+	}
+
+	_, err := m.FindDropletFromNodeName("unknown")
+	if fe, ok := err.(*flex.Error); !ok || fe.Code != flex.ErrorCodeNotFound {
+		t.Errorf("expected not found error for unknown node but got %v", err)
+	}
+}
+
+func TestGetVolumeByName(t *testing.T) {
+	s := stub.NewServer("nyc1", 1)
+	defer s.Close()
+	s.AddVolume("id0123456789", "prueba", 10)
+
+	m := newStubManager(t, s)
+	vol, err := m.GetVolumeByName("prueba", "")
+	if err != nil {
+		t.Fatalf("unexpected error getting volume by name: %s", err)
+	}
+	if vol.ID != "id0123456789" {
+		t.Errorf("expected volume %q but got %q", "id0123456789", vol.ID)
+	}
+	if n := s.CountRequests("GET " + stub.MetadataPath + "region"); n != 1 {
+		t.Errorf("expected 1 region metadata request but got %d", n)
+	}
+
+	// explicit regions need no metadata
+	if vol, err := m.GetVolumeByName("prueba", "nyc1"); err != nil || vol.ID != "id0123456789" {
+		t.Errorf("expected volume %q at region nyc1 but got %+v, %v", "id0123456789", vol, err)
+	}
+	_, err = m.GetVolumeByName("prueba", "sfo2")
+	if fe, ok := err.(*flex.Error); !ok || fe.Code != flex.ErrorCodeNotFound {
+		t.Errorf("expected not found error at other region but got %v", err)
+	}
+	if n := s.CountRequests("GET " + stub.MetadataPath + "region"); n != 1 {
+		t.Errorf("expected no further region metadata request but got %d", n-1)
+	}
+
+	_, err = m.GetVolumeByName("unknown", "")
+	if fe, ok := err.(*flex.Error); !ok || fe.Code != flex.ErrorCodeNotFound {
+		t.Errorf("expected not found error for unknown volume but got %v", err)
+	}
+
+	s.AddVolume("id9876543210", "prueba", 10)
+	_, err = m.GetVolumeByName("prueba", "")
+	if fe, ok := err.(*flex.Error); !ok || fe.Code != flex.ErrorCodeAPIError {
+		t.Errorf("expected %s error for duplicated volume name but got %v", flex.ErrorCodeAPIError, err)
+	}
+}
+
+func TestErrorResponses(t *testing.T) {
+	s := stub.NewServer("nyc1", 1)
+	defer s.Close()
+	s.AddDroplet(1, "node-1", "10.0.0.1", "192.0.2.1")
+
+	s.FailNext("GET /v2/account", http.StatusUnauthorized)
+	_, err := NewDigitalOceanManager("token", &ManagerOptions{APIURL: s.APIURL(), MetadataURL: s.MetadataURL()})
+	if fe, ok := err.(*flex.Error); !ok || fe.Code != flex.ErrorCodeUnauthorized || fe.RequestID == "" {
+		t.Errorf("expected unauthorized error with request ID but got %v", err)
+	}
+
+	m := newStubManager(t, s)
+	cases := []struct {
+		status            int
+		expectedCode      string
+		expectedRetryable bool
+	}{
+		{http.StatusTooManyRequests, flex.ErrorCodeRateLimited, true},
+		{http.StatusInternalServerError, flex.ErrorCodeAPIUnavailable, true},
+		{http.StatusNotFound, flex.ErrorCodeNotFound, false},
+	}
+	for _, c := range cases {
+		s.FailNext("GET /v2/droplets/1", c.status)
+		_, err := m.GetDroplet(1)
+		fe, ok := err.(*flex.Error)
+		if !ok || fe.Code != c.expectedCode || fe.Retryable != c.expectedRetryable {
+			t.Errorf("status %d expected code %q and retryable %t but got %v", c.status, c.expectedCode, c.expectedRetryable, err)
+		}
+	}
+}
+
+func TestVolumeActionsAndWait(t *testing.T) {
+	s := stub.NewServer("nyc1", 1)
+	defer s.Close()
+	s.ActionPolls = 2
+	s.AddDroplet(1, "node-1", "10.0.0.1", "192.0.2.1")
+	s.AddVolume("id0123456789", "prueba", 10)
+
+	m := newStubManager(t, s)
+	action, err := m.AttachVolumeAndWait("id0123456789", 1)
+	if err != nil {
+		t.Fatalf("unexpected error attaching volume: %s", err)
+	}
+	if action.Status != "completed" || action.Type != "attach" {
+		t.Errorf("expected completed attach action but got %+v", action)
+	}
+	if n := s.CountRequests(fmt.Sprintf("GET /v2/volumes/id0123456789/actions/%d", action.ID)); n != 3 {
+		t.Errorf("expected 3 action polls but got %d", n)
+	}
+	if v := s.Volume("id0123456789"); len(v.DropletIDs) != 1 || v.DropletIDs[0] != 1 {
+		t.Errorf("expected volume attached to droplet 1 but got %v", v.DropletIDs)
+	}
+
+	// a failed poll is retried
+	s.FailNext("GET /v2/volumes/id0123456789/actions/", http.StatusServiceUnavailable)
+	action, err = m.ResizeVolumeAndWait("id0123456789", 20)
+	if err != nil {
+		t.Fatalf("unexpected error resizing volume: %s", err)
+	}
+	if action.Status != "completed" {
+		t.Errorf("expected completed resize action but got %+v", action)
+	}
+
+	// resizing to a smaller size is a no-op
+	action, err = m.ResizeVolumeAndWait("id0123456789", 5)
+	if err != nil || action != nil {
+		t.Errorf("expected no action shrinking volume but got %+v, %v", action, err)
+	}
+
+	action, err = m.DetachVolumeAndWait("id0123456789", 1)
+	if err != nil {
+		t.Fatalf("unexpected error detaching volume: %s", err)
+	}
+	if action.Status != "completed" || action.Type != "detach" {
+		t.Errorf("expected completed detach action but got %+v", action)
+	}
+	if v := s.Volume("id0123456789"); len(v.DropletIDs) != 0 {
+		t.Errorf("expected detached volume but got %v", v.DropletIDs)
+	}
+
+	// detaching a detached volume is a no-op
+	action, err = m.DetachVolumeAndWait("id0123456789", 1)
+	if err != nil || action != nil {
+		t.Errorf("expected no action detaching a detached volume but got %+v, %v", action, err)
+	}
+}
+
+func TestVolumeActionFailures(t *testing.T) {
+	s := stub.NewServer("nyc1", 1)
+	defer s.Close()
+	s.AddDroplet(1, "node-1", "10.0.0.1", "192.0.2.1")
+	s.AddVolume("id0123456789", "prueba", 10)
+
+	m := newStubManager(t, s)
+	s.ActionStatus = "errored"
+	action, err := m.AttachVolumeAndWait("id0123456789", 1)
+	if fe, ok := err.(*flex.Error); !ok || fe.Code != flex.ErrorCodeActionFailed {
+		t.Errorf("expected action failed error but got %v", err)
+	}
+	if action == nil || action.Status != "errored" {
+		t.Errorf("expected errored action state but got %+v", action)
+	}
+
+	s.ActionStatus = "completed"
+	s.ActionPolls = 1000
+	m.pollOptions.Timeout = 20 * time.Millisecond
+	action, err = m.DetachVolumeAndWait("id0123456789", 1)
+	if fe, ok := err.(*flex.Error); !ok || fe.Code != flex.ErrorCodeTimeout || !fe.Retryable {
+		t.Errorf("expected retryable timeout error but got %v", err)
+	}
+	if action == nil || action.Status != "in-progress" {
+		t.Errorf("expected in progress action state but got %+v", action)
+	}
+}
+
+func TestRateLimitedRequestsAreRetried(t *testing.T) {
+	s := stub.NewServer("nyc1", 1)
+	defer s.Close()
+	s.RetryAfter = "0"
+	s.AddDroplet(1, "node-1", "10.0.0.1", "192.0.2.1")
+
+	m, err := NewDigitalOceanManager("token", &ManagerOptions{
+		APIURL:      s.APIURL(),
+		MetadataURL: s.MetadataURL(),
+		Retry:       RetryOptions{MaxRetries: 2, InitialBackoff: time.Millisecond},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error creating manager against stub server: %s", err)
+	}
+
+	s.FailNext("GET /v2/droplets/1", http.StatusTooManyRequests)
+	s.FailNext("GET /v2/droplets/1", http.StatusInternalServerError)
+	if _, err := m.GetDroplet(1); err != nil {
+		t.Errorf("unexpected error getting droplet after retries: %s", err)
+	}
+	if n := s.CountRequests("GET /v2/droplets/1"); n != 3 {
+		t.Errorf("expected 3 droplet requests but got %d", n)
+	}
+}
+
+func TestFindDropletFromMetadata(t *testing.T) {
+	s := stub.NewServer("nyc1", 2)
+	defer s.Close()
+	s.AddDroplet(1, "node-1", "10.0.0.1", "192.0.2.1")
+	s.AddDroplet(2, "node-2", "10.0.0.2", "192.0.2.2")
+	s.AddDroplet(3, "node-3", "", "192.0.2.3")
+
+	m := newStubManager(t, s)
+	m.hostname = "node-2.example.com"
+	cases := []struct {
+		node         string
+		expectedID   int
+		expectedList bool
+	}{
+		// the local droplet is resolved without listing droplets
+		{"node-2", 2, false},
+		// node names other than the local hostname are not looked up at metadata
+		{"10.0.0.2", 2, true},
+		// provider IDs are resolved directly
+		{"digitalocean://3", 3, false},
+		// other nodes are found listing droplets
+		{"node-1", 1, true},
+	}
+	for _, c := range cases {
+		before := s.CountRequests("GET /v2/droplets") - s.CountRequests("GET /v2/droplets/")
+		d, err := m.FindDropletFromNodeName(c.node)
+		if err != nil {
+			t.Errorf("unexpected error finding droplet for node %q: %s", c.node, err)
+			continue
+		}
+		if d.ID != c.expectedID {
+			t.Errorf("node %q expected droplet %d but got %d", c.node, c.expectedID, d.ID)
+		}
+		after := s.CountRequests("GET /v2/droplets") - s.CountRequests("GET /v2/droplets/")
+		if listed := after > before; listed != c.expectedList {
+			t.Errorf("node %q expected droplet list %t but got %t", c.node, c.expectedList, listed)
+		}
+	}
+
+	if _, err := m.FindDropletFromNodeName("digitalocean://abc"); err == nil {
+		t.Errorf("expected error for invalid provider ID")
+	}
+
+	metadataRequests := s.CountRequests("GET " + stub.MetadataPath + "id")
+	if metadataRequests != 1 {
+		t.Errorf("expected 1 droplet ID metadata request for the local node name but got %d", metadataRequests)
+	}
+
+	// metadata failures fall back to listing droplets
+	s.FailNext("GET "+stub.MetadataPath+"id", http.StatusInternalServerError)
+	d, err := m.FindDropletFromNodeName("node-2")
+	if err != nil || d.ID != 2 {
+		t.Errorf("expected droplet 2 after metadata failure but got %+v, %v", d, err)
+	}
+
+	// without a known hostname, as at the controller manager, metadata is never asked
+	m.hostname = ""
+	metadataRequests = s.CountRequests("GET " + stub.MetadataPath + "id")
+	if d, err := m.FindDropletFromNodeName("node-2"); err != nil || d.ID != 2 {
+		t.Errorf("expected droplet 2 listing droplets but got %+v, %v", d, err)
+	}
+	if n := s.CountRequests("GET " + stub.MetadataPath + "id"); n != metadataRequests {
+		t.Errorf("expected no droplet ID metadata request for other nodes but got %d", n-metadataRequests)
+	}
+}
+
+func TestLookupCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := stub.NewServer("nyc1", 1)
+	defer s.Close()
+	s.AddDroplet(1, "node-1", "10.0.0.1", "192.0.2.1")
+	s.AddVolume("id0123456789", "prueba", 10)
+
+	options := &ManagerOptions{
+		APIURL:      s.APIURL(),
+		MetadataURL: s.MetadataURL(),
+		ActionPoll:  PollOptions{InitialInterval: time.Millisecond},
+		Cache:       CacheOptions{Dir: dir, TTL: time.Minute},
+	}
+	m, err := NewDigitalOceanManager("token", options)
+	if err != nil {
+		t.Fatalf("unexpected error creating manager against stub server: %s", err)
+	}
+
+	// lookups are shared by managers using the same cache directory
+	m.GetDroplet(1)
+	m.DropletList()
+	m.GetVolume("id0123456789")
+	other, err := NewDigitalOceanManager("token", options)
+	if err != nil {
+		t.Fatalf("unexpected error creating manager against stub server: %s", err)
+	}
+	other.GetDroplet(1)
+	other.DropletList()
+	vol, err := other.GetVolume("id0123456789")
+	if err != nil || vol.Name != "prueba" {
+		t.Errorf("expected cached volume but got %+v, %v", vol, err)
+	}
+	if n := s.CountRequests("GET /v2/droplets/1"); n != 1 {
+		t.Errorf("expected 1 droplet request but got %d", n)
+	}
+	if n := s.CountRequests("GET /v2/droplets") - s.CountRequests("GET /v2/droplets/"); n != 1 {
+		t.Errorf("expected 1 droplet list request but got %d", n)
+	}
+	if n := s.CountRequests("GET /v2/volumes/id0123456789"); n != 1 {
+		t.Errorf("expected 1 volume request but got %d", n)
+	}
+
+	// attaching invalidates the cache
+	if _, err := m.AttachVolumeAndWait("id0123456789", 1); err != nil {
+		t.Fatalf("unexpected error attaching volume: %s", err)
+	}
+	vol, err = other.GetVolume("id0123456789")
+	if err != nil || len(vol.DropletIDs) != 1 {
+		t.Errorf("expected attached volume after invalidation but got %+v, %v", vol, err)
+	}
+
+	// detaching from elsewhere leaves the cached droplet stale, but not the fetched one
+	if droplet, err := m.GetDroplet(1); err != nil || len(droplet.VolumeIDs) != 1 {
+		t.Fatalf("expected droplet with the attached volume but got %+v, %v", droplet, err)
+	}
+	uncached := *options
+	uncached.Cache.TTL = 0
+	elsewhere, err := NewDigitalOceanManager("token", &uncached)
+	if err != nil {
+		t.Fatalf("unexpected error creating manager against stub server: %s", err)
+	}
+	if _, err := elsewhere.DetachVolumeAndWait("id0123456789", 1); err != nil {
+		t.Fatalf("unexpected error detaching volume: %s", err)
+	}
+	if droplet, err := m.GetDroplet(1); err != nil || len(droplet.VolumeIDs) != 1 {
+		t.Errorf("expected cached droplet but got %+v, %v", droplet, err)
+	}
+	if droplet, err := m.FetchDroplet(1); err != nil || len(droplet.VolumeIDs) != 0 {
+		t.Errorf("expected fetched droplet without volumes but got %+v, %v", droplet, err)
+	}
+	if droplet, err := other.GetDroplet(1); err != nil || len(droplet.VolumeIDs) != 0 {
+		t.Errorf("expected fetched droplet to refresh the cache but got %+v, %v", droplet, err)
+	}
+
+	// bypassed lookups reach the API
+	options.Cache.Bypass = true
+	bypassed, err := NewDigitalOceanManager("token", options)
+	if err != nil {
+		t.Fatalf("unexpected error creating manager against stub server: %s", err)
+	}
+	before := s.CountRequests("GET /v2/droplets/1")
+	bypassed.GetDroplet(1)
+	if n := s.CountRequests("GET /v2/droplets/1") - before; n != 1 {
+		t.Errorf("expected bypassed droplet request but got %d", n)
+	}
+}
+
+func TestCreateAndDeleteVolume(t *testing.T) {
+	s := stub.NewServer("nyc1", 1)
+	defer s.Close()
+	s.AddDroplet(1, "node-1", "10.0.0.1", "192.0.2.1")
+
+	m := newStubManager(t, s)
+	vol, err := m.CreateVolume(&VolumeRequest{
+		Name:           "pvc-1",
+		SizeGigabytes:  5,
+		FilesystemType: "xfs",
+		Tags:           []string{"k8s"},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error creating volume: %s", err)
+	}
+	// the region defaults to this droplet's region
+	if vol.Name != "pvc-1" || vol.SizeGigaBytes != 5 || vol.Region == nil || vol.Region.Slug != "nyc1" {
+		t.Errorf("unexpected created volume %+v", vol)
+	}
+	if a := s.CreatedVolumeAttributes(vol.ID); a.FilesystemType != "xfs" || len(a.Tags) != 1 || a.Tags[0] != "k8s" {
+		t.Errorf("expected filesystem type and tags to be requested but got %+v", a)
+	}
+
+	_, err = m.CreateVolume(&VolumeRequest{Name: "pvc-1", Region: "nyc1", SizeGigabytes: 5})
+	if fe, ok := err.(*flex.Error); !ok || fe.Code != flex.ErrorCodeAPIError {
+		t.Errorf("expected API error creating a duplicated volume but got %v", err)
+	}
+
+	if _, err := m.AttachVolumeAndWait(vol.ID, 1); err != nil {
+		t.Fatalf("unexpected error attaching volume: %s", err)
+	}
+	if err := m.DeleteVolume(vol.ID); err == nil {
+		t.Errorf("expected error deleting an attached volume")
+	}
+	if _, err := m.DetachVolumeAndWait(vol.ID, 1); err != nil {
+		t.Fatalf("unexpected error detaching volume: %s", err)
+	}
+	if err := m.DeleteVolume(vol.ID); err != nil {
+		t.Errorf("unexpected error deleting volume: %s", err)
+	}
+	err = m.DeleteVolume(vol.ID)
+	if fe, ok := err.(*flex.Error); !ok || fe.Code != flex.ErrorCodeNotFound {
+		t.Errorf("expected not found error deleting a deleted volume but got %v", err)
+	}
+}
+
+func TestSnapshots(t *testing.T) {
+	s := stub.NewServer("nyc1", 1)
+	defer s.Close()
+	s.AddVolume("id0123456789", "prueba", 10)
+
+	m := newStubManager(t, s)
+	snapshot, err := m.CreateSnapshot("id0123456789", "backup", "")
+	if err != nil {
+		t.Fatalf("unexpected error creating snapshot: %s", err)
+	}
+	if snapshot.ResourceID != "id0123456789" || snapshot.MinDiskSize != 10 {
+		t.Errorf("unexpected snapshot %+v", snapshot)
+	}
+
+	snapshots, err := m.ListSnapshots("id0123456789")
+	if err != nil || len(snapshots) != 1 || snapshots[0].ID != snapshot.ID {
+		t.Errorf("expected the created snapshot to be listed but got %+v, %v", snapshots, err)
+	}
+
+	vol, err := m.CreateVolume(&VolumeRequest{Name: "restored", Region: "nyc1", SizeGigabytes: 10, SnapshotID: snapshot.ID})
+	if err != nil || vol.Name != "restored" {
+		t.Errorf("expected volume restored from snapshot but got %+v, %v", vol, err)
+	}
+	if _, err := m.CreateVolume(&VolumeRequest{Name: "small", Region: "nyc1", SizeGigabytes: 5, SnapshotID: snapshot.ID}); err == nil {
+		t.Errorf("expected error restoring snapshot to a smaller volume")
+	}
+
+	if err := m.DeleteSnapshot(snapshot.ID); err != nil {
+		t.Errorf("unexpected error deleting snapshot: %s", err)
+	}
+	_, err = m.GetSnapshot(snapshot.ID)
+	if fe, ok := err.(*flex.Error); !ok || fe.Code != flex.ErrorCodeNotFound {
+		t.Errorf("expected not found error for deleted snapshot but got %v", err)
+	}
+}
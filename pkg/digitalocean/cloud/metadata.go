@@ -0,0 +1,62 @@
+package cloud
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/StackPointCloud/digitalocean-flex-volume/pkg/flex"
+)
+
+const (
+	defaultMetadataURL = "http://169.254.169.254/metadata/v1/"
+	regionMetadataPath = "region"
+	idMetadataPath     = "id"
+
+	// the metadata service is link local, it either answers quickly or
+	// this process is not running at a droplet
+	metadataTimeout = 2 * time.Second
+)
+
+var metadataClient = &http.Client{Timeout: metadataTimeout}
+
+// currentRegion returns the current region for the droplet
+func (m *DigitalOceanManager) currentRegion() (string, error) {
+	return m.metadata(regionMetadataPath)
+}
+
+// localDropletID returns the ID of the droplet running this process
+func (m *DigitalOceanManager) localDropletID() (int, error) {
+	v, err := m.metadata(idMetadataPath)
+	if err != nil {
+		return 0, err
+	}
+	id, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, flex.NewError(flex.ErrorCodeMetadata, "could not parse droplet ID %q from metadata: %s", v, err.Error())
+	}
+	return id, nil
+}
+
+// metadata retrieves a droplet metadata value
+func (m *DigitalOceanManager) metadata(path string) (string, error) {
+	resp, err := metadataClient.Get(m.metadataURL + path)
+	if err != nil {
+		return "", flex.NewRetryableError(flex.ErrorCodeMetadata, "could not reach droplet metadata service: %s", err.Error())
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", flex.NewRetryableError(flex.ErrorCodeMetadata, "error retrieving droplet %s: %d", path, resp.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(body)), nil
+}
@@ -0,0 +1,158 @@
+package cloud
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/digitalocean/godo"
+)
+
+// Strategies to match kubernetes node names to droplets
+const (
+	// NodeMatchName matches the droplet name
+	NodeMatchName = "name"
+	// NodeMatchShortName matches the droplet name to the node name stripped of its domain
+	NodeMatchShortName = "shortName"
+	// NodeMatchTag matches droplets tagged k8s-node:<node name>
+	NodeMatchTag = "tag"
+	// NodeMatchPrivateIP matches the droplet private IPv4
+	NodeMatchPrivateIP = "privateIP"
+	// NodeMatchPublicIP matches the droplet public IPv4
+	NodeMatchPublicIP = "publicIP"
+	// NodeMatchMappingFile matches the droplet ID using a static node name to droplet ID file
+	NodeMatchMappingFile = "mappingFile"
+
+	nodeTagPrefix = "k8s-node:"
+)
+
+// DefaultNodeMatchers returns the default node matching strategies, in order
+func DefaultNodeMatchers() []string {
+	return []string{NodeMatchName, NodeMatchTag, NodeMatchPrivateIP, NodeMatchPublicIP}
+}
+
+// nodeMatcher finds the droplet for a node among a droplet list
+type nodeMatcher interface {
+	// match returns the matching droplet, or nil if none matches.
+	// An error means the strategy could not be applied.
+	match(node string, droplets []godo.Droplet) (*godo.Droplet, error)
+}
+
+// nodeMatcherFunc adapts a function matching a single droplet to a nodeMatcher
+type nodeMatcherFunc func(node string, droplet *godo.Droplet) bool
+
+func (f nodeMatcherFunc) match(node string, droplets []godo.Droplet) (*godo.Droplet, error) {
+	for i := range droplets {
+		if f(node, &droplets[i]) {
+			return &droplets[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// newNodeMatchers returns the named strategies, in order
+func newNodeMatchers(names []string, mappingFile string) ([]namedNodeMatcher, error) {
+	matchers := []namedNodeMatcher{}
+	for _, name := range names {
+		var m nodeMatcher
+		switch name {
+		case NodeMatchName:
+			m = nodeMatcherFunc(matchName)
+		case NodeMatchShortName:
+			m = nodeMatcherFunc(matchShortName)
+		case NodeMatchTag:
+			m = nodeMatcherFunc(matchTag)
+		case NodeMatchPrivateIP:
+			m = nodeMatcherFunc(matchPrivateIP)
+		case NodeMatchPublicIP:
+			m = nodeMatcherFunc(matchPublicIP)
+		case NodeMatchMappingFile:
+			if mappingFile == "" {
+				return nil, fmt.Errorf("node matching strategy %q needs a node mapping file", name)
+			}
+			m = &mappingFileMatcher{file: mappingFile}
+		default:
+			return nil, fmt.Errorf("unknown node matching strategy %q", name)
+		}
+		matchers = append(matchers, namedNodeMatcher{name: name, nodeMatcher: m})
+	}
+	return matchers, nil
+}
+
+// namedNodeMatcher is a strategy and the name it was configured with
+type namedNodeMatcher struct {
+	nodeMatcher
+	name string
+}
+
+func matchName(node string, droplet *godo.Droplet) bool {
+	return droplet.Name == node
+}
+
+func matchShortName(node string, droplet *godo.Droplet) bool {
+	if net.ParseIP(node) != nil {
+		return false
+	}
+	i := strings.Index(node, ".")
+	if i <= 0 {
+		return false
+	}
+	return droplet.Name == node[:i]
+}
+
+func matchTag(node string, droplet *godo.Droplet) bool {
+	for _, tag := range droplet.Tags {
+		if tag == nodeTagPrefix+node {
+			return true
+		}
+	}
+	return false
+}
+
+// matchPrivateIP skips droplets without private networking
+func matchPrivateIP(node string, droplet *godo.Droplet) bool {
+	ip, err := droplet.PrivateIPv4()
+	return err == nil && ip != "" && ip == node
+}
+
+func matchPublicIP(node string, droplet *godo.Droplet) bool {
+	ip, err := droplet.PublicIPv4()
+	return err == nil && ip != "" && ip == node
+}
+
+// mappingFileMatcher reads a JSON object of node names to droplet IDs
+type mappingFileMatcher struct {
+	file string
+
+	once    sync.Once
+	mapping map[string]int
+	err     error
+}
+
+func (m *mappingFileMatcher) match(node string, droplets []godo.Droplet) (*godo.Droplet, error) {
+	m.once.Do(func() {
+		var c []byte
+		c, m.err = ioutil.ReadFile(m.file)
+		if m.err != nil {
+			return
+		}
+		m.err = json.Unmarshal(c, &m.mapping)
+	})
+	if m.err != nil {
+		return nil, fmt.Errorf("could not read node mapping file %s: %s", m.file, m.err.Error())
+	}
+
+	id, ok := m.mapping[node]
+	if !ok {
+		return nil, nil
+	}
+	for i := range droplets {
+		if droplets[i].ID == id {
+			return &droplets[i], nil
+		}
+	}
+	return nil, nil
+}
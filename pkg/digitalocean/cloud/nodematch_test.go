@@ -0,0 +1,99 @@
+package cloud
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/digitalocean/godo"
+)
+
+func testDroplets() []godo.Droplet {
+	return []godo.Droplet{
+		// droplet without networking information
+		{ID: 1, Name: "orphan"},
+		{ID: 2, Name: "web", Networks: &godo.Networks{V4: []godo.NetworkV4{
+			{IPAddress: "192.0.2.2", Type: "public"},
+		}}},
+		{ID: 3, Name: "worker-3", Tags: []string{"k8s", "k8s-node:node-3.example.com"}, Networks: &godo.Networks{V4: []godo.NetworkV4{
+			{IPAddress: "10.0.0.3", Type: "private"},
+			{IPAddress: "192.0.2.3", Type: "public"},
+		}}},
+		{ID: 4, Name: "db.example.com"},
+	}
+}
+
+func TestNodeMatchers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nodematch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	mappingFile := filepath.Join(dir, "nodes.json")
+	if err := ioutil.WriteFile(mappingFile, []byte(`{"node-x": 2}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		strategy   string
+		node       string
+		expectedID int
+	}{
+		{NodeMatchName, "web", 2},
+		{NodeMatchName, "web.example.com", 0},
+		{NodeMatchName, "db.example.com", 4},
+		{NodeMatchShortName, "web.example.com", 2},
+		{NodeMatchShortName, "web", 0},
+		{NodeMatchShortName, "192.0.2.2", 0},
+		{NodeMatchTag, "node-3.example.com", 3},
+		{NodeMatchTag, "k8s", 0},
+		{NodeMatchPrivateIP, "10.0.0.3", 3},
+		{NodeMatchPrivateIP, "192.0.2.3", 0},
+		{NodeMatchPrivateIP, "", 0},
+		{NodeMatchPublicIP, "192.0.2.2", 2},
+		{NodeMatchMappingFile, "node-x", 2},
+		{NodeMatchMappingFile, "node-y", 0},
+	}
+
+	for _, c := range cases {
+		matchers, err := newNodeMatchers([]string{c.strategy}, mappingFile)
+		if err != nil {
+			t.Fatalf("unexpected error creating strategy %q: %s", c.strategy, err)
+		}
+		d, err := matchers[0].match(c.node, testDroplets())
+		if err != nil {
+			t.Errorf("strategy %q node %q unexpected error: %s", c.strategy, c.node, err)
+			continue
+		}
+		id := 0
+		if d != nil {
+			id = d.ID
+		}
+		if id != c.expectedID {
+			t.Errorf("strategy %q node %q expected droplet %d but got %d", c.strategy, c.node, c.expectedID, id)
+		}
+	}
+}
+
+func TestMatchDropletSkipsFailingStrategies(t *testing.T) {
+	matchers, err := newNodeMatchers([]string{NodeMatchMappingFile, NodeMatchPrivateIP, NodeMatchPublicIP}, "/nonexistent/nodes.json")
+	if err != nil {
+		t.Fatalf("unexpected error creating strategies: %s", err)
+	}
+
+	m := &DigitalOceanManager{nodeMatchers: matchers}
+	d := m.matchDroplet("192.0.2.3", testDroplets())
+	if d == nil || d.ID != 3 {
+		t.Errorf("expected droplet 3 but got %+v", d)
+	}
+}
+
+func TestNewNodeMatchersErrors(t *testing.T) {
+	if _, err := newNodeMatchers([]string{"hostname"}, ""); err == nil {
+		t.Errorf("expected error for unknown strategy")
+	}
+	if _, err := newNodeMatchers([]string{NodeMatchMappingFile}, ""); err == nil {
+		t.Errorf("expected error for mapping file strategy without file")
+	}
+}
@@ -0,0 +1,123 @@
+package cloud
+
+import (
+	"context"
+	"math/rand"
+	"time"
+)
+
+const (
+	defaultPollInitialInterval = time.Second
+	defaultPollFactor          = 1.5
+	defaultPollJitter          = 0.2
+	defaultPollMaxInterval     = 10 * time.Second
+	defaultPollTimeout         = 3 * time.Minute
+)
+
+// PollOptions configures how DigitalOcean actions are polled.
+// Zero durations and factor are replaced by defaults, a zero jitter disables it.
+type PollOptions struct {
+	// InitialInterval is the wait before the first poll
+	InitialInterval time.Duration
+	// Factor multiplies the interval after each poll
+	Factor float64
+	// Jitter randomizes each interval by up to this fraction
+	Jitter float64
+	// MaxInterval caps the interval between polls
+	MaxInterval time.Duration
+	// Timeout is the overall deadline for the action to finish
+	Timeout time.Duration
+}
+
+// DefaultPollOptions returns the default action polling options
+func DefaultPollOptions() PollOptions {
+	return PollOptions{
+		InitialInterval: defaultPollInitialInterval,
+		Factor:          defaultPollFactor,
+		Jitter:          defaultPollJitter,
+		MaxInterval:     defaultPollMaxInterval,
+		Timeout:         defaultPollTimeout,
+	}
+}
+
+// withDefaults returns a copy of the options with defaults for unset values
+func (o PollOptions) withDefaults() PollOptions {
+	if o.InitialInterval <= 0 {
+		o.InitialInterval = defaultPollInitialInterval
+	}
+	if o.Factor < 1 {
+		o.Factor = defaultPollFactor
+	}
+	if o.Jitter < 0 || o.Jitter >= 1 {
+		o.Jitter = 0
+	}
+	if o.MaxInterval <= 0 {
+		o.MaxInterval = defaultPollMaxInterval
+	}
+	if o.MaxInterval < o.InitialInterval {
+		o.MaxInterval = o.InitialInterval
+	}
+	if o.Timeout <= 0 {
+		o.Timeout = defaultPollTimeout
+	}
+	return o
+}
+
+// poller calls a condition function with exponential backoff until it is done
+type poller struct {
+	options PollOptions
+	random  *rand.Rand
+}
+
+func newPoller(options PollOptions) *poller {
+	return &poller{
+		options: options.withDefaults(),
+		random:  rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// poll calls condition until it returns done or an error,
+// returning the context error if the deadline is reached first
+func (p *poller) poll(ctx context.Context, condition func(ctx context.Context, attempt int) (bool, error)) error {
+	ctx, cancel := context.WithTimeout(ctx, p.options.Timeout)
+	defer cancel()
+
+	interval := p.options.InitialInterval
+	for attempt := 1; ; attempt++ {
+		timer := time.NewTimer(p.jitter(interval))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+
+		done, err := condition(ctx, attempt)
+		if err != nil {
+			return err
+		}
+		if done {
+			return nil
+		}
+
+		interval = p.next(interval)
+	}
+}
+
+// next returns the interval following the given one
+func (p *poller) next(interval time.Duration) time.Duration {
+	next := time.Duration(float64(interval) * p.options.Factor)
+	if next > p.options.MaxInterval {
+		return p.options.MaxInterval
+	}
+	return next
+}
+
+// jitter randomizes the interval within the configured fraction
+func (p *poller) jitter(interval time.Duration) time.Duration {
+	if p.options.Jitter == 0 {
+		return interval
+	}
+	delta := p.options.Jitter * (2*p.random.Float64() - 1)
+	return time.Duration(float64(interval) * (1 + delta))
+}
@@ -0,0 +1,65 @@
+package cloud
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestPollerBackoff(t *testing.T) {
+	p := newPoller(PollOptions{
+		InitialInterval: time.Second,
+		Factor:          2,
+		MaxInterval:     5 * time.Second,
+	})
+
+	expected := []time.Duration{2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}
+	interval := p.options.InitialInterval
+	for i, e := range expected {
+		interval = p.next(interval)
+		if interval != e {
+			t.Errorf("interval %d expected %s but got %s", i+1, e, interval)
+		}
+	}
+}
+
+func TestPollerJitter(t *testing.T) {
+	p := newPoller(PollOptions{InitialInterval: time.Second, Jitter: 0.25})
+	for i := 0; i < 100; i++ {
+		j := p.jitter(time.Second)
+		if j < 750*time.Millisecond || j > 1250*time.Millisecond {
+			t.Fatalf("jittered interval %s out of bounds", j)
+		}
+	}
+}
+
+func TestPollerDefaults(t *testing.T) {
+	o := PollOptions{Jitter: 2}.withDefaults()
+	if o.InitialInterval != defaultPollInitialInterval || o.Factor != defaultPollFactor ||
+		o.MaxInterval != defaultPollMaxInterval || o.Timeout != defaultPollTimeout || o.Jitter != 0 {
+		t.Errorf("unexpected defaults %+v", o)
+	}
+}
+
+func TestPoll(t *testing.T) {
+	p := newPoller(PollOptions{InitialInterval: time.Millisecond, MaxInterval: time.Millisecond, Timeout: time.Second})
+	attempts := 0
+	err := p.poll(context.Background(), func(ctx context.Context, attempt int) (bool, error) {
+		attempts = attempt
+		return attempt == 3, nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error polling: %s", err)
+	}
+	if attempts != 3 {
+		t.Errorf("expected 3 attempts but got %d", attempts)
+	}
+
+	p = newPoller(PollOptions{InitialInterval: time.Millisecond, MaxInterval: time.Millisecond, Timeout: 20 * time.Millisecond})
+	err = p.poll(context.Background(), func(ctx context.Context, attempt int) (bool, error) {
+		return false, nil
+	})
+	if err != context.DeadlineExceeded {
+		t.Errorf("expected deadline exceeded but got %v", err)
+	}
+}
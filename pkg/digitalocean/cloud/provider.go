@@ -0,0 +1,39 @@
+package cloud
+
+import (
+	"github.com/digitalocean/godo"
+)
+
+// Provider is the set of DigitalOcean operations used by the volume plugin
+type Provider interface {
+	// GetDroplet retrieves the droplet by ID
+	GetDroplet(dropletID int) (*godo.Droplet, error)
+	// FetchDroplet retrieves the droplet by ID skipping the lookup cache
+	FetchDroplet(dropletID int) (*godo.Droplet, error)
+	// FindDropletFromNodeName retrieves the droplet given the kubernetes node name or provider ID
+	FindDropletFromNodeName(node string) (*godo.Droplet, error)
+	// GetVolume given an unique Digital Ocean identifier returns the volume
+	GetVolume(volumeID string) (*godo.Volume, error)
+	// GetVolumeByName lists the volumes at the region, the current one if empty, to find one by name
+	GetVolumeByName(name, region string) (*godo.Volume, error)
+	// AttachVolumeAndWait attaches volume to given droplet and waits for the action
+	AttachVolumeAndWait(volumeID string, dropletID int) (*godo.Action, error)
+	// DetachVolumeAndWait detaches volume from given droplet and waits for the action
+	DetachVolumeAndWait(volumeID string, dropletID int) (*godo.Action, error)
+	// ResizeVolumeAndWait grows the volume and waits for the action
+	ResizeVolumeAndWait(volumeID string, sizeGigabytes int) (*godo.Action, error)
+	// CreateVolume creates a detached volume
+	CreateVolume(request *VolumeRequest) (*godo.Volume, error)
+	// DeleteVolume deletes a detached volume
+	DeleteVolume(volumeID string) error
+	// CreateSnapshot creates a snapshot of the volume
+	CreateSnapshot(volumeID, name, description string) (*godo.Snapshot, error)
+	// ListSnapshots returns all the snapshots of the volume
+	ListSnapshots(volumeID string) ([]godo.Snapshot, error)
+	// GetSnapshot retrieves the snapshot by ID
+	GetSnapshot(snapshotID string) (*godo.Snapshot, error)
+	// DeleteSnapshot deletes the snapshot
+	DeleteSnapshot(snapshotID string) error
+}
+
+var _ Provider = &DigitalOceanManager{}
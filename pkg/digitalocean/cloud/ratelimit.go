@@ -0,0 +1,279 @@
+package cloud
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+var errBodyNotReplayable = errors.New("request body can not be replayed for retry")
+
+const (
+	headerRateLimit     = "RateLimit-Limit"
+	headerRateRemaining = "RateLimit-Remaining"
+	headerRateReset     = "RateLimit-Reset"
+	headerRetryAfter    = "Retry-After"
+
+	defaultMaxRetries     = 4
+	defaultInitialBackoff = time.Second
+	defaultMaxBackoff     = 30 * time.Second
+	defaultLowBudget      = 100
+)
+
+// RetryOptions configures how DigitalOcean API requests are retried
+// and paced. Zero durations are replaced by defaults, zero retries
+// disable retrying and a zero low budget disables pacing.
+type RetryOptions struct {
+	// MaxRetries is the number of retries for rate limited or failed requests
+	MaxRetries int
+	// InitialBackoff is the wait before the first retry, doubled on each retry
+	InitialBackoff time.Duration
+	// MaxBackoff caps any wait, including those requested by the API headers.
+	// Requests that would need a longer wait fail instead.
+	MaxBackoff time.Duration
+	// LowBudget is the number of remaining requests under which
+	// requests are spread over the time left until the limit resets
+	LowBudget int
+}
+
+// DefaultRetryOptions returns the default API retry options
+func DefaultRetryOptions() RetryOptions {
+	return RetryOptions{
+		MaxRetries:     defaultMaxRetries,
+		InitialBackoff: defaultInitialBackoff,
+		MaxBackoff:     defaultMaxBackoff,
+		LowBudget:      defaultLowBudget,
+	}
+}
+
+// withDefaults returns a copy of the options with defaults for unset values
+func (o RetryOptions) withDefaults() RetryOptions {
+	if o.MaxRetries < 0 {
+		o.MaxRetries = 0
+	}
+	if o.InitialBackoff <= 0 {
+		o.InitialBackoff = defaultInitialBackoff
+	}
+	if o.MaxBackoff <= 0 {
+		o.MaxBackoff = defaultMaxBackoff
+	}
+	if o.LowBudget < 0 {
+		o.LowBudget = 0
+	}
+	return o
+}
+
+// rateLimitTransport retries rate limited and failed requests
+// honoring the DigitalOcean rate limit headers
+type rateLimitTransport struct {
+	base    http.RoundTripper
+	options RetryOptions
+	now     func() time.Time
+
+	mu        sync.Mutex
+	limit     int
+	remaining int
+	reset     time.Time
+}
+
+func newRateLimitTransport(base http.RoundTripper, options RetryOptions) *rateLimitTransport {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &rateLimitTransport{
+		base:      base,
+		options:   options.withDefaults(),
+		now:       time.Now,
+		remaining: -1,
+	}
+}
+
+// RoundTrip executes the request, retrying 429 responses, and 5xx
+// responses and network errors for idempotent methods
+func (t *rateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := t.sleep(req.Context(), t.pace()); err != nil {
+		return nil, err
+	}
+
+	backoff := t.options.InitialBackoff
+	for attempt := 0; ; attempt++ {
+		r := req
+		if attempt > 0 && req.Body != nil {
+			if req.GetBody == nil {
+				return nil, errBodyNotReplayable
+			}
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			// requests must not be modified by transports
+			r = new(http.Request)
+			*r = *req
+			r.Body = body
+		}
+
+		resp, err := t.base.RoundTrip(r)
+		if resp != nil {
+			t.updateRate(resp)
+		}
+
+		if attempt >= t.options.MaxRetries || !t.retryable(req, resp, err) {
+			return resp, err
+		}
+
+		wait := t.jitter(backoff)
+		if resp != nil {
+			if w, ok := t.headerWait(resp); ok {
+				wait = w
+			}
+		}
+		if wait > t.options.MaxBackoff {
+			glog.Warningf("DigitalOcean API %s %s needs to wait %s before retrying, more than the maximum %s",
+				req.Method, req.URL.Path, wait, t.options.MaxBackoff)
+			return resp, err
+		}
+
+		if err != nil {
+			glog.Warningf("DigitalOcean API %s %s failed, retry %d in %s: %s", req.Method, req.URL.Path, attempt+1, wait, err.Error())
+		} else {
+			glog.Warningf("DigitalOcean API %s %s returned %d, retry %d in %s", req.Method, req.URL.Path, resp.StatusCode, attempt+1, wait)
+			drain(resp)
+		}
+
+		if err := t.sleep(req.Context(), wait); err != nil {
+			return nil, err
+		}
+
+		backoff *= 2
+		if backoff > t.options.MaxBackoff {
+			backoff = t.options.MaxBackoff
+		}
+	}
+}
+
+// retryable returns true if the request can be sent again
+func (t *rateLimitTransport) retryable(req *http.Request, resp *http.Response, err error) bool {
+	if err != nil {
+		return idempotent(req.Method) && req.Context().Err() == nil
+	}
+	if resp.StatusCode == http.StatusTooManyRequests {
+		// rate limited requests are not processed by the API
+		return true
+	}
+	return resp.StatusCode >= http.StatusInternalServerError && idempotent(req.Method)
+}
+
+// headerWait returns the wait requested by the API response headers
+func (t *rateLimitTransport) headerWait(resp *http.Response) (time.Duration, bool) {
+	if v := resp.Header.Get(headerRetryAfter); v != "" {
+		if seconds, err := strconv.Atoi(v); err == nil && seconds >= 0 {
+			return time.Duration(seconds) * time.Second, true
+		}
+		if date, err := http.ParseTime(v); err == nil {
+			return positive(date.Sub(t.now())), true
+		}
+	}
+
+	if resp.StatusCode == http.StatusTooManyRequests {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		if t.remaining == 0 && !t.reset.IsZero() {
+			return positive(t.reset.Sub(t.now())), true
+		}
+	}
+	return 0, false
+}
+
+// updateRate records the rate limit budget reported at the response
+func (t *rateLimitTransport) updateRate(resp *http.Response) {
+	limit, err := strconv.Atoi(resp.Header.Get(headerRateLimit))
+	if err != nil {
+		return
+	}
+	remaining, err := strconv.Atoi(resp.Header.Get(headerRateRemaining))
+	if err != nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.limit = limit
+	t.remaining = remaining
+	if reset, err := strconv.ParseInt(resp.Header.Get(headerRateReset), 10, 64); err == nil {
+		t.reset = time.Unix(reset, 0)
+	}
+
+	if remaining < t.options.LowBudget {
+		glog.Warningf("DigitalOcean API rate limit budget is low: %d of %d requests remaining until %s", remaining, limit, t.reset)
+	} else {
+		glog.V(2).Infof("DigitalOcean API rate limit budget: %d of %d requests remaining", remaining, limit)
+	}
+}
+
+// pace returns the wait needed before the next request to spread
+// the remaining budget until the rate limit resets
+func (t *rateLimitTransport) pace() time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.options.LowBudget == 0 || t.remaining < 0 || t.remaining >= t.options.LowBudget || t.reset.IsZero() {
+		return 0
+	}
+
+	left := t.reset.Sub(t.now())
+	if left <= 0 {
+		return 0
+	}
+	wait := left / time.Duration(t.remaining+1)
+	if wait > t.options.MaxBackoff {
+		wait = t.options.MaxBackoff
+	}
+	return wait
+}
+
+func (t *rateLimitTransport) jitter(d time.Duration) time.Duration {
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+func (t *rateLimitTransport) sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func idempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+func positive(d time.Duration) time.Duration {
+	if d < 0 {
+		return 0
+	}
+	return d
+}
+
+// drain discards the response body so the connection can be reused
+func drain(resp *http.Response) {
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+}
@@ -0,0 +1,130 @@
+package cloud
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func newTestTransport(options RetryOptions) *rateLimitTransport {
+	return newRateLimitTransport(http.DefaultTransport, options)
+}
+
+func TestRateLimitTransportRetries(t *testing.T) {
+	cases := []struct {
+		method           string
+		statuses         []int
+		expectedStatus   int
+		expectedRequests int
+	}{
+		{http.MethodGet, []int{http.StatusTooManyRequests, http.StatusOK}, http.StatusOK, 2},
+		{http.MethodGet, []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusOK}, http.StatusOK, 3},
+		{http.MethodGet, []int{http.StatusNotFound}, http.StatusNotFound, 1},
+		{http.MethodGet, []int{http.StatusTooManyRequests, http.StatusTooManyRequests, http.StatusTooManyRequests}, http.StatusTooManyRequests, 3},
+		{http.MethodPost, []int{http.StatusTooManyRequests, http.StatusAccepted}, http.StatusAccepted, 2},
+		{http.MethodPost, []int{http.StatusInternalServerError, http.StatusAccepted}, http.StatusInternalServerError, 1},
+	}
+
+	for _, c := range cases {
+		requests := 0
+		bodies := []string{}
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			b, _ := ioutil.ReadAll(r.Body)
+			bodies = append(bodies, string(b))
+			w.WriteHeader(c.statuses[requests])
+			requests++
+		}))
+
+		tr := newTestTransport(RetryOptions{MaxRetries: 2, InitialBackoff: time.Millisecond, MaxBackoff: 10 * time.Millisecond})
+		req, _ := http.NewRequest(c.method, srv.URL, bytes.NewBufferString(`{"type":"attach"}`))
+		resp, err := tr.RoundTrip(req)
+		srv.Close()
+
+		if err != nil {
+			t.Errorf("%s %v unexpected error: %s", c.method, c.statuses, err)
+			continue
+		}
+		if resp.StatusCode != c.expectedStatus {
+			t.Errorf("%s %v expected status %d but got %d", c.method, c.statuses, c.expectedStatus, resp.StatusCode)
+		}
+		if requests != c.expectedRequests {
+			t.Errorf("%s %v expected %d requests but got %d", c.method, c.statuses, c.expectedRequests, requests)
+		}
+		for _, b := range bodies {
+			if b != `{"type":"attach"}` {
+				t.Errorf("%s %v retried request with body %q", c.method, c.statuses, b)
+			}
+		}
+	}
+}
+
+func TestRateLimitTransportHeaders(t *testing.T) {
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			w.Header().Set(headerRetryAfter, "60")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	// the API asks for a longer wait than allowed, the response is returned
+	tr := newTestTransport(RetryOptions{MaxRetries: 2, InitialBackoff: time.Millisecond, MaxBackoff: time.Second})
+	req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+	resp, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if resp.StatusCode != http.StatusTooManyRequests || requests != 1 {
+		t.Errorf("expected a single rate limited request but got status %d after %d requests", resp.StatusCode, requests)
+	}
+
+	now := time.Unix(time.Now().Unix(), 0)
+	tr.now = func() time.Time { return now }
+	resp = &http.Response{StatusCode: http.StatusTooManyRequests, Header: http.Header{}}
+	resp.Header.Set(headerRateLimit, "5000")
+	resp.Header.Set(headerRateRemaining, "0")
+	resp.Header.Set(headerRateReset, strconv.FormatInt(now.Add(30*time.Second).Unix(), 10))
+	tr.updateRate(resp)
+	if wait, ok := tr.headerWait(resp); !ok || wait != 30*time.Second {
+		t.Errorf("expected 30s wait until the limit resets but got %s", wait)
+	}
+
+	resp.Header.Set(headerRetryAfter, now.Add(10*time.Second).UTC().Format(http.TimeFormat))
+	if wait, ok := tr.headerWait(resp); !ok || wait != 10*time.Second {
+		t.Errorf("expected 10s wait from Retry-After date but got %s", wait)
+	}
+}
+
+func TestRateLimitTransportPace(t *testing.T) {
+	now := time.Unix(time.Now().Unix(), 0)
+	tr := newTestTransport(RetryOptions{LowBudget: 100, MaxBackoff: time.Minute})
+	tr.now = func() time.Time { return now }
+
+	if wait := tr.pace(); wait != 0 {
+		t.Errorf("expected no pacing without rate information but got %s", wait)
+	}
+
+	resp := &http.Response{Header: http.Header{}}
+	resp.Header.Set(headerRateLimit, "5000")
+	resp.Header.Set(headerRateReset, strconv.FormatInt(now.Add(100*time.Second).Unix(), 10))
+
+	resp.Header.Set(headerRateRemaining, "4000")
+	tr.updateRate(resp)
+	if wait := tr.pace(); wait != 0 {
+		t.Errorf("expected no pacing with enough budget but got %s", wait)
+	}
+
+	resp.Header.Set(headerRateRemaining, "9")
+	tr.updateRate(resp)
+	if wait := tr.pace(); wait != 10*time.Second {
+		t.Errorf("expected 10s pacing with low budget but got %s", wait)
+	}
+}
@@ -0,0 +1,65 @@
+package cloud
+
+import (
+	"github.com/digitalocean/godo"
+	doctx "github.com/digitalocean/godo/context"
+	"github.com/golang/glog"
+)
+
+// CreateSnapshot creates a snapshot of the volume
+func (m *DigitalOceanManager) CreateSnapshot(volumeID, name, description string) (*godo.Snapshot, error) {
+	request := &godo.SnapshotCreateRequest{
+		VolumeID:    volumeID,
+		Name:        name,
+		Description: description,
+	}
+	snapshot, _, err := m.client.Storage.CreateSnapshot(doctx.TODO(), request)
+	if err != nil {
+		return nil, apiError(err)
+	}
+
+	glog.Infof("created snapshot %q named %q of volume %q", snapshot.ID, name, volumeID)
+	return snapshot, nil
+}
+
+// ListSnapshots returns all the snapshots of the volume
+func (m *DigitalOceanManager) ListSnapshots(volumeID string) ([]godo.Snapshot, error) {
+	list := []godo.Snapshot{}
+	opt := &godo.ListOptions{}
+	for {
+		snapshots, resp, err := m.client.Storage.ListSnapshots(doctx.TODO(), volumeID, opt)
+		if err != nil {
+			return nil, apiError(err)
+		}
+
+		list = append(list, snapshots...)
+		if resp.Links == nil || resp.Links.IsLastPage() {
+			break
+		}
+		page, err := resp.Links.CurrentPage()
+		if err != nil {
+			return nil, err
+		}
+		opt.Page = page + 1
+	}
+	return list, nil
+}
+
+// GetSnapshot retrieves the snapshot by ID
+func (m *DigitalOceanManager) GetSnapshot(snapshotID string) (*godo.Snapshot, error) {
+	snapshot, _, err := m.client.Storage.GetSnapshot(doctx.TODO(), snapshotID)
+	if err != nil {
+		return nil, apiError(err)
+	}
+	return snapshot, nil
+}
+
+// DeleteSnapshot deletes the snapshot
+func (m *DigitalOceanManager) DeleteSnapshot(snapshotID string) error {
+	if _, err := m.client.Storage.DeleteSnapshot(doctx.TODO(), snapshotID); err != nil {
+		return apiError(err)
+	}
+
+	glog.Infof("deleted snapshot %q", snapshotID)
+	return nil
+}
@@ -0,0 +1,639 @@
+// Package stub provides a local DigitalOcean API and droplet metadata
+// server, so the godo code paths can be tested without internet access.
+package stub
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/digitalocean/godo"
+)
+
+const (
+	// MetadataPath is the path where the droplet metadata service is served
+	MetadataPath = "/metadata/v1/"
+
+	defaultPerPage   = 20
+	defaultRateLimit = 5000
+)
+
+// Server is a stub of the DigitalOcean v2 API endpoints used by the manager
+type Server struct {
+	*httptest.Server
+
+	// PerPage is the list page size used when the request does not set one
+	PerPage int
+	// ActionPolls is the number of action status requests answered
+	// as in-progress before the action is completed
+	ActionPolls int
+	// ActionStatus is the final status for storage actions, defaults to completed
+	ActionStatus string
+	// RateLimit is the number of API requests allowed until the limit resets
+	RateLimit int
+	// RetryAfter is the Retry-After header value sent with 429 failures
+	RetryAfter string
+
+	mu          sync.Mutex
+	account     godo.Account
+	region      string
+	dropletID   int
+	droplets    []*godo.Droplet
+	volumes     map[string]*godo.Volume
+	created     map[string]VolumeAttributes
+	volumeSeq   int
+	snapshots   map[string]*godo.Snapshot
+	snapshotSeq int
+	actions     map[int]*action
+	actionSeq   int
+	failures    []failure
+	requests    []string
+	apiCalls    int
+	rateReset   time.Time
+}
+
+type action struct {
+	godo.Action
+	volumeID string
+	polls    int
+}
+
+// VolumeAttributes are the volume creation fields not returned by godo
+type VolumeAttributes struct {
+	FilesystemType string
+	Tags           []string
+}
+
+type failure struct {
+	route  string
+	status int
+}
+
+// NewServer starts a stub server for the region, answering metadata
+// requests as the droplet with the given ID
+func NewServer(region string, dropletID int) *Server {
+	s := &Server{
+		PerPage:      defaultPerPage,
+		ActionStatus: godo.ActionCompleted,
+		RateLimit:    defaultRateLimit,
+		rateReset:    time.Now().Add(time.Hour),
+		account:      godo.Account{Email: "stub@example.com", UUID: "stub", Status: "active", EmailVerified: true},
+		region:       region,
+		dropletID:    dropletID,
+		volumes:      map[string]*godo.Volume{},
+		created:      map[string]VolumeAttributes{},
+		snapshots:    map[string]*godo.Snapshot{},
+		actions:      map[int]*action{},
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// APIURL returns the base URL to be used by godo
+func (s *Server) APIURL() string {
+	return s.URL + "/"
+}
+
+// MetadataURL returns the base URL of the droplet metadata service
+func (s *Server) MetadataURL() string {
+	return s.URL + MetadataPath
+}
+
+// AddDroplet creates a droplet, IP addresses are optional
+func (s *Server) AddDroplet(id int, name, privateIP, publicIP string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	d := &godo.Droplet{
+		ID:        id,
+		Name:      name,
+		Region:    &godo.Region{Slug: s.region},
+		Networks:  &godo.Networks{},
+		VolumeIDs: []string{},
+	}
+	if privateIP != "" {
+		d.Networks.V4 = append(d.Networks.V4, godo.NetworkV4{IPAddress: privateIP, Type: "private"})
+	}
+	if publicIP != "" {
+		d.Networks.V4 = append(d.Networks.V4, godo.NetworkV4{IPAddress: publicIP, Type: "public"})
+	}
+	s.droplets = append(s.droplets, d)
+}
+
+// AddVolume creates a detached volume
+func (s *Server) AddVolume(id, name string, sizeGigabytes int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.volumes[id] = &godo.Volume{
+		ID:            id,
+		Name:          name,
+		Region:        &godo.Region{Slug: s.region},
+		SizeGigaBytes: sizeGigabytes,
+		DropletIDs:    []int{},
+		CreatedAt:     time.Now(),
+	}
+}
+
+// Volume returns a copy of the stored volume
+func (s *Server) Volume(id string) *godo.Volume {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	v, ok := s.volumes[id]
+	if !ok {
+		return nil
+	}
+	c := *v
+	c.DropletIDs = append([]int{}, v.DropletIDs...)
+	return &c
+}
+
+// CreatedVolumeAttributes returns the filesystem type and tags
+// requested when the volume was created through the API
+func (s *Server) CreatedVolumeAttributes(id string) VolumeAttributes {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.created[id]
+}
+
+// FailNext makes the next request matching the route fail with the HTTP status.
+// Routes are the request method and a path prefix, as in "GET /v2/droplets".
+func (s *Server) FailNext(route string, status int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures = append(s.failures, failure{route: route, status: status})
+}
+
+// Requests returns the served requests as method, path and query
+func (s *Server) Requests() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.requests...)
+}
+
+// CountRequests returns the number of served requests matching the route
+func (s *Server) CountRequests(route string) int {
+	n := 0
+	for _, r := range s.Requests() {
+		if strings.HasPrefix(r, route) {
+			n++
+		}
+	}
+	return n
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	route := r.Method + " " + r.URL.Path
+	req := route
+	if r.URL.RawQuery != "" {
+		req += "?" + r.URL.RawQuery
+	}
+	s.requests = append(s.requests, req)
+
+	metadata := strings.HasPrefix(r.URL.Path, MetadataPath)
+	if !metadata {
+		s.writeRateHeaders(w)
+	}
+
+	for i, f := range s.failures {
+		if strings.HasPrefix(route, f.route) {
+			s.failures = append(s.failures[:i], s.failures[i+1:]...)
+			if f.status == http.StatusTooManyRequests && s.RetryAfter != "" {
+				w.Header().Set("Retry-After", s.RetryAfter)
+			}
+			writeError(w, f.status, http.StatusText(f.status))
+			return
+		}
+	}
+
+	if metadata {
+		s.serveMetadata(w, strings.TrimPrefix(r.URL.Path, MetadataPath))
+		return
+	}
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) < 2 || parts[0] != "v2" {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodGet && len(parts) == 2 && parts[1] == "account":
+		writeJSON(w, http.StatusOK, map[string]interface{}{"account": s.account})
+	case r.Method == http.MethodGet && len(parts) == 2 && parts[1] == "droplets":
+		s.listDroplets(w, r)
+	case r.Method == http.MethodGet && len(parts) == 3 && parts[1] == "droplets":
+		s.getDroplet(w, parts[2])
+	case r.Method == http.MethodGet && len(parts) == 2 && parts[1] == "volumes":
+		s.listVolumes(w, r)
+	case r.Method == http.MethodGet && len(parts) == 3 && parts[1] == "volumes":
+		s.getVolume(w, parts[2])
+	case r.Method == http.MethodPost && len(parts) == 2 && parts[1] == "volumes":
+		s.createVolume(w, r)
+	case r.Method == http.MethodDelete && len(parts) == 3 && parts[1] == "volumes":
+		s.deleteVolume(w, parts[2])
+	case r.Method == http.MethodPost && len(parts) == 4 && parts[1] == "volumes" && parts[3] == "snapshots":
+		s.createSnapshot(w, r, parts[2])
+	case r.Method == http.MethodGet && len(parts) == 4 && parts[1] == "volumes" && parts[3] == "snapshots":
+		s.listSnapshots(w, r, parts[2])
+	case r.Method == http.MethodGet && len(parts) == 3 && parts[1] == "snapshots":
+		s.getSnapshot(w, parts[2])
+	case r.Method == http.MethodDelete && len(parts) == 3 && parts[1] == "snapshots":
+		s.deleteSnapshot(w, parts[2])
+	case r.Method == http.MethodPost && len(parts) == 4 && parts[1] == "volumes" && parts[3] == "actions":
+		s.createAction(w, r, parts[2])
+	case r.Method == http.MethodGet && len(parts) == 5 && parts[1] == "volumes" && parts[3] == "actions":
+		s.getAction(w, parts[2], parts[4])
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+	}
+}
+
+// writeRateHeaders sets the rate limit headers counting this API call
+func (s *Server) writeRateHeaders(w http.ResponseWriter) {
+	s.apiCalls++
+	remaining := s.RateLimit - s.apiCalls
+	if remaining < 0 {
+		remaining = 0
+	}
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(s.RateLimit))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(remaining))
+	w.Header().Set("RateLimit-Reset", strconv.FormatInt(s.rateReset.Unix(), 10))
+}
+
+func (s *Server) serveMetadata(w http.ResponseWriter, path string) {
+	w.Header().Set("Content-Type", "text/plain")
+	switch path {
+	case "id":
+		fmt.Fprint(w, strconv.Itoa(s.dropletID))
+	case "region":
+		fmt.Fprint(w, s.region)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (s *Server) listDroplets(w http.ResponseWriter, r *http.Request) {
+	page, perPage := s.pagination(r)
+
+	start := (page - 1) * perPage
+	if start > len(s.droplets) {
+		start = len(s.droplets)
+	}
+	end := start + perPage
+	if end > len(s.droplets) {
+		end = len(s.droplets)
+	}
+
+	droplets := []godo.Droplet{}
+	for _, d := range s.droplets[start:end] {
+		// droplets are listed without attached volumes
+		c := *d
+		c.VolumeIDs = nil
+		droplets = append(droplets, c)
+	}
+
+	pages := &godo.Pages{}
+	pageURL := func(p int) string {
+		return fmt.Sprintf("%s/v2/droplets?page=%d&per_page=%d", s.URL, p, perPage)
+	}
+	last := (len(s.droplets) + perPage - 1) / perPage
+	if page > 1 {
+		pages.First = pageURL(1)
+		pages.Prev = pageURL(page - 1)
+	}
+	if page < last {
+		pages.Next = pageURL(page + 1)
+		pages.Last = pageURL(last)
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"droplets": droplets,
+		"links":    &godo.Links{Pages: pages},
+		"meta":     map[string]int{"total": len(s.droplets)},
+	})
+}
+
+func (s *Server) getDroplet(w http.ResponseWriter, idText string) {
+	id, err := strconv.Atoi(idText)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "droplet not found")
+		return
+	}
+	d := s.findDroplet(id)
+	if d == nil {
+		writeError(w, http.StatusNotFound, "droplet not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"droplet": d})
+}
+
+func (s *Server) listVolumes(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("name")
+	region := r.URL.Query().Get("region")
+
+	volumes := []godo.Volume{}
+	for _, v := range s.volumes {
+		if name != "" && v.Name != name {
+			continue
+		}
+		if region != "" && v.Region.Slug != region {
+			continue
+		}
+		volumes = append(volumes, *v)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"volumes": volumes,
+		"links":   &godo.Links{},
+	})
+}
+
+func (s *Server) getVolume(w http.ResponseWriter, id string) {
+	v, ok := s.volumes[id]
+	if !ok {
+		writeError(w, http.StatusNotFound, "volume not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"volume": v})
+}
+
+func (s *Server) createVolume(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		Name           string   `json:"name"`
+		Description    string   `json:"description"`
+		Region         string   `json:"region"`
+		SizeGigabytes  int64    `json:"size_gigabytes"`
+		FilesystemType string   `json:"filesystem_type"`
+		Tags           []string `json:"tags"`
+		SnapshotID     string   `json:"snapshot_id"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.Name == "" || req.Region == "" || req.SizeGigabytes < 1 {
+		writeError(w, http.StatusUnprocessableEntity, "name, region and size_gigabytes are required")
+		return
+	}
+	for _, v := range s.volumes {
+		if v.Name == req.Name && v.Region.Slug == req.Region {
+			writeError(w, http.StatusConflict, "a volume with the same name already exists in the region")
+			return
+		}
+	}
+	if req.SnapshotID != "" {
+		snapshot, ok := s.snapshots[req.SnapshotID]
+		if !ok {
+			writeError(w, http.StatusNotFound, "snapshot not found")
+			return
+		}
+		if snapshot.Regions[0] != req.Region || req.SizeGigabytes < int64(snapshot.MinDiskSize) {
+			writeError(w, http.StatusUnprocessableEntity, "volumes must be at the snapshot region and at least its size")
+			return
+		}
+	}
+
+	s.volumeSeq++
+	v := &godo.Volume{
+		ID:            fmt.Sprintf("stub-volume-%d", s.volumeSeq),
+		Name:          req.Name,
+		Description:   req.Description,
+		Region:        &godo.Region{Slug: req.Region},
+		SizeGigaBytes: req.SizeGigabytes,
+		DropletIDs:    []int{},
+		CreatedAt:     time.Now(),
+	}
+	s.volumes[v.ID] = v
+	s.created[v.ID] = VolumeAttributes{FilesystemType: req.FilesystemType, Tags: req.Tags}
+	writeJSON(w, http.StatusCreated, map[string]interface{}{"volume": v})
+}
+
+func (s *Server) deleteVolume(w http.ResponseWriter, id string) {
+	v, ok := s.volumes[id]
+	if !ok {
+		writeError(w, http.StatusNotFound, "volume not found")
+		return
+	}
+	if len(v.DropletIDs) > 0 {
+		writeError(w, http.StatusConflict, "volume is attached to a droplet")
+		return
+	}
+	delete(s.volumes, id)
+	delete(s.created, id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) createSnapshot(w http.ResponseWriter, r *http.Request, volumeID string) {
+	v, ok := s.volumes[volumeID]
+	if !ok {
+		writeError(w, http.StatusNotFound, "volume not found")
+		return
+	}
+
+	req := godo.SnapshotCreateRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.Name == "" {
+		writeError(w, http.StatusUnprocessableEntity, "name is required")
+		return
+	}
+
+	s.snapshotSeq++
+	snapshot := &godo.Snapshot{
+		ID:           fmt.Sprintf("stub-snapshot-%d", s.snapshotSeq),
+		Name:         req.Name,
+		ResourceID:   volumeID,
+		ResourceType: "volume",
+		Regions:      []string{v.Region.Slug},
+		MinDiskSize:  int(v.SizeGigaBytes),
+		Created:      time.Now().UTC().Format(time.RFC3339),
+	}
+	s.snapshots[snapshot.ID] = snapshot
+	writeJSON(w, http.StatusCreated, map[string]interface{}{"snapshot": snapshot})
+}
+
+func (s *Server) listSnapshots(w http.ResponseWriter, r *http.Request, volumeID string) {
+	if _, ok := s.volumes[volumeID]; !ok {
+		writeError(w, http.StatusNotFound, "volume not found")
+		return
+	}
+
+	snapshots := []godo.Snapshot{}
+	for i := 1; i <= s.snapshotSeq; i++ {
+		snapshot, ok := s.snapshots[fmt.Sprintf("stub-snapshot-%d", i)]
+		if ok && snapshot.ResourceID == volumeID {
+			snapshots = append(snapshots, *snapshot)
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"snapshots": snapshots,
+		"links":     &godo.Links{},
+	})
+}
+
+func (s *Server) getSnapshot(w http.ResponseWriter, id string) {
+	snapshot, ok := s.snapshots[id]
+	if !ok {
+		writeError(w, http.StatusNotFound, "snapshot not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"snapshot": snapshot})
+}
+
+func (s *Server) deleteSnapshot(w http.ResponseWriter, id string) {
+	if _, ok := s.snapshots[id]; !ok {
+		writeError(w, http.StatusNotFound, "snapshot not found")
+		return
+	}
+	delete(s.snapshots, id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) createAction(w http.ResponseWriter, r *http.Request, volumeID string) {
+	v, ok := s.volumes[volumeID]
+	if !ok {
+		writeError(w, http.StatusNotFound, "volume not found")
+		return
+	}
+
+	req := struct {
+		Type          string `json:"type"`
+		DropletID     int    `json:"droplet_id"`
+		SizeGigabytes int64  `json:"size_gigabytes"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	switch req.Type {
+	case "attach":
+		d := s.findDroplet(req.DropletID)
+		if d == nil {
+			writeError(w, http.StatusNotFound, "droplet not found")
+			return
+		}
+		if len(v.DropletIDs) > 0 {
+			writeError(w, http.StatusUnprocessableEntity, "volume is already attached to a droplet")
+			return
+		}
+		v.DropletIDs = append(v.DropletIDs, d.ID)
+		d.VolumeIDs = append(d.VolumeIDs, v.ID)
+	case "detach":
+		d := s.findDroplet(req.DropletID)
+		if d == nil {
+			writeError(w, http.StatusNotFound, "droplet not found")
+			return
+		}
+		v.DropletIDs = removeInt(v.DropletIDs, d.ID)
+		d.VolumeIDs = removeString(d.VolumeIDs, v.ID)
+	case "resize":
+		if req.SizeGigabytes < v.SizeGigaBytes {
+			writeError(w, http.StatusUnprocessableEntity, "volumes can not be shrunk")
+			return
+		}
+		v.SizeGigaBytes = req.SizeGigabytes
+	default:
+		writeError(w, http.StatusUnprocessableEntity, fmt.Sprintf("unknown action type %q", req.Type))
+		return
+	}
+
+	s.actionSeq++
+	a := &action{
+		Action: godo.Action{
+			ID:           s.actionSeq,
+			Status:       godo.ActionInProgress,
+			Type:         req.Type,
+			ResourceType: "volume",
+			RegionSlug:   s.region,
+		},
+		volumeID: volumeID,
+	}
+	s.actions[a.ID] = a
+	writeJSON(w, http.StatusAccepted, map[string]interface{}{"action": a.Action})
+}
+
+func (s *Server) getAction(w http.ResponseWriter, volumeID, idText string) {
+	id, err := strconv.Atoi(idText)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "action not found")
+		return
+	}
+	a, ok := s.actions[id]
+	if !ok || a.volumeID != volumeID {
+		writeError(w, http.StatusNotFound, "action not found")
+		return
+	}
+
+	a.polls++
+	if a.Status == godo.ActionInProgress && a.polls > s.ActionPolls {
+		a.Status = s.ActionStatus
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"action": a.Action})
+}
+
+func (s *Server) pagination(r *http.Request) (int, int) {
+	page, err := strconv.Atoi(r.URL.Query().Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	perPage, err := strconv.Atoi(r.URL.Query().Get("per_page"))
+	if err != nil || perPage < 1 {
+		perPage = s.PerPage
+	}
+	return page, perPage
+}
+
+func (s *Server) findDroplet(id int) *godo.Droplet {
+	for _, d := range s.droplets {
+		if d.ID == id {
+			return d
+		}
+	}
+	return nil
+}
+
+func removeInt(list []int, value int) []int {
+	result := []int{}
+	for _, i := range list {
+		if i != value {
+			result = append(result, i)
+		}
+	}
+	return result
+}
+
+func removeString(list []string, value string) []string {
+	result := []string{}
+	for _, s := range list {
+		if s != value {
+			result = append(result, s)
+		}
+	}
+	return result
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{
+		"id":         strings.ToLower(strings.Replace(http.StatusText(status), " ", "_", -1)),
+		"message":    message,
+		"request_id": fmt.Sprintf("stub-%d", time.Now().UnixNano()),
+	})
+}
@@ -1,12 +1,16 @@
 package plugin
 
 import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
 	"github.com/StackPointCloud/digitalocean-flex-volume/pkg/digitalocean/cloud"
 	"github.com/StackPointCloud/digitalocean-flex-volume/pkg/flex"
-)
-
-const (
-	digitalOceanAttachTimeout = 200
+	"github.com/digitalocean/godo"
+	"github.com/golang/glog"
 )
 
 // Attach volume to the node
@@ -16,31 +20,32 @@ func (v *VolumePlugin) Attach(options string, node string) (*flex.DriverStatus,
 		return nil, err
 	}
 
+	vol, err := v.optionsVolume(opt)
+	if err != nil {
+		return nil, err
+	}
+
 	d, err := v.manager.FindDropletFromNodeName(node)
 	if err != nil {
 		return nil, err
 	}
 
-	// we need to retrieve the droplet to get the volumes (previous call lacks volumes)
-	droplet, err := v.manager.GetDroplet(d.ID)
+	// we need to retrieve the droplet to get the volumes (previous call lacks volumes),
+	// skipping the cache that could hold attachments changed since
+	droplet, err := v.manager.FetchDroplet(d.ID)
 	if err != nil {
 		return nil, err
 	}
 
 	needAttach := true
 	for _, attachedID := range droplet.VolumeIDs {
-		if attachedID == opt.VolumeID {
+		if attachedID == vol.ID {
 			needAttach = false
 		}
 	}
 
-	vol, err := v.manager.GetVolume(opt.VolumeID)
-	if err != nil {
-		return nil, err
-	}
-
 	if needAttach {
-		err := v.manager.AttachVolumeAndWait(opt.VolumeID, droplet.ID, digitalOceanAttachTimeout)
+		_, err := v.manager.AttachVolumeAndWait(vol.ID, droplet.ID)
 		if err != nil {
 			return nil, err
 		}
@@ -55,7 +60,7 @@ func (v *VolumePlugin) Attach(options string, node string) (*flex.DriverStatus,
 // Detach the volume from the node
 func (v *VolumePlugin) Detach(device, node string) (*flex.DriverStatus, error) {
 
-	vol, err := v.manager.GetVolumeByName(device)
+	vol, err := v.findVolume(device)
 	if err != nil {
 		return nil, err
 	}
@@ -65,8 +70,9 @@ func (v *VolumePlugin) Detach(device, node string) (*flex.DriverStatus, error) {
 		return nil, err
 	}
 
-	// we need to retrieve the droplet to get the volumes (previous call lacks volumes)
-	droplet, err := v.manager.GetDroplet(d.ID)
+	// we need to retrieve the droplet to get the volumes (previous call lacks volumes),
+	// skipping the cache that could hold attachments changed since
+	droplet, err := v.manager.FetchDroplet(d.ID)
 	if err != nil {
 		return nil, err
 	}
@@ -79,7 +85,7 @@ func (v *VolumePlugin) Detach(device, node string) (*flex.DriverStatus, error) {
 	}
 
 	if needDetach {
-		err = v.manager.DetachVolumeAndWait(vol.ID, droplet.ID, digitalOceanAttachTimeout)
+		_, err = v.manager.DetachVolumeAndWait(vol.ID, droplet.ID)
 		if err != nil {
 			return nil, err
 		}
@@ -90,12 +96,100 @@ func (v *VolumePlugin) Detach(device, node string) (*flex.DriverStatus, error) {
 	}, nil
 }
 
-// WaitForAttach no need to implement since we wait at the Attach command
+// WaitForAttach waits at the node for the device of the attached volume,
+// which appears some time after the attach action is completed, and
+// returns the device the by-id symbolic link resolves to
 func (v *VolumePlugin) WaitForAttach(device string, options string) (*flex.DriverStatus, error) {
-	r := &flex.DriverStatus{
-		Status: flex.StatusNotSupported,
+	if device == "" {
+		// older controllers might not pass the device path from Attach
+		opt, err := v.newOptions(options)
+		if err != nil {
+			return nil, err
+		}
+		device, err = v.devicePath(opt)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	resolved, err := v.waitForDevice(device)
+	if err != nil {
+		return nil, err
+	}
+
+	return &flex.DriverStatus{
+		Status:     flex.StatusSuccess,
+		DevicePath: resolved,
+	}, nil
+}
+
+// devicePath returns the by-id device path of the volume in the options
+func (v *VolumePlugin) devicePath(opt *digitalOceanOptions) (string, error) {
+	if opt.VolumeName != "" {
+		return cloud.DevicePrefix + opt.VolumeName, nil
+	}
+	if opt.VolumeID == "" {
+		return "", flex.NewError(flex.ErrorCodeInvalidOptions, "DigitalOcean volume needs volumeID or volumeName property at flex options")
+	}
+	vol, err := v.manager.GetVolume(opt.VolumeID)
+	if err != nil {
+		return "", err
+	}
+	return cloud.DevicePrefix + vol.Name, nil
+}
+
+// waitForDevice polls for the device symbolic link until the attach
+// timeout, letting udev process its queued events between attempts
+func (v *VolumePlugin) waitForDevice(device string) (string, error) {
+	deadline := time.Now().Add(v.attachTimeout)
+	settled := false
+	for {
+		resolved, err := v.resolveDevice(device)
+		if err == nil {
+			return resolved, nil
+		}
+		if fe, ok := err.(*flex.Error); !ok || !fe.Retryable {
+			return "", err
+		}
+
+		if time.Now().After(deadline) {
+			return "", flex.NewRetryableError(flex.ErrorCodeTimeout, "device %s did not appear at the node after %s: %s", device, v.attachTimeout, err.Error())
+		}
+
+		// settling is immediately followed by another attempt
+		if !settled {
+			v.settleUdev()
+			settled = true
+			continue
+		}
+		settled = false
+		time.Sleep(v.attachPoll)
+	}
+}
+
+// resolveDevice returns the block device the symbolic link points to,
+// or a retryable error if the link does not exist yet
+func (v *VolumePlugin) resolveDevice(device string) (string, error) {
+	resolved, err := filepath.EvalSymlinks(device)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", flex.NewRetryableError(flex.ErrorCodeDeviceNotFound, "device %s not found", device)
+		}
+		return "", flex.NewError(flex.ErrorCodeDeviceNotFound, "could not resolve device %s: %s", device, err.Error())
+	}
+	if err := v.checkDevice(resolved); err != nil {
+		return "", err
+	}
+	return resolved, nil
+}
+
+// settleUdev waits for udev to process the queued device events, failures
+// are logged since udevadm might not be available where the driver runs
+func (v *VolumePlugin) settleUdev() {
+	timeout := fmt.Sprintf("--timeout=%d", int(v.attachPoll.Seconds()+1))
+	if out, err := v.exec.CombinedOutput("udevadm", "settle", timeout); err != nil {
+		glog.V(2).Infof("udevadm settle failed with error [%s] and output [%s]", err.Error(), string(out))
 	}
-	return r, nil
 }
 
 // IsAttached checks for the volume to be attached to the node
@@ -105,20 +199,26 @@ func (v *VolumePlugin) IsAttached(options string, node string) (*flex.DriverStat
 		return nil, err
 	}
 
+	vol, err := v.optionsVolume(opt)
+	if err != nil {
+		return nil, err
+	}
+
 	d, err := v.manager.FindDropletFromNodeName(node)
 	if err != nil {
 		return nil, err
 	}
 
-	// we need to retrieve the droplet to get the volumes (previous call lacks volumes)
-	droplet, err := v.manager.GetDroplet(d.ID)
+	// we need to retrieve the droplet to get the volumes (previous call lacks volumes),
+	// skipping the cache that could hold attachments changed since
+	droplet, err := v.manager.FetchDroplet(d.ID)
 	if err != nil {
 		return nil, err
 	}
 
 	isAttached := false
 	for _, attachedID := range droplet.VolumeIDs {
-		if attachedID == opt.VolumeID {
+		if attachedID == vol.ID {
 			isAttached = true
 			break
 		}
@@ -129,3 +229,32 @@ func (v *VolumePlugin) IsAttached(options string, node string) (*flex.DriverStat
 		Attached: isAttached,
 	}, nil
 }
+
+// optionsVolume retrieves the volume of the flex options by ID, or else
+// by name at the current region
+func (v *VolumePlugin) optionsVolume(opt *digitalOceanOptions) (*godo.Volume, error) {
+	if _, err := opt.uniqueName(); err != nil {
+		return nil, err
+	}
+	if opt.VolumeID != "" {
+		return v.manager.GetVolume(opt.VolumeID)
+	}
+	return v.manager.GetVolumeByName(opt.VolumeName, "")
+}
+
+// findVolume resolves the detach argument, which depending on the kubelet
+// version is the unique volume name (the volume ID), the volume name
+// or the device path
+func (v *VolumePlugin) findVolume(device string) (*godo.Volume, error) {
+	if !strings.HasPrefix(device, cloud.DevicePrefix) {
+		vol, err := v.manager.GetVolume(device)
+		if err == nil {
+			return vol, nil
+		}
+		if fe, ok := err.(*flex.Error); !ok || fe.Code != flex.ErrorCodeNotFound {
+			return nil, err
+		}
+	}
+
+	return v.manager.GetVolumeByName(strings.TrimPrefix(device, cloud.DevicePrefix), "")
+}
@@ -0,0 +1,192 @@
+package plugin
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/StackPointCloud/digitalocean-flex-volume/pkg/flex"
+	"github.com/golang/glog"
+)
+
+// deviceMountsDir is where kubelet mounts the devices of the driver,
+// relative to the kubelet root directory
+const deviceMountsDir = "plugins/kubernetes.io/flexvolume/" + DriverName + "/mounts"
+
+// deviceMountDir returns the directory where kubelet mounted the device of
+// the volume, found from the pod volume directory, which kubelet names
+// <root>/pods/<pod UID>/volumes/<driver>/<spec name>. kubelet ignores the
+// getvolumename output and names the device mount after the spec name
+// too, the persistent volume name, not after the DigitalOcean volume.
+func deviceMountDir(mountdir string) (string, error) {
+	clean := filepath.Clean(mountdir)
+	volumes := filepath.Dir(filepath.Dir(clean))
+	pods := filepath.Dir(filepath.Dir(volumes))
+	if filepath.Base(volumes) != "volumes" || filepath.Base(pods) != "pods" {
+		return "", flex.NewError(flex.ErrorCodeInvalidOptions, "dir %s is not a kubelet pod volume directory", mountdir)
+	}
+	return filepath.Join(filepath.Dir(pods), deviceMountsDir, filepath.Base(clean)), nil
+}
+
+// bindSource returns the directory of the device mount bind mounted at the
+// pods, the sub directory if set, which is created for read write mounts.
+// Sub directories can not point out of the volume.
+func bindSource(deviceDir, subDirectory string, readOnly bool) (string, error) {
+	if subDirectory == "" {
+		return deviceDir, nil
+	}
+	clean := filepath.Clean(subDirectory)
+	if filepath.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", flex.NewError(flex.ErrorCodeInvalidOptions, "invalid %s flex option %q, expected a path relative to the volume", SubDirectoryOption, subDirectory)
+	}
+
+	source := filepath.Join(deviceDir, clean)
+	if !readOnly {
+		if err := os.MkdirAll(source, 0777); err != nil {
+			return "", flex.NewError(flex.ErrorCodeMountFailed, "could not create directory %s: %s", source, err.Error())
+		}
+	}
+	resolved, err := filepath.EvalSymlinks(source)
+	if err != nil {
+		return "", flex.NewError(flex.ErrorCodeMountFailed, "could not find directory %s of the volume: %s", clean, err.Error())
+	}
+	root := resolvePath(deviceDir)
+	if resolved != root && !strings.HasPrefix(resolved, root+string(filepath.Separator)) {
+		return "", flex.NewError(flex.ErrorCodeMountFailed, "directory %s of the volume points to %s out of the volume, refusing to mount it", clean, resolved)
+	}
+	return resolved, nil
+}
+
+// bindMount mounts the source directory at dir. The kernel ignores
+// the read only flag of new bind mounts, so they are remounted read only.
+func bindMount(m mounter, source, dir string, readOnly bool) error {
+	if err := m.Mount(source, dir, "", []string{"bind"}); err != nil {
+		return err
+	}
+	if !readOnly {
+		return nil
+	}
+	if err := m.Mount(source, dir, "", []string{"remount", "bind", "ro"}); err != nil {
+		if unmountErr := m.Unmount(dir); unmountErr != nil {
+			glog.Warningf("could not unmount %s after failing to make it read only: %s", dir, unmountErr.Error())
+		}
+		return err
+	}
+	return nil
+}
+
+// Mount bind mounts the device mount of the volume, or a directory
+// of it, at the pod directory, replacing stale bind mounts. The device
+// node of block volumes is bind mounted onto a file instead.
+func (v *VolumePlugin) Mount(mountdir string, options string) (*flex.DriverStatus, error) {
+	opt, err := v.newOptions(options)
+	if err != nil {
+		return nil, err
+	}
+	name, err := opt.uniqueName()
+	if err != nil {
+		return nil, err
+	}
+	readOnly := opt.RW == "ro"
+
+	deviceDir, err := deviceMountDir(mountdir)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := opt.blockMode()
+	if err != nil {
+		return nil, err
+	}
+	if block {
+		device, err := publishedDevice(deviceDir)
+		if err != nil {
+			return nil, err
+		}
+		if device == "" {
+			return nil, flex.NewRetryableError(flex.ErrorCodeMountFailed, "volume %s is not published at %s", name, deviceDir)
+		}
+		if err := v.bindBlock(device, mountdir, readOnly); err != nil {
+			return nil, err
+		}
+		return &flex.DriverStatus{Status: flex.StatusSuccess}, nil
+	}
+
+	dmp, err := v.mounter.MountPoint(deviceDir)
+	if err != nil {
+		return nil, err
+	}
+	if dmp == nil {
+		return nil, flex.NewRetryableError(flex.ErrorCodeMountFailed, "volume %s is not mounted at %s", name, deviceDir)
+	}
+	if stale := v.checkMount(dmp); stale != nil {
+		return nil, flex.NewRetryableError(flex.ErrorCodeStaleMount, "volume %s mounted at %s is stale: %s", name, deviceDir, stale.Error())
+	}
+
+	mp, err := v.mounter.MountPoint(mountdir)
+	if err != nil {
+		return nil, err
+	}
+	if mp != nil {
+		stale := v.checkMount(mp)
+		if stale == nil {
+			if !sameDevice(mp.Device, dmp.Device) {
+				return nil, flex.NewError(flex.ErrorCodeMountFailed, "dir %s already has %s mounted instead of volume %s", mountdir, mp.Device, name)
+			}
+			return &flex.DriverStatus{Status: flex.StatusSuccess}, nil
+		}
+		glog.Warningf("detaching stale mount of %s at %s: %s", mp.Device, mountdir, stale.Error())
+		if err := v.mounter.LazyUnmount(mountdir); err != nil {
+			return nil, err
+		}
+	}
+
+	source, err := bindSource(deviceDir, opt.SubDirectory, readOnly)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(mountdir, 0750); err != nil {
+		return nil, flex.NewError(flex.ErrorCodeMountFailed, "could not create directory %s: %s", mountdir, err.Error())
+	}
+	if err := bindMount(v.mounter, source, mountdir, readOnly); err != nil {
+		return nil, err
+	}
+
+	return &flex.DriverStatus{Status: flex.StatusSuccess}, nil
+}
+
+// Unmount the volume at the pod directory and remove the directory
+// if empty, leaving any data written there while unmounted. Files
+// holding block volumes are removed, as are links to them.
+func (v *VolumePlugin) Unmount(mountdir string) (*flex.DriverStatus, error) {
+	device, err := publishedDevice(mountdir)
+	if err != nil {
+		return nil, err
+	}
+	if device != "" {
+		if err := os.Remove(mountdir); err != nil {
+			return nil, flex.NewError(flex.ErrorCodeUnmountFailed, "could not remove link %s to device %s: %s", mountdir, device, err.Error())
+		}
+		return &flex.DriverStatus{Status: flex.StatusSuccess}, nil
+	}
+
+	mp, err := v.mounter.MountPoint(mountdir)
+	if err != nil {
+		return nil, err
+	}
+	if mp != nil {
+		unmount := v.mounter.Unmount
+		if stale := v.checkMount(mp); stale != nil {
+			glog.Warningf("detaching stale mount of %s at %s: %s", mp.Device, mountdir, stale.Error())
+			unmount = v.mounter.LazyUnmount
+		}
+		if err := unmount(mountdir); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := os.Remove(mountdir); err != nil && !os.IsNotExist(err) {
+		glog.Warningf("could not remove directory %s after unmounting it: %s", mountdir, err.Error())
+	}
+	return &flex.DriverStatus{Status: flex.StatusSuccess}, nil
+}
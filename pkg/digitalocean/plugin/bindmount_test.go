@@ -0,0 +1,109 @@
+package plugin
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/StackPointCloud/digitalocean-flex-volume/pkg/flex"
+)
+
+func TestDeviceMountDir(t *testing.T) {
+	// both directories are named after the persistent volume
+	dir, err := deviceMountDir("/var/lib/kubelet/pods/0123-4567/volumes/digitalocean~flex-volume/pvc-uid-data")
+	if err != nil || dir != "/var/lib/kubelet/plugins/kubernetes.io/flexvolume/digitalocean/flex-volume/mounts/pvc-uid-data" {
+		t.Errorf("expected kubelet device mount dir but got %q, %v", dir, err)
+	}
+	if _, err := deviceMountDir("/mnt/data"); err == nil {
+		t.Errorf("expected error for dir out of kubelet pods")
+	}
+}
+
+func TestBindSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bindsource")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	volume := filepath.Join(dir, "volume")
+	os.MkdirAll(volume, 0700)
+	os.Symlink(dir, filepath.Join(volume, "escape"))
+
+	if source, err := bindSource(volume, "", false); err != nil || source != volume {
+		t.Errorf("expected volume dir but got %q, %v", source, err)
+	}
+	if source, err := bindSource(volume, "data/logs", false); err != nil || source != filepath.Join(volume, "data", "logs") {
+		t.Errorf("expected created sub directory but got %q, %v", source, err)
+	}
+	if _, err := bindSource(volume, "missing", true); err == nil {
+		t.Errorf("expected error for missing sub directory of read only mount")
+	}
+	for _, sub := range []string{"../other", "/etc", "escape"} {
+		if _, err := bindSource(volume, sub, false); err == nil {
+			t.Errorf("expected error for sub directory %q out of the volume", sub)
+		}
+	}
+}
+
+func TestMountUnmount(t *testing.T) {
+	vp, f, dir := newMountPlugin(t)
+	defer os.RemoveAll(dir)
+	mountdir := filepath.Join(dir, "pods", "0123-4567", "volumes", "digitalocean~flex-volume", "pvc-uid-data")
+	deviceDir := filepath.Join(dir, "plugins", "kubernetes.io", "flexvolume", "digitalocean", "flex-volume", "mounts", "pvc-uid-data")
+	options := `{"volumeID":"id0123456789","kubernetes.io/readwrite":"ro"}`
+
+	// the device is not mounted yet
+	f.on(findmntCommand+deviceDir, "", exitError(1))
+	_, err := vp.Mount(mountdir, options)
+	if fe, ok := err.(*flex.Error); !ok || fe.Code != flex.ErrorCodeMountFailed || !fe.Retryable {
+		t.Errorf("expected retryable %s error but got %v", flex.ErrorCodeMountFailed, err)
+	}
+
+	f.on(findmntCommand+deviceDir, deviceDir+" /dev/sda ext4 rw,relatime\n", nil)
+	f.on(findmntCommand+mountdir, "", exitError(1))
+	if err := os.MkdirAll(deviceDir, 0750); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := vp.Mount(mountdir, options); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	for _, command := range []string{
+		"mount -o bind " + deviceDir + " " + mountdir,
+		"mount -o remount,bind,ro " + deviceDir + " " + mountdir,
+	} {
+		if !f.ran(command) {
+			t.Errorf("expected %q but ran %q", command, f.calls)
+		}
+	}
+
+	// mounted volumes are left as they are
+	f.calls = nil
+	f.on(findmntCommand+mountdir, mountdir+" /dev/sda ext4 ro,relatime\n", nil)
+	if _, err := vp.Mount(mountdir, options); err != nil || f.ran("mount") {
+		t.Errorf("expected mounted volume to be kept but ran %q, %v", f.calls, err)
+	}
+	f.on(findmntCommand+mountdir, mountdir+" /dev/sdb ext4 ro,relatime\n", nil)
+	if _, err := vp.Mount(mountdir, options); err == nil {
+		t.Errorf("expected error when another device is mounted")
+	}
+
+	f.calls = nil
+	f.on(findmntCommand+mountdir, mountdir+" /dev/sda ext4 ro,relatime\n", nil)
+	if _, err := vp.Unmount(mountdir); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !f.ran("umount " + mountdir) {
+		t.Errorf("expected unmount but ran %q", f.calls)
+	}
+	if _, err := os.Stat(mountdir); !os.IsNotExist(err) {
+		t.Errorf("expected empty pod dir to be removed but got %v", err)
+	}
+
+	// unmounted dirs are just removed
+	f.calls = nil
+	f.on(findmntCommand+mountdir, "", exitError(1))
+	if _, err := vp.Unmount(mountdir); err != nil || f.ran("umount") {
+		t.Errorf("expected nothing to unmount but ran %q, %v", f.calls, err)
+	}
+}
@@ -0,0 +1,144 @@
+package plugin
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/StackPointCloud/digitalocean-flex-volume/pkg/flex"
+	"github.com/golang/glog"
+)
+
+const (
+	// VolumeModeFilesystem mounts a filesystem of the volume, the default mode
+	VolumeModeFilesystem = "Filesystem"
+	// VolumeModeBlock publishes the block device of the volume without filesystem
+	VolumeModeBlock = "Block"
+)
+
+// blockMode returns whether the options request a raw block volume
+func (o *digitalOceanOptions) blockMode() (bool, error) {
+	switch o.VolumeMode {
+	case "", VolumeModeFilesystem:
+		return false, nil
+	case VolumeModeBlock:
+		return true, nil
+	default:
+		return false, flex.NewError(flex.ErrorCodeInvalidOptions, "invalid %s flex option %q, expected %s or %s", VolumeModeOption, o.VolumeMode, VolumeModeFilesystem, VolumeModeBlock)
+	}
+}
+
+// publishedDevice returns the device linked at path, empty if path is not a link
+func publishedDevice(path string) (string, error) {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", flex.NewError(flex.ErrorCodeCommandFailed, "could not stat %s: %s", path, err.Error())
+	}
+	if fi.Mode()&os.ModeSymlink == 0 {
+		return "", nil
+	}
+	device, err := os.Readlink(path)
+	if err != nil {
+		return "", flex.NewError(flex.ErrorCodeCommandFailed, "could not read link %s: %s", path, err.Error())
+	}
+	return device, nil
+}
+
+// publishBlock links the device node at path, replacing the empty
+// directory kubelet creates there. Links to the device are kept.
+func publishBlock(device, path string) error {
+	device = resolvePath(device)
+	current, err := publishedDevice(path)
+	if err != nil {
+		return err
+	}
+	if current != "" {
+		if !sameDevice(current, device) {
+			return flex.NewError(flex.ErrorCodeMountFailed, "%s already links %s instead of device %s", path, current, device)
+		}
+		return nil
+	}
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return flex.NewError(flex.ErrorCodeMountFailed, "could not publish device %s at %s, which is not an empty directory: %s", device, path, err.Error())
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		return flex.NewError(flex.ErrorCodeMountFailed, "could not create directory %s: %s", filepath.Dir(path), err.Error())
+	}
+	if err := os.Symlink(device, path); err != nil {
+		return flex.NewError(flex.ErrorCodeMountFailed, "could not link device %s at %s: %s", device, path, err.Error())
+	}
+	return nil
+}
+
+// bindBlock bind mounts the device node onto a regular file at path,
+// replacing the empty directory kubelet creates there. Links would
+// resolve against the /dev of the container, while the bind mounted
+// file is the device node itself. Bound devices are kept.
+func (v *VolumePlugin) bindBlock(device, path string, readOnly bool) error {
+	mp, err := v.mounter.MountPoint(path)
+	if err != nil {
+		return err
+	}
+	if mp != nil {
+		if !sameDevice(path, device) && !sameDevice(mp.Device, device) {
+			return flex.NewError(flex.ErrorCodeMountFailed, "%s already has %s mounted instead of device %s", path, mp.Device, device)
+		}
+		return nil
+	}
+
+	// a link or the empty directory kubelet creates
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return flex.NewError(flex.ErrorCodeMountFailed, "could not publish device %s at %s, which is not an empty directory: %s", device, path, err.Error())
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		return flex.NewError(flex.ErrorCodeMountFailed, "could not create directory %s: %s", filepath.Dir(path), err.Error())
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDONLY, 0640)
+	if err != nil {
+		return flex.NewError(flex.ErrorCodeMountFailed, "could not create file %s to publish device %s: %s", path, device, err.Error())
+	}
+	f.Close()
+
+	if err := bindMount(v.mounter, device, path, readOnly); err != nil {
+		if removeErr := os.Remove(path); removeErr != nil {
+			glog.Warningf("could not remove %s after failing to publish device %s: %s", path, device, removeErr.Error())
+		}
+		return err
+	}
+	return nil
+}
+
+// mountBlock publishes the device, opened first if encrypted,
+// without formatting or mounting it
+func (v *VolumePlugin) mountBlock(targetDir, device string, r *mountRequest) (err error) {
+	if r.encryption != nil {
+		if device, err = v.openEncrypted(device, r); err != nil {
+			return err
+		}
+		defer func() {
+			if err == nil {
+				return
+			}
+			if closeErr := v.closeEncrypted(r.encryption.mapping); closeErr != nil {
+				glog.Warningf("could not close encrypted volume after failed publish: %s", closeErr.Error())
+			}
+		}()
+	}
+	return publishBlock(device, targetDir)
+}
+
+// unmountBlock removes the device link, leaving the data untouched,
+// and closes the LUKS mapping of encrypted volumes
+func (v *VolumePlugin) unmountBlock(path, device string) error {
+	mapping := v.luksMapping(device)
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return flex.NewError(flex.ErrorCodeUnmountFailed, "could not remove link %s to device %s: %s", path, device, err.Error())
+	}
+	if mapping != "" {
+		return v.closeEncrypted(mapping)
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package plugin
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/StackPointCloud/digitalocean-flex-volume/pkg/flex"
+)
+
+func TestMountDeviceBlock(t *testing.T) {
+	vp, f, dir := newMountPlugin(t)
+	defer os.RemoveAll(dir)
+	mountdir := filepath.Join(dir, "mnt")
+	device := filepath.Join(dir, "sda")
+	other := filepath.Join(dir, "sdb")
+	for _, d := range []string{device, other} {
+		if err := ioutil.WriteFile(d, []byte("data"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	options := `{"volumeID":"id0123456789","volumeMode":"Block","kubernetes.io/mountOptions":"noatime"}`
+
+	// kubelet creates the directory before calling the driver
+	if err := os.MkdirAll(mountdir, 0750); err != nil {
+		t.Fatal(err)
+	}
+	ds, err := vp.MountDevice(mountdir, device, options)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if ds.Message != "" || len(f.calls) > 0 {
+		t.Errorf("expected no format nor mount but ran %q with message %q", f.calls, ds.Message)
+	}
+	if link, err := os.Readlink(mountdir); err != nil || link != device {
+		t.Errorf("expected link to %s but got %q, %v", device, link, err)
+	}
+
+	// published devices are kept
+	if _, err := vp.MountDevice(mountdir, device, options); err != nil {
+		t.Errorf("unexpected error publishing the device again: %s", err)
+	}
+	if _, err := vp.MountDevice(mountdir, other, options); err == nil {
+		t.Errorf("expected error publishing another device")
+	}
+
+	if _, err := vp.UnmountDevice(mountdir); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, err := os.Lstat(mountdir); !os.IsNotExist(err) {
+		t.Errorf("expected link to be removed but got %v", err)
+	}
+	if data, err := ioutil.ReadFile(device); err != nil || string(data) != "data" {
+		t.Errorf("expected device data to be kept but got %q, %v", data, err)
+	}
+	if len(f.calls) > 0 {
+		t.Errorf("expected no unmount but ran %q", f.calls)
+	}
+
+	// directories holding data are not replaced
+	os.MkdirAll(mountdir, 0750)
+	ioutil.WriteFile(filepath.Join(mountdir, "file"), []byte("data"), 0600)
+	if _, err := vp.MountDevice(mountdir, device, options); err == nil {
+		t.Errorf("expected error publishing at a directory holding files")
+	}
+
+	_, err = vp.MountDevice(mountdir, device, `{"volumeID":"id0123456789","volumeMode":"Raw"}`)
+	if fe, ok := err.(*flex.Error); !ok || fe.Code != flex.ErrorCodeInvalidOptions {
+		t.Errorf("expected %s error but got %v", flex.ErrorCodeInvalidOptions, err)
+	}
+}
+
+func TestMountBlock(t *testing.T) {
+	vp, f, dir := newMountPlugin(t)
+	defer os.RemoveAll(dir)
+	mountdir := filepath.Join(dir, "pods", "0123-4567", "volumes", "digitalocean~flex-volume", "pvc-uid-data")
+	deviceDir := filepath.Join(dir, "plugins", "kubernetes.io", "flexvolume", "digitalocean", "flex-volume", "mounts", "pvc-uid-data")
+	device := filepath.Join(dir, "sda")
+	ioutil.WriteFile(device, []byte("data"), 0600)
+	options := `{"volumeID":"id0123456789","volumeMode":"Block"}`
+
+	_, err := vp.Mount(mountdir, options)
+	if fe, ok := err.(*flex.Error); !ok || !fe.Retryable {
+		t.Errorf("expected retryable error before the device is published but got %v", err)
+	}
+
+	if err := publishBlock(device, deviceDir); err != nil {
+		t.Fatal(err)
+	}
+	// kubelet creates the directory before calling the driver
+	if err := os.MkdirAll(mountdir, 0750); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := vp.Mount(mountdir, options); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if fi, err := os.Lstat(mountdir); err != nil || !fi.Mode().IsRegular() {
+		t.Errorf("expected file to bind mount the device onto but got %v, %v", fi, err)
+	}
+	if !f.ran("mount -o bind " + device + " " + mountdir) {
+		t.Errorf("expected device bind mounted but ran %q", f.calls)
+	}
+
+	// bound devices are kept
+	f.calls = nil
+	f.on(findmntCommand+mountdir, mountdir+" "+device+" devtmpfs rw\n", nil)
+	if _, err := vp.Mount(mountdir, options); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if f.ran("mount") {
+		t.Errorf("expected no mount of a bound device but ran %q", f.calls)
+	}
+
+	if _, err := vp.Unmount(mountdir); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !f.ran("umount " + mountdir) {
+		t.Errorf("expected unmount but ran %q", f.calls)
+	}
+	if _, err := os.Lstat(mountdir); !os.IsNotExist(err) {
+		t.Errorf("expected file to be removed but got %v", err)
+	}
+	if _, err := os.Lstat(deviceDir); err != nil {
+		t.Errorf("expected device link to be kept but got %v", err)
+	}
+}
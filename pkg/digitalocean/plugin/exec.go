@@ -0,0 +1,62 @@
+package plugin
+
+import (
+	"bytes"
+	"os/exec"
+
+	"github.com/StackPointCloud/digitalocean-flex-volume/pkg/flex"
+	"golang.org/x/sys/unix"
+)
+
+// executor runs node commands, replaced at tests
+type executor interface {
+	// Output runs the command returning its standard output
+	Output(name string, args ...string) ([]byte, error)
+	// CombinedOutput runs the command returning its standard output and error
+	CombinedOutput(name string, args ...string) ([]byte, error)
+	// CombinedOutputWithInput runs the command reading the input, such as
+	// a key, from its standard input
+	CombinedOutputWithInput(input []byte, name string, args ...string) ([]byte, error)
+}
+
+// osExecutor runs commands at the node
+type osExecutor struct{}
+
+func (osExecutor) Output(name string, args ...string) ([]byte, error) {
+	return exec.Command(name, args...).Output()
+}
+
+func (osExecutor) CombinedOutput(name string, args ...string) ([]byte, error) {
+	return exec.Command(name, args...).CombinedOutput()
+}
+
+func (osExecutor) CombinedOutputWithInput(input []byte, name string, args ...string) ([]byte, error) {
+	cmd := exec.Command(name, args...)
+	cmd.Stdin = bytes.NewReader(input)
+	return cmd.CombinedOutput()
+}
+
+// exitCode returns the status of a command that ran and exited with an
+// error status, false if the error is not an exit status
+func exitCode(err error) (int, bool) {
+	e, ok := err.(interface {
+		ExitCode() int
+	})
+	if !ok {
+		return 0, false
+	}
+	return e.ExitCode(), true
+}
+
+// checkBlockDevice fails unless the device exists and is a block device
+func checkBlockDevice(device string) error {
+	var res unix.Stat_t
+	if err := unix.Stat(device, &res); err != nil {
+		return flex.NewRetryableError(flex.ErrorCodeDeviceNotFound, "could not stat device %s: %s", device, err.Error())
+	}
+
+	if res.Mode&unix.S_IFMT != unix.S_IFBLK {
+		return flex.NewError(flex.ErrorCodeNotBlockDevice, "device %s is not a block device", device)
+	}
+	return nil
+}
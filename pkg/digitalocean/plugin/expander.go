@@ -0,0 +1,86 @@
+package plugin
+
+import (
+	"github.com/StackPointCloud/digitalocean-flex-volume/pkg/flex"
+)
+
+const (
+	gigabyte = 1024 * 1024 * 1024
+)
+
+// ExpandVolume resizes the DigitalOcean volume to the new size
+func (v *VolumePlugin) ExpandVolume(options string, newSize, oldSize int64) (*flex.DriverStatus, error) {
+	opt, err := v.newOptions(options)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = opt.uniqueName(); err != nil {
+		return nil, err
+	}
+
+	if newSize <= oldSize {
+		return &flex.DriverStatus{
+			Status: flex.StatusSuccess,
+		}, nil
+	}
+
+	vol, err := v.optionsVolume(opt)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = v.manager.ResizeVolumeAndWait(vol.ID, sizeGigabytes(newSize))
+	if err != nil {
+		return nil, err
+	}
+
+	return &flex.DriverStatus{
+		Status: flex.StatusSuccess,
+	}, nil
+}
+
+// ExpandFS grows the filesystem at the device to fill the resized volume.
+// Block volumes have no filesystem to grow.
+func (v *VolumePlugin) ExpandFS(options, device, mountdir string, newSize, oldSize int64) (*flex.DriverStatus, error) {
+	opt, err := v.newOptions(options)
+	if err != nil {
+		return nil, err
+	}
+	block, err := opt.blockMode()
+	if err != nil {
+		return nil, err
+	}
+	if block {
+		return &flex.DriverStatus{Status: flex.StatusSuccess}, nil
+	}
+
+	format, err := v.currentFormat(device)
+	if err != nil {
+		return nil, err
+	}
+
+	var name, arg string
+	switch format {
+	case "ext2", "ext3", "ext4":
+		name, arg = "resize2fs", device
+	case "xfs":
+		// xfs can only be grown while mounted
+		name, arg = "xfs_growfs", mountdir
+	default:
+		return nil, flex.NewError(flex.ErrorCodeResizeFailed, "filesystem %q at device %s can not be resized", format, device)
+	}
+
+	if out, err := v.exec.CombinedOutput(name, arg); err != nil {
+		return nil, flex.NewError(flex.ErrorCodeResizeFailed, "resizing filesystem at device %s failed with error [%s] and output [%s]", device, err.Error(), string(out))
+	}
+
+	return &flex.DriverStatus{
+		Status: flex.StatusSuccess,
+	}, nil
+}
+
+// sizeGigabytes rounds up the size in bytes to DigitalOcean gigabytes
+func sizeGigabytes(size int64) int {
+	return int((size + gigabyte - 1) / gigabyte)
+}
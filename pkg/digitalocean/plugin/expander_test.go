@@ -0,0 +1,95 @@
+package plugin
+
+import (
+	"os"
+	"testing"
+
+	"github.com/StackPointCloud/digitalocean-flex-volume/pkg/digitalocean/cloud/fake"
+	"github.com/StackPointCloud/digitalocean-flex-volume/pkg/flex"
+)
+
+func TestExpandVolume(t *testing.T) {
+	vp, p := newFakePlugin()
+	options := `{"volumeID":"id0123456789"}`
+
+	if _, err := vp.ExpandVolume(options, 20*gigabyte, 10*gigabyte); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if vol, _ := p.GetVolume("id0123456789"); p.Calls(fake.MethodResizeVolumeAndWait) != 1 || vol.SizeGigaBytes != 20 {
+		t.Errorf("expected volume resized to 20GB but got %dGB after %d calls", vol.SizeGigaBytes, p.Calls(fake.MethodResizeVolumeAndWait))
+	}
+
+	// unchanged sizes need no resize
+	if _, err := vp.ExpandVolume(options, 20*gigabyte, 20*gigabyte); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if p.Calls(fake.MethodResizeVolumeAndWait) != 1 {
+		t.Errorf("expected no resize for unchanged size but got %d calls", p.Calls(fake.MethodResizeVolumeAndWait))
+	}
+
+	p.FailNext(fake.MethodResizeVolumeAndWait, flex.NewRetryableError(flex.ErrorCodeAPIUnavailable, "unavailable"))
+	_, err := vp.ExpandVolume(options, 30*gigabyte, 20*gigabyte)
+	if fe, ok := err.(*flex.Error); !ok || fe.Code != flex.ErrorCodeAPIUnavailable || !fe.Retryable {
+		t.Errorf("expected retryable %s error but got %v", flex.ErrorCodeAPIUnavailable, err)
+	}
+
+	// volumes are resolved by name without volume ID
+	if _, err = vp.ExpandVolume(`{"volumeName":"prueba"}`, 30*gigabyte, 20*gigabyte); err != nil {
+		t.Fatalf("unexpected error resizing volume by name: %s", err)
+	}
+	if p.Volumes()[0].SizeGigaBytes != 30 {
+		t.Errorf("expected volume resized to 30GB by name but got %dGB", p.Volumes()[0].SizeGigaBytes)
+	}
+
+	_, err = vp.ExpandVolume(`{"volumeName":"unknown"}`, 40*gigabyte, 30*gigabyte)
+	if err == nil {
+		t.Errorf("expected error resizing an unknown volume")
+	}
+
+	_, err = vp.ExpandVolume(`{}`, 40*gigabyte, 30*gigabyte)
+	if fe, ok := err.(*flex.Error); !ok || fe.Code != flex.ErrorCodeInvalidOptions {
+		t.Errorf("expected %s error but got %v", flex.ErrorCodeInvalidOptions, err)
+	}
+}
+
+func TestExpandFS(t *testing.T) {
+	vp, f, dir := newMountPlugin(t)
+	defer os.RemoveAll(dir)
+	const mountdir = "/var/lib/kubelet/mounts/id0123456789"
+
+	cases := []struct {
+		format   string
+		expected string
+	}{
+		{"ext4", "resize2fs /dev/sda"},
+		{"ext3", "resize2fs /dev/sda"},
+		{"xfs", "xfs_growfs " + mountdir},
+	}
+	for _, c := range cases {
+		f.calls = nil
+		f.on("lsblk -n -o FSTYPE /dev/sda", c.format+"\n", nil)
+		if _, err := vp.ExpandFS("{}", "/dev/sda", mountdir, 20*gigabyte, 10*gigabyte); err != nil {
+			t.Fatalf("unexpected error resizing %s: %s", c.format, err)
+		}
+		if !f.ran(c.expected) {
+			t.Errorf("expected %q resizing %s but ran %q", c.expected, c.format, f.calls)
+		}
+	}
+
+	f.on("resize2fs /dev/sda", "resize2fs: Bad magic number", exitError(1))
+	f.on("lsblk -n -o FSTYPE /dev/sda", "ext4\n", nil)
+	_, err := vp.ExpandFS("{}", "/dev/sda", mountdir, 20*gigabyte, 10*gigabyte)
+	if fe, ok := err.(*flex.Error); !ok || fe.Code != flex.ErrorCodeResizeFailed {
+		t.Errorf("expected %s error but got %v", flex.ErrorCodeResizeFailed, err)
+	}
+
+	f.calls = nil
+	f.on("lsblk -n -o FSTYPE /dev/sda", "vfat\n", nil)
+	_, err = vp.ExpandFS("{}", "/dev/sda", mountdir, 20*gigabyte, 10*gigabyte)
+	if fe, ok := err.(*flex.Error); !ok || fe.Code != flex.ErrorCodeResizeFailed {
+		t.Errorf("expected %s error but got %v", flex.ErrorCodeResizeFailed, err)
+	}
+	if f.ran("resize2fs") || f.ran("xfs_growfs") {
+		t.Errorf("expected no resize of unsupported filesystem but ran %q", f.calls)
+	}
+}
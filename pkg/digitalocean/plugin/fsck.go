@@ -0,0 +1,177 @@
+package plugin
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/StackPointCloud/digitalocean-flex-volume/pkg/flex"
+	"github.com/golang/glog"
+)
+
+const (
+	// FsckNever mounts filesystems without checking them
+	FsckNever = "never"
+	// FsckAutoPreen repairs the problems fsck can safely fix and fails on the others
+	FsckAutoPreen = "auto-preen"
+	// FsckFailOnError checks filesystems without changing them and fails on any error
+	FsckFailOnError = "fail-on-error"
+)
+
+// e2fsck exit status bits, see e2fsck(8)
+var e2fsckExitCodes = []struct {
+	bit         int
+	description string
+}{
+	{1, "errors corrected"},
+	{2, "errors corrected, system should be rebooted"},
+	{4, "errors left uncorrected"},
+	{8, "operational error"},
+	{16, "usage or syntax error"},
+	{32, "canceled by user request"},
+	{128, "shared library error"},
+}
+
+// checkFsckPolicy fails unless the policy is known
+func checkFsckPolicy(policy string) error {
+	switch policy {
+	case FsckNever, FsckAutoPreen, FsckFailOnError:
+		return nil
+	}
+	return fmt.Errorf("unknown fsck policy %q, expected %s, %s or %s", policy, FsckNever, FsckAutoPreen, FsckFailOnError)
+}
+
+// describeE2fsck returns the meaning of the e2fsck exit status
+func describeE2fsck(code int) string {
+	meanings := []string{}
+	for _, c := range e2fsckExitCodes {
+		if code&c.bit != 0 {
+			meanings = append(meanings, c.description)
+		}
+	}
+	if len(meanings) == 0 {
+		return "no errors"
+	}
+	return strings.Join(meanings, ", ")
+}
+
+// fsck checks the filesystem at the unmounted device following the policy,
+// returning a message describing repairs, or an error if the filesystem
+// should not be mounted. Read only mounts are checked without repairs.
+// Filesystems without checker, or mounted elsewhere, are not checked.
+func (v *VolumePlugin) fsck(device string, r *mountRequest) (string, error) {
+	if r.fsck == FsckNever {
+		return "", nil
+	}
+
+	// checkers can not run on mounted filesystems, nor the xfs log be replayed
+	mp, err := v.mounter.DeviceMountPoint(device)
+	if err != nil {
+		return "", err
+	}
+	if mp != nil {
+		glog.V(2).Infof("skipping check of device %s mounted at %s", device, mp.Dir)
+		return "", nil
+	}
+
+	repair := r.fsck == FsckAutoPreen && !r.readOnly
+	switch r.fsType {
+	case "ext2", "ext3", "ext4":
+		return v.e2fsck(device, repair)
+	case "xfs":
+		return v.xfsCheck(device, repair)
+	default:
+		glog.V(2).Infof("skipping check of %s filesystem at device %s", r.fsType, device)
+		return "", nil
+	}
+}
+
+// e2fsck preens or checks without changes an ext filesystem
+func (v *VolumePlugin) e2fsck(device string, preen bool) (string, error) {
+	args := []string{"-n", device}
+	if preen {
+		args = []string{"-p", device}
+	}
+	command := "e2fsck " + strings.Join(args, " ")
+
+	out, err := v.exec.CombinedOutput("e2fsck", args...)
+	if err == nil {
+		return "", nil
+	}
+	code, ok := exitCode(err)
+	if !ok {
+		return "", flex.NewError(flex.ErrorCodeCommandFailed, "%s failed with error [%s] and output [%s]", command, err.Error(), string(out))
+	}
+
+	description := describeE2fsck(code)
+	if code&^3 != 0 {
+		return "", flex.NewError(flex.ErrorCodeFsckFailed, "%s at device %s: %s (exit code %d), refusing to mount it; output [%s]", command, device, description, code, string(out))
+	}
+	glog.Warningf("%s at device %s: %s (exit code %d), output [%s]", command, device, description, code, string(out))
+	return fmt.Sprintf("%s: %s (exit code %d)", command, description, code), nil
+}
+
+// xfsCheck checks without changes a xfs filesystem. xfs has no safe
+// automatic repair, so corrupted filesystems are never mounted.
+// xfs_repair -n exits 1 both on corruption and on a dirty log, which
+// only the kernel replays. When replaying is allowed the log is replayed
+// mounting and unmounting the filesystem before checking it again,
+// otherwise the filesystem is refused as if corrupted.
+func (v *VolumePlugin) xfsCheck(device string, replay bool) (string, error) {
+	command := "xfs_repair -n " + device
+	out, err := v.exec.CombinedOutput("xfs_repair", "-n", device)
+	if err == nil {
+		return "", nil
+	}
+	code, ok := exitCode(err)
+	if !ok {
+		return "", flex.NewError(flex.ErrorCodeCommandFailed, "%s failed with error [%s] and output [%s]", command, err.Error(), string(out))
+	}
+	if code != 1 {
+		return "", flex.NewError(flex.ErrorCodeFsckFailed, "%s at device %s: check failed (exit code %d); output [%s]", command, device, code, string(out))
+	}
+	if !replay {
+		return "", flex.NewError(flex.ErrorCodeFsckFailed, "%s at device %s: filesystem corruption or dirty log detected (exit code 1), refusing to mount it; "+
+			"mounting it read write with the %s policy replays a dirty log; output [%s]", command, device, FsckAutoPreen, string(out))
+	}
+
+	if err := v.replayXfsLog(device); err != nil {
+		return "", flex.NewError(flex.ErrorCodeFsckFailed, "%s at device %s: filesystem corruption detected (exit code 1) and its log could not be replayed: %s; "+
+			"refusing to mount it; output [%s]", command, device, err.Error(), string(out))
+	}
+	dirty := out
+	out, err = v.exec.CombinedOutput("xfs_repair", "-n", device)
+	if err == nil {
+		glog.Warningf("%s at device %s: clean after replaying the log, output of the first check [%s]", command, device, string(dirty))
+		return fmt.Sprintf("%s: dirty log replayed before the check", command), nil
+	}
+	code, ok = exitCode(err)
+	switch {
+	case !ok:
+		return "", flex.NewError(flex.ErrorCodeCommandFailed, "%s failed with error [%s] and output [%s]", command, err.Error(), string(out))
+	case code == 1:
+		return "", flex.NewError(flex.ErrorCodeFsckFailed, "%s at device %s: filesystem corruption detected (exit code 1), refusing to mount it; output [%s]", command, device, string(out))
+	default:
+		return "", flex.NewError(flex.ErrorCodeFsckFailed, "%s at device %s: check failed (exit code %d); output [%s]", command, device, code, string(out))
+	}
+}
+
+// xfsReplayDir is where xfs filesystems are mounted to replay their log
+func xfsReplayDir(device string) string {
+	return filepath.Join(os.TempDir(), "xfs-replay-"+filepath.Base(device))
+}
+
+// replayXfsLog mounts and unmounts the xfs filesystem, which replays its log
+func (v *VolumePlugin) replayXfsLog(device string) error {
+	dir := xfsReplayDir(device)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	defer os.Remove(dir)
+
+	if err := v.mounter.Mount(device, dir, "xfs", nil); err != nil {
+		return err
+	}
+	return v.mounter.Unmount(dir)
+}
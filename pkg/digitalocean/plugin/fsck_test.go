@@ -0,0 +1,150 @@
+package plugin
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/StackPointCloud/digitalocean-flex-volume/pkg/flex"
+)
+
+func TestMountDeviceFsck(t *testing.T) {
+	const device = "/dev/sda"
+	cases := []struct {
+		name     string
+		fsType   string
+		policy   string
+		readOnly bool
+		command  string
+		exit     error
+		// recheck is the exit of xfs_repair after replaying the log
+		recheck error
+		// replay is the exit of the mount replaying the xfs log
+		replay  error
+		message string
+		code    string
+	}{
+		{name: "ext4 clean", command: "e2fsck -p " + device},
+		{name: "ext4 preened", exit: exitError(1), command: "e2fsck -p " + device, message: "errors corrected (exit code 1)"},
+		{name: "ext4 uncorrected", exit: exitError(4), command: "e2fsck -p " + device, code: flex.ErrorCodeFsckFailed},
+		{name: "ext4 operational error", exit: exitError(8), command: "e2fsck -p " + device, code: flex.ErrorCodeFsckFailed},
+		{name: "ext4 fail on error", policy: FsckFailOnError, exit: exitError(4), command: "e2fsck -n " + device, code: flex.ErrorCodeFsckFailed},
+		{name: "ext4 fail on error clean", policy: FsckFailOnError, command: "e2fsck -n " + device},
+		{name: "ext4 read only", readOnly: true, command: "e2fsck -n " + device},
+		{name: "ext4 never", policy: FsckNever},
+		{name: "xfs clean", fsType: "xfs", command: "xfs_repair -n " + device},
+		{name: "xfs dirty log", fsType: "xfs", exit: exitError(1), command: "xfs_repair -n " + device, message: "dirty log replayed"},
+		{name: "xfs dirty log fail on error", fsType: "xfs", policy: FsckFailOnError, exit: exitError(1), command: "xfs_repair -n " + device, code: flex.ErrorCodeFsckFailed},
+		{name: "xfs dirty log read only", fsType: "xfs", readOnly: true, exit: exitError(1), command: "xfs_repair -n " + device, code: flex.ErrorCodeFsckFailed},
+		{name: "xfs corrupted", fsType: "xfs", exit: exitError(1), recheck: exitError(1), command: "xfs_repair -n " + device, code: flex.ErrorCodeFsckFailed},
+		{name: "xfs log not replayed", fsType: "xfs", exit: exitError(1), replay: exitError(32), command: "xfs_repair -n " + device, code: flex.ErrorCodeFsckFailed},
+		{name: "xfs operational error", fsType: "xfs", exit: exitError(4), command: "xfs_repair -n " + device, code: flex.ErrorCodeFsckFailed},
+		{name: "missing checker", exit: os.ErrNotExist, command: "e2fsck -p " + device, code: flex.ErrorCodeCommandFailed},
+		{name: "unknown policy", policy: "sometimes", code: flex.ErrorCodeInvalidOptions},
+	}
+
+	for _, c := range cases {
+		vp, f, dir := newMountPlugin(t)
+		mountdir := filepath.Join(dir, "mnt")
+		fsType := c.fsType
+		if fsType == "" {
+			fsType = "ext4"
+		}
+		f.on("lsblk -n -o FSTYPE "+device, fsType+"\n", nil)
+		if c.command != "" {
+			f.once(c.command, "fsck output", c.exit)
+			f.on(c.command, "fsck output", c.recheck)
+		}
+		f.on("mount -t xfs "+device+" "+xfsReplayDir(device), "", c.replay)
+		rw := "rw"
+		if c.readOnly {
+			rw = "ro"
+		}
+
+		options := `{"kubernetes.io/fsType":"` + fsType + `","kubernetes.io/readwrite":"` + rw + `","fsck":"` + c.policy + `"}`
+		ds, err := vp.MountDevice(mountdir, device, options)
+		os.RemoveAll(dir)
+
+		if c.code != "" {
+			if fe, ok := err.(*flex.Error); !ok || fe.Code != c.code {
+				t.Errorf("%s: expected %s error but got %v", c.name, c.code, err)
+			}
+			if mounted(f, mountdir) {
+				t.Errorf("%s: expected no mount but ran %q", c.name, f.calls)
+			}
+			if (c.policy == FsckFailOnError || c.readOnly) && f.ran("mount") {
+				t.Errorf("%s: expected no log replay but ran %q", c.name, f.calls)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", c.name, err)
+			continue
+		}
+		if c.command == "" && (f.ran("e2fsck") || f.ran("xfs_repair")) {
+			t.Errorf("%s: expected no check but ran %q", c.name, f.calls)
+		}
+		if c.command != "" && !f.ran(c.command) {
+			t.Errorf("%s: expected %q but ran %q", c.name, c.command, f.calls)
+		}
+		if !strings.Contains(ds.Message, c.message) || (c.message == "" && ds.Message != "") {
+			t.Errorf("%s: expected message %q but got %q", c.name, c.message, ds.Message)
+		}
+		replayed := f.ran("umount " + xfsReplayDir(device))
+		if replayed != (c.exit != nil && c.fsType == "xfs") {
+			t.Errorf("%s: expected log replayed %v but ran %q", c.name, !replayed, f.calls)
+		}
+	}
+}
+
+// mounted returns whether a mount at dir was run
+func mounted(f *fakeExecutor, dir string) bool {
+	for _, c := range f.calls {
+		if strings.HasPrefix(c, "mount ") && strings.HasSuffix(c, " "+dir) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestMountDeviceFsckSkipped(t *testing.T) {
+	const device = "/dev/sda"
+	vp, f, dir := newMountPlugin(t)
+	defer os.RemoveAll(dir)
+	mountdir := filepath.Join(dir, "mnt")
+
+	// new filesystems are not checked
+	f.on("lsblk -n -o FSTYPE "+device, "\n", nil)
+	f.on("blkid -p -o export "+device, "", exitError(2))
+	if _, err := vp.MountDevice(mountdir, device, `{"kubernetes.io/fsType":"ext4"}`); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !f.ran("mkfs") || f.ran("e2fsck") {
+		t.Errorf("expected format without check but ran %q", f.calls)
+	}
+
+	// mounted filesystems are not checked
+	f.calls = nil
+	f.on(findmntCommand+mountdir, mountdir+" "+device+" ext4 rw,relatime\n", nil)
+	if _, err := vp.MountDevice(mountdir, device, `{"kubernetes.io/fsType":"ext4"}`); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if f.ran("e2fsck") {
+		t.Errorf("expected no check of a mounted filesystem but ran %q", f.calls)
+	}
+
+	// devices mounted elsewhere are not checked nor replayed
+	f.calls = nil
+	f.on(findmntCommand+mountdir, "", exitError(1))
+	f.on("findmnt -n -r -o TARGET,SOURCE,FSTYPE,OPTIONS --source "+device, "/mnt/other "+device+" xfs rw,relatime\n", nil)
+	f.on("lsblk -n -o FSTYPE "+device, "xfs\n", nil)
+	f.on("xfs_repair -n "+device, "", exitError(1))
+	if _, err := vp.MountDevice(mountdir, device, `{"kubernetes.io/fsType":"xfs"}`); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if f.ran("xfs_repair") || f.ran("mount -t xfs "+device+" "+xfsReplayDir(device)) || !mounted(f, mountdir) {
+		t.Errorf("expected mount without check but ran %q", f.calls)
+	}
+}
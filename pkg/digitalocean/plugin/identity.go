@@ -0,0 +1,76 @@
+package plugin
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/StackPointCloud/digitalocean-flex-volume/pkg/flex"
+	"github.com/golang/glog"
+)
+
+// sysBlockDevicesDir holds the sysfs directory of every block device
+const sysBlockDevicesDir = "/sys/block"
+
+// deviceSerial reads the serial of the device from sysfs, the SCSI unit
+// serial number VPD page or the virtio serial, empty if not available
+func (v *VolumePlugin) deviceSerial(device string) (string, error) {
+	name := filepath.Base(resolvePath(device))
+
+	page, err := ioutil.ReadFile(filepath.Join(v.sysBlockDevices, name, "device", "vpd_pg80"))
+	if err == nil {
+		// 4 bytes header with the page code and the serial length
+		if len(page) < 4 || page[1] != 0x80 {
+			return "", flex.NewError(flex.ErrorCodeDeviceMismatch, "invalid SCSI serial page of device %s", device)
+		}
+		length := int(page[2])<<8 | int(page[3])
+		if length > len(page)-4 {
+			length = len(page) - 4
+		}
+		return strings.TrimSpace(string(bytes.Trim(page[4:4+length], "\x00"))), nil
+	}
+	if !os.IsNotExist(err) {
+		return "", flex.NewError(flex.ErrorCodeDeviceMismatch, "could not read SCSI serial of device %s: %s", device, err.Error())
+	}
+
+	serial, err := ioutil.ReadFile(filepath.Join(v.sysBlockDevices, name, "serial"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", flex.NewError(flex.ErrorCodeDeviceMismatch, "could not read serial of device %s: %s", device, err.Error())
+	}
+	return strings.TrimSpace(string(serial)), nil
+}
+
+// verifyDevice checks the device serial against the DigitalOcean volume ID
+// and name, so stale links or renamed volumes never get the wrong device
+// formatted or mounted. The name the volume has now is looked up when the
+// flex options name does not match. Devices without serial are not verified.
+func (v *VolumePlugin) verifyDevice(device, volumeID, volumeName string) error {
+	serial, err := v.deviceSerial(device)
+	if err != nil {
+		return err
+	}
+	if serial == "" {
+		glog.Warningf("could not verify device %s, no serial found at sysfs", device)
+		return nil
+	}
+
+	if serial == volumeID || serial == volumeName {
+		return nil
+	}
+	if volumeID != "" {
+		vol, err := v.manager.GetVolume(volumeID)
+		if err != nil {
+			return err
+		}
+		if serial == vol.Name {
+			return nil
+		}
+		volumeName = vol.Name
+	}
+	return flex.NewError(flex.ErrorCodeDeviceMismatch, "device %s has serial %q but the volume is %s named %q, refusing to use it", device, serial, volumeID, volumeName)
+}
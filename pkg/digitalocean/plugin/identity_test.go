@@ -0,0 +1,68 @@
+package plugin
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/StackPointCloud/digitalocean-flex-volume/pkg/digitalocean/cloud/fake"
+	"github.com/StackPointCloud/digitalocean-flex-volume/pkg/flex"
+)
+
+// vpdSerialPage returns a SCSI unit serial number VPD page
+func vpdSerialPage(serial string) []byte {
+	return append([]byte{0, 0x80, 0, byte(len(serial))}, serial...)
+}
+
+func TestMountDeviceVerifiesSerial(t *testing.T) {
+	const device = "/dev/sda"
+	cases := []struct {
+		name   string
+		file   string
+		serial []byte
+		code   string
+	}{
+		{"serial is the volume name", "device/vpd_pg80", vpdSerialPage("prueba"), ""},
+		{"serial is the volume ID", "device/vpd_pg80", vpdSerialPage("id0123456789"), ""},
+		{"volume renamed", "device/vpd_pg80", vpdSerialPage("renamed"), ""},
+		{"virtio serial", "serial", []byte("prueba\n"), ""},
+		{"no serial", "", nil, ""},
+		{"other volume", "device/vpd_pg80", vpdSerialPage("other"), flex.ErrorCodeDeviceMismatch},
+		{"invalid page", "device/vpd_pg80", []byte{0, 0x83}, flex.ErrorCodeDeviceMismatch},
+	}
+
+	for _, c := range cases {
+		vp, f, dir := newMountPlugin(t)
+		p := fake.NewProvider("nyc1")
+		p.AddVolume("id0123456789", "renamed", 10)
+		vp.manager = p
+		if c.file != "" {
+			file := filepath.Join(vp.sysBlockDevices, "sda", c.file)
+			if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(file, c.serial, 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+		f.on("lsblk -n -o FSTYPE "+device, "ext4\n", nil)
+
+		options := `{"kubernetes.io/fsType":"ext4","volumeID":"id0123456789","volumeName":"prueba"}`
+		_, err := vp.MountDevice(filepath.Join(dir, "mnt"), device, options)
+		os.RemoveAll(dir)
+
+		if c.code == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %s", c.name, err)
+			}
+			continue
+		}
+		if fe, ok := err.(*flex.Error); !ok || fe.Code != c.code {
+			t.Errorf("%s: expected %s error but got %v", c.name, c.code, err)
+		}
+		if f.ran("lsblk") || f.ran("mount") {
+			t.Errorf("%s: expected device not to be used but ran %q", c.name, f.calls)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package plugin
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/StackPointCloud/digitalocean-flex-volume/pkg/flex"
+	"github.com/golang/glog"
+)
+
+const (
+	// luksFormat is the format lsblk and blkid report for LUKS devices
+	luksFormat = "crypto_LUKS"
+	// mapperDir holds the device mapper devices
+	mapperDir = "/dev/mapper"
+	// luksUUIDPrefix starts the device mapper UUID of LUKS mappings
+	luksUUIDPrefix = "CRYPT-LUKS"
+	// luksMappingFile records the LUKS mapping at the device mount directory,
+	// where the mount hides it until the volume is unmounted
+	luksMappingFile = ".luks-mapping"
+)
+
+// encryption describes how an encrypted volume is opened
+type encryption struct {
+	// mapping is the device mapper name of the opened volume
+	mapping string
+	key     []byte
+}
+
+// device returns the device mapper device of the opened volume
+func (e *encryption) device() string {
+	return filepath.Join(mapperDir, e.mapping)
+}
+
+// encryption returns how the volume is opened if encrypted, nil otherwise.
+// The key is the file named after the volume ID or name at the key
+// directory: kubelet only passes volume secrets when mounting at the pods,
+// not when mounting the device where the volume is opened. The mapping is
+// named after the unique volume name.
+func (v *VolumePlugin) encryption(o *digitalOceanOptions) (*encryption, error) {
+	if o.Encrypted == "" {
+		return nil, nil
+	}
+	encrypted, err := parseBool(EncryptedOption, o.Encrypted)
+	if err != nil || !encrypted {
+		return nil, err
+	}
+
+	e := &encryption{mapping: o.VolumeID}
+	if e.mapping == "" {
+		e.mapping = o.VolumeName
+	}
+	if e.mapping == "" {
+		return nil, flex.NewError(flex.ErrorCodeInvalidOptions, "encrypted DigitalOcean volume needs volumeID or volumeName property at flex options")
+	}
+
+	if v.keyDir != "" {
+		for _, name := range []string{o.VolumeID, o.VolumeName} {
+			if name == "" {
+				continue
+			}
+			e.key, err = ioutil.ReadFile(filepath.Join(v.keyDir, name))
+			if err == nil || !os.IsNotExist(err) {
+				break
+			}
+		}
+		if err != nil && !os.IsNotExist(err) {
+			return nil, flex.NewError(flex.ErrorCodeInvalidOptions, "could not read key of volume %s: %s", e.mapping, err.Error())
+		}
+	}
+	if len(e.key) == 0 {
+		return nil, flex.NewError(flex.ErrorCodeInvalidOptions, "encrypted volume %s has no key, set a key file named after the volume at the key directory %q", e.mapping, v.keyDir)
+	}
+	return e, nil
+}
+
+// openEncrypted formats as LUKS the blank device, or any other if
+// reformatting is allowed, and opens it, returning the mapper device
+func (v *VolumePlugin) openEncrypted(device string, r *mountRequest) (string, error) {
+	e := r.encryption
+	active, err := v.luksActive(e.mapping)
+	if err != nil {
+		return "", err
+	}
+	if active {
+		return e.device(), nil
+	}
+
+	format, err := v.currentFormat(device)
+	if err != nil {
+		return "", err
+	}
+	if format != luksFormat {
+		if r.readOnly {
+			return "", flex.NewError(flex.ErrorCodeFormatMismatch, "device %s holds %q instead of an encrypted volume, refusing to mount it read only", device, format)
+		}
+		if format != "" {
+			if !r.allowReformat {
+				return "", flex.NewError(flex.ErrorCodeFormatMismatch, "device %s holds %s instead of an encrypted volume, refusing to encrypt it; "+
+					"set the %s flex option to destroy its data", device, format, AllowReformatOption)
+			}
+			glog.Warningf("encrypting device %s holding %s, its data is lost", device, format)
+		}
+		if out, err := v.exec.CombinedOutputWithInput(e.key, "cryptsetup", "-q", "luksFormat", "--key-file", "-", device); err != nil {
+			return "", flex.NewError(flex.ErrorCodeFormatFailed, "cryptsetup luksFormat %s failed with error [%s] and output [%s]", device, err.Error(), string(out))
+		}
+	}
+
+	args := []string{"luksOpen", "--key-file", "-"}
+	if r.readOnly {
+		args = append(args, "--readonly")
+	}
+	args = append(args, device, e.mapping)
+	if out, err := v.exec.CombinedOutputWithInput(e.key, "cryptsetup", args...); err != nil {
+		return "", flex.NewError(flex.ErrorCodeMountFailed, "cryptsetup luksOpen %s %s failed with error [%s] and output [%s]", device, e.mapping, err.Error(), string(out))
+	}
+	return e.device(), nil
+}
+
+// luksActive returns whether the LUKS mapping is open
+func (v *VolumePlugin) luksActive(mapping string) (bool, error) {
+	out, err := v.exec.CombinedOutput("cryptsetup", "status", mapping)
+	if err != nil {
+		// cryptsetup status exits with an error status for inactive mappings
+		if _, ok := exitCode(err); ok {
+			return false, nil
+		}
+		return false, flex.NewError(flex.ErrorCodeCommandFailed, "cryptsetup status %s failed with error [%s] and output [%s]", mapping, err.Error(), string(out))
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "type:" {
+			return strings.HasPrefix(fields[1], "LUKS"), nil
+		}
+	}
+	return false, nil
+}
+
+// luksMapping returns the name of the LUKS mapping of a device mapper
+// device, empty if the device is not one
+func (v *VolumePlugin) luksMapping(device string) string {
+	dir := filepath.Join(v.sysBlockDevices, filepath.Base(resolvePath(device)), "dm")
+	uuid, err := ioutil.ReadFile(filepath.Join(dir, "uuid"))
+	if err != nil || !strings.HasPrefix(string(uuid), luksUUIDPrefix) {
+		return ""
+	}
+	name, err := ioutil.ReadFile(filepath.Join(dir, "name"))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(name))
+}
+
+// recordMapping writes the LUKS mapping at the directory about to be mounted,
+// so that unmounting can close it once the mount is gone, even if a previous
+// attempt unmounted the volume but could not close it. Unmounting only gets
+// the directory, which kubelet names after the persistent volume.
+func recordMapping(dir, mapping string) error {
+	if err := ioutil.WriteFile(filepath.Join(dir, luksMappingFile), []byte(mapping+"\n"), 0600); err != nil {
+		return flex.NewError(flex.ErrorCodeMountFailed, "could not record LUKS mapping %s at %s: %s", mapping, dir, err.Error())
+	}
+	return nil
+}
+
+// recordedMapping returns the LUKS mapping recorded at the unmounted directory, empty if none
+func recordedMapping(dir string) string {
+	mapping, err := ioutil.ReadFile(filepath.Join(dir, luksMappingFile))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(mapping))
+}
+
+// removeMappingRecord removes the LUKS mapping record, so that kubelet can remove the directory
+func removeMappingRecord(dir string) {
+	if err := os.Remove(filepath.Join(dir, luksMappingFile)); err != nil && !os.IsNotExist(err) {
+		glog.Warningf("could not remove LUKS mapping record at %s: %s", dir, err.Error())
+	}
+}
+
+// closeEncrypted closes the LUKS mapping
+func (v *VolumePlugin) closeEncrypted(mapping string) error {
+	if out, err := v.exec.CombinedOutput("cryptsetup", "luksClose", mapping); err != nil {
+		return flex.NewError(flex.ErrorCodeUnmountFailed, "cryptsetup luksClose %s failed with error [%s] and output [%s]", mapping, err.Error(), string(out))
+	}
+	return nil
+}
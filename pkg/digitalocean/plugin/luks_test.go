@@ -0,0 +1,195 @@
+package plugin
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/StackPointCloud/digitalocean-flex-volume/pkg/flex"
+)
+
+const luksDevice = "/dev/sda"
+
+// encryptedOptions are the flex options of an encrypted volume
+const encryptedOptions = `{"kubernetes.io/fsType":"ext4","volumeID":"id0123456789","volumeName":"prueba","encrypted":"true"}`
+
+// withKeyFile sets the key directory of the plugin to one holding the key of the encrypted volume
+func withKeyFile(t *testing.T, vp *VolumePlugin, dir string) {
+	vp.keyDir = filepath.Join(dir, "keys")
+	if err := os.MkdirAll(vp.keyDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(vp.keyDir, "id0123456789"), []byte("secret key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMountDeviceEncrypted(t *testing.T) {
+	vp, f, dir := newMountPlugin(t)
+	defer os.RemoveAll(dir)
+	withKeyFile(t, vp, dir)
+	mountdir := filepath.Join(dir, "mnt")
+	mapper := "/dev/mapper/id0123456789"
+
+	f.on("cryptsetup status id0123456789", "/dev/mapper/id0123456789 is inactive.", exitError(4))
+	f.on("lsblk -n -o FSTYPE "+luksDevice, "\n", nil)
+	f.on("blkid -p -o export "+luksDevice, "", exitError(2))
+	f.on("lsblk -n -o FSTYPE "+mapper, "\n", nil)
+	f.on("blkid -p -o export "+mapper, "", exitError(2))
+
+	if _, err := vp.MountDevice(mountdir, luksDevice, encryptedOptions); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	for _, command := range []string{
+		"cryptsetup -q luksFormat --key-file - " + luksDevice,
+		"cryptsetup luksOpen --key-file - " + luksDevice + " id0123456789",
+		"mkfs -t ext4 -L prueba " + mapper,
+		"mount -t ext4 " + mapper + " " + mountdir,
+	} {
+		if !f.ran(command) {
+			t.Errorf("expected %q but ran %q", command, f.calls)
+		}
+		if input, ok := f.inputs[command]; ok && string(input) != "secret key" {
+			t.Errorf("expected key as input of %q but got %q", command, input)
+		}
+	}
+	if f.ran("mkfs -t ext4 -L prueba " + luksDevice) {
+		t.Errorf("expected the raw device not to be formatted but ran %q", f.calls)
+	}
+	if mapping := recordedMapping(mountdir); mapping != "id0123456789" {
+		t.Errorf("expected mapping recorded at the mount dir but got %q", mapping)
+	}
+
+	// existing LUKS volumes are opened without formatting
+	f.calls = nil
+	f.on("lsblk -n -o FSTYPE "+luksDevice, "crypto_LUKS\next4\n", nil)
+	f.on("lsblk -n -o FSTYPE "+mapper, "ext4\n", nil)
+	if _, err := vp.MountDevice(mountdir, luksDevice, encryptedOptions); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if f.ran("cryptsetup -q luksFormat") || f.ran("mkfs") || !f.ran("cryptsetup luksOpen") {
+		t.Errorf("expected existing volume to be opened but ran %q", f.calls)
+	}
+
+	// open mappings are reused
+	f.calls = nil
+	f.on("cryptsetup status id0123456789", "/dev/mapper/id0123456789 is active.\n  type:    LUKS2\n", nil)
+	if _, err := vp.MountDevice(mountdir, luksDevice, encryptedOptions); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if f.ran("cryptsetup luksOpen") {
+		t.Errorf("expected open mapping to be reused but ran %q", f.calls)
+	}
+}
+
+func TestMountDeviceEncryptedErrors(t *testing.T) {
+	vp, f, dir := newMountPlugin(t)
+	defer os.RemoveAll(dir)
+	withKeyFile(t, vp, dir)
+	mountdir := filepath.Join(dir, "mnt")
+
+	f.on("cryptsetup status id0123456789", "", exitError(4))
+	f.on("lsblk -n -o FSTYPE "+luksDevice, "ext4\n", nil)
+
+	// plain filesystems are not encrypted
+	_, err := vp.MountDevice(mountdir, luksDevice, encryptedOptions)
+	if fe, ok := err.(*flex.Error); !ok || fe.Code != flex.ErrorCodeFormatMismatch {
+		t.Errorf("expected %s error but got %v", flex.ErrorCodeFormatMismatch, err)
+	}
+	if f.ran("cryptsetup -q luksFormat") {
+		t.Errorf("expected no LUKS format but ran %q", f.calls)
+	}
+
+	// volumes without key file
+	_, err = vp.MountDevice(mountdir, luksDevice, `{"volumeID":"id9876543210","encrypted":"true"}`)
+	if fe, ok := err.(*flex.Error); !ok || fe.Code != flex.ErrorCodeInvalidOptions {
+		t.Errorf("expected %s error but got %v", flex.ErrorCodeInvalidOptions, err)
+	}
+
+	// mappings are closed when mounting fails
+	f.calls = nil
+	f.on("lsblk -n -o FSTYPE "+luksDevice, "crypto_LUKS\n", nil)
+	f.on("lsblk -n -o FSTYPE /dev/mapper/id0123456789", "xfs\n", nil)
+	if _, err = vp.MountDevice(mountdir, luksDevice, encryptedOptions); err == nil {
+		t.Errorf("expected error mounting a xfs filesystem as ext4")
+	}
+	if !f.ran("cryptsetup luksClose id0123456789") {
+		t.Errorf("expected mapping to be closed but ran %q", f.calls)
+	}
+}
+
+func TestEncryptionKeyFile(t *testing.T) {
+	vp, _, dir := newMountPlugin(t)
+	defer os.RemoveAll(dir)
+	vp.keyDir = dir
+	if err := ioutil.WriteFile(filepath.Join(dir, "prueba"), []byte("file key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	e, err := vp.encryption(&digitalOceanOptions{VolumeID: "id0123456789", VolumeName: "prueba", Encrypted: "true"})
+	if err != nil || string(e.key) != "file key" || e.mapping != "id0123456789" {
+		t.Errorf("expected key from file but got %+v, %v", e, err)
+	}
+	if e, err := vp.encryption(&digitalOceanOptions{VolumeID: "id0123456789", Encrypted: "false"}); err != nil || e != nil {
+		t.Errorf("expected no encryption but got %+v, %v", e, err)
+	}
+	if _, err := vp.encryption(&digitalOceanOptions{VolumeID: "id0123456789", Encrypted: "yes please"}); err == nil {
+		t.Errorf("expected error for invalid encrypted option")
+	}
+}
+
+func TestUnmountDeviceEncrypted(t *testing.T) {
+	vp, f, dir := newMountPlugin(t)
+	defer os.RemoveAll(dir)
+	// kubelet names the dir after the persistent volume, not the mapping
+	mountdir := filepath.Join(dir, "pvc-uid-data")
+
+	// the mapper device is reported as /dev/dm-0 by the mount table
+	dm := filepath.Join(vp.sysBlockDevices, "dm-0", "dm")
+	for _, d := range []string{dm, mountdir} {
+		if err := os.MkdirAll(d, 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ioutil.WriteFile(filepath.Join(dm, "uuid"), []byte("CRYPT-LUKS2-0123-id0123456789\n"), 0600)
+	ioutil.WriteFile(filepath.Join(dm, "name"), []byte("id0123456789\n"), 0600)
+
+	f.on(findmntCommand+mountdir, mountdir+" /dev/dm-0 ext4 rw,relatime\n", nil)
+	if _, err := vp.UnmountDevice(mountdir); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !f.ran("umount "+mountdir) || !f.ran("cryptsetup luksClose id0123456789") {
+		t.Errorf("expected unmount and close but ran %q", f.calls)
+	}
+
+	// mappings left open by failed unmounts are found by the record of the mount
+	f.calls = nil
+	f.on(findmntCommand+mountdir, "", exitError(1))
+	f.on("cryptsetup status id0123456789", "/dev/mapper/id0123456789 is active.\n  type:    LUKS2\n", nil)
+	if err := recordMapping(mountdir, "id0123456789"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := vp.UnmountDevice(mountdir); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if f.ran("umount") || !f.ran("cryptsetup luksClose id0123456789") {
+		t.Errorf("expected close without unmount but ran %q", f.calls)
+	}
+	if mapping := recordedMapping(mountdir); mapping != "" {
+		t.Errorf("expected mapping record to be removed but got %q", mapping)
+	}
+
+	// closed mappings are left alone
+	f.calls = nil
+	f.on("cryptsetup status id0123456789", "/dev/mapper/id0123456789 is inactive.", exitError(4))
+	if err := recordMapping(mountdir, "id0123456789"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := vp.UnmountDevice(mountdir); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if f.ran("cryptsetup luksClose") {
+		t.Errorf("expected no close of an inactive mapping but ran %q", f.calls)
+	}
+}
@@ -0,0 +1,124 @@
+package plugin
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/StackPointCloud/digitalocean-flex-volume/pkg/flex"
+	"github.com/golang/glog"
+)
+
+// labelLimits are the longest filesystem labels, in bytes
+var labelLimits = map[string]int{
+	"ext2": 16,
+	"ext3": 16,
+	"ext4": 16,
+	"xfs":  12,
+}
+
+// fsLabel returns the label of a filesystem for the volume name, truncated
+// to the filesystem limit, or empty if the filesystem is not labeled
+func fsLabel(fsType, volumeName string) string {
+	limit, ok := labelLimits[fsType]
+	if !ok {
+		return ""
+	}
+	if len(volumeName) > limit {
+		return volumeName[:limit]
+	}
+	return volumeName
+}
+
+// checkMkfsArgs validates extra mkfs arguments, which can not override
+// the filesystem type, the label or the format safety policy
+func checkMkfsArgs(args []string) error {
+	for _, a := range args {
+		switch a {
+		case "-t", "-L", "-F", "-f":
+			return fmt.Errorf("mkfs argument %s is set by the driver", a)
+		}
+	}
+	return nil
+}
+
+// mkfsArgs returns the mkfs arguments formatting the device, forced
+// arguments let the filesystem tool overwrite existing signatures
+func mkfsArgs(fsType, device string, force bool, label string, extra []string) []string {
+	args := []string{"-t", fsType}
+	if force {
+		switch fsType {
+		case "xfs":
+			args = append(args, "-f")
+		case "ext2", "ext3", "ext4":
+			args = append(args, "-F")
+		}
+	}
+	if label != "" {
+		args = append(args, "-L", label)
+	}
+	args = append(args, extra...)
+	return append(args, device)
+}
+
+// format creates the filesystem at the device following the format safety
+// policy: blank devices are formatted, devices already holding the filesystem
+// are kept, and anything else fails unless reformatting is explicitly allowed.
+// Read only mounts never format the device. Returns whether the device was formatted.
+func (v *VolumePlugin) format(device string, r *mountRequest) (bool, error) {
+	fsType := r.fsType
+	format, err := v.currentFormat(device)
+	if err != nil {
+		return false, err
+	}
+
+	if format == fsType {
+		return false, v.checkLabel(device, r.label)
+	}
+
+	if r.readOnly {
+		if format == "" {
+			return false, flex.NewError(flex.ErrorCodeMountFailed, "device %s is blank and can not be formatted to be mounted read only", device)
+		}
+		return false, flex.NewError(flex.ErrorCodeFormatMismatch, "device %s holds %s but %s was requested, refusing to mount it read only", device, format, fsType)
+	}
+
+	if format != "" {
+		if !r.allowReformat {
+			return false, flex.NewError(flex.ErrorCodeFormatMismatch, "device %s holds %s but %s was requested, refusing to format it; "+
+				"fix the volume fsType or set the %s flex option to destroy its data", device, format, fsType, AllowReformatOption)
+		}
+		glog.Warningf("reformatting device %s holding %s as %s, its data is lost", device, format, fsType)
+	}
+
+	args := mkfsArgs(fsType, device, format != "", r.label, r.mkfsArgs)
+	if mkfsOut, err := v.exec.CombinedOutput("mkfs", args...); err != nil {
+		return false, flex.NewError(flex.ErrorCodeFormatFailed, "mkfs %s failed with error [%s] and output [%s]", strings.Join(args, " "), err.Error(), string(mkfsOut))
+	}
+	return true, nil
+}
+
+// checkLabel warns if the filesystem at the device is labeled for another
+// volume. The label follows the volume name when formatted, so volumes
+// restored from snapshots or renamed legitimately hold another label and
+// are mounted anyway. Filesystems without label, such as those formatted
+// by older drivers, are accepted silently.
+func (v *VolumePlugin) checkLabel(device, label string) error {
+	if label == "" {
+		return nil
+	}
+
+	values, err := v.probe(device)
+	if err != nil {
+		return err
+	}
+	current := values["LABEL"]
+	if current == "" {
+		glog.V(2).Infof("filesystem at device %s has no label, expected %q", device, label)
+		return nil
+	}
+	if current != label {
+		glog.Warningf("filesystem at device %s is labeled %q but the volume label is %q, "+
+			"expected if the volume was restored from a snapshot or renamed", device, current, label)
+	}
+	return nil
+}
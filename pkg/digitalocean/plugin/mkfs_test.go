@@ -0,0 +1,96 @@
+package plugin
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/StackPointCloud/digitalocean-flex-volume/pkg/flex"
+)
+
+func TestFsLabel(t *testing.T) {
+	cases := []struct {
+		fsType, name, expected string
+	}{
+		{"ext4", "data", "data"},
+		{"ext4", "pvc-0123456789abcdef", "pvc-0123456789ab"},
+		{"xfs", "pvc-0123456789abcdef", "pvc-01234567"},
+		{"btrfs", "data", ""},
+		{"ext4", "", ""},
+	}
+	for _, c := range cases {
+		if label := fsLabel(c.fsType, c.name); label != c.expected {
+			t.Errorf("expected %s label %q for %q but got %q", c.fsType, c.expected, c.name, label)
+		}
+	}
+}
+
+func TestMountDeviceMkfsOptions(t *testing.T) {
+	const device = "/dev/sda"
+	vp, f, dir := newMountPlugin(t)
+	defer os.RemoveAll(dir)
+	mountdir := filepath.Join(dir, "mnt")
+	vp.mkfsOptions = map[string][]string{
+		"ext4": {"-E", "lazy_itable_init=0,lazy_journal_init=0"},
+		"xfs":  {"-i", "size=512"},
+	}
+
+	f.on("lsblk -n -o FSTYPE "+device, "\n", nil)
+	f.on("blkid -p -o export "+device, "", exitError(2))
+	options := `{"kubernetes.io/fsType":"ext4","volumeName":"pvc-0123456789abcdef","mkfsOptions":"-i 4096"}`
+	if _, err := vp.MountDevice(mountdir, device, options); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expected := "mkfs -t ext4 -L pvc-0123456789ab -E lazy_itable_init=0,lazy_journal_init=0 -i 4096 " + device
+	if !f.ran(expected) {
+		t.Errorf("expected %q but ran %q", expected, f.calls)
+	}
+
+	// volumes can not override the arguments set by the driver
+	f.calls = nil
+	_, err := vp.MountDevice(mountdir, device, `{"kubernetes.io/fsType":"ext4","mkfsOptions":"-F -i 4096"}`)
+	if fe, ok := err.(*flex.Error); !ok || fe.Code != flex.ErrorCodeInvalidOptions {
+		t.Errorf("expected %s error but got %v", flex.ErrorCodeInvalidOptions, err)
+	}
+	if f.ran("mkfs") {
+		t.Errorf("expected no mkfs with invalid options but ran %q", f.calls)
+	}
+}
+
+func TestMountDeviceLabel(t *testing.T) {
+	const device = "/dev/sda"
+	cases := []struct {
+		name       string
+		blkid      string
+		volumeName string
+	}{
+		{"same label", "TYPE=xfs\nLABEL=pvc-01234567\n", "pvc-0123456789abcdef"},
+		{"no label", "TYPE=xfs\n", "pvc-0123456789abcdef"},
+		// snapshot restore creates a volume named after the snapshot holding the original label
+		{"restored volume", "TYPE=xfs\nLABEL=pvc-01234567\n", "prueba-restored"},
+		{"renamed volume", "TYPE=xfs\nLABEL=pvc-76543210\n", "pvc-0123456789abcdef"},
+	}
+	for _, c := range cases {
+		vp, f, dir := newMountPlugin(t)
+		mountdir := filepath.Join(dir, "mnt")
+		f.on("lsblk -n -o FSTYPE "+device, "xfs\n", nil)
+		f.on("blkid -p -o export "+device, c.blkid, nil)
+
+		_, err := vp.MountDevice(mountdir, device, `{"kubernetes.io/fsType":"xfs","volumeName":"`+c.volumeName+`"}`)
+		os.RemoveAll(dir)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", c.name, err)
+		}
+		if f.ran("mkfs") || !f.ran("mount") {
+			t.Errorf("%s: expected mount without format but ran %q", c.name, f.calls)
+		}
+	}
+}
+
+func TestNewPluginMkfsOptions(t *testing.T) {
+	options := DefaultOptions()
+	options.MkfsOptions = map[string][]string{"ext4": {"-L", "data"}}
+	if _, err := NewDigitalOceanVolumePlugin(nil, &options); err == nil {
+		t.Errorf("expected error for mkfs options setting the label")
+	}
+}
@@ -0,0 +1,252 @@
+package plugin
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/StackPointCloud/digitalocean-flex-volume/pkg/flex"
+	"github.com/StackPointCloud/digitalocean-flex-volume/pkg/mountinfo"
+)
+
+const (
+	// MounterNative reads /proc/self/mountinfo and calls the mount syscalls
+	MounterNative = "native"
+	// MounterExec runs findmnt, mount and umount, which must be in the PATH
+	MounterExec = "exec"
+
+	// sysBlockDir links block device numbers to their sysfs directory
+	sysBlockDir = "/sys/dev/block"
+)
+
+// mountPoint is a filesystem mounted at a directory
+type mountPoint struct {
+	// Dir is the mount point
+	Dir string
+	// Device is the mounted device, or the filesystem specific source
+	Device string
+	FSType string
+	// Options are the per mount options
+	Options []string
+}
+
+// mounter mounts and unmounts filesystems at the node
+type mounter interface {
+	// MountPoint returns the filesystem visible at dir, nil if nothing is mounted there
+	MountPoint(dir string) (*mountPoint, error)
+	// DeviceMountPoint returns a mount of the device, nil if it is not mounted
+	DeviceMountPoint(device string) (*mountPoint, error)
+	// Mount mounts the device at dir
+	Mount(device, dir, fsType string, options []string) error
+	// Unmount unmounts the filesystem visible at dir
+	Unmount(dir string) error
+	// LazyUnmount detaches the filesystem visible at dir without
+	// waiting for it to be idle, which dead mounts never are
+	LazyUnmount(dir string) error
+}
+
+// newMounter returns the mounter of the kind, MounterNative if empty
+func newMounter(kind string, exec executor) (mounter, error) {
+	switch kind {
+	case "", MounterNative:
+		return &nativeMounter{file: mountinfo.File, sysBlock: sysBlockDir}, nil
+	case MounterExec:
+		return &execMounter{exec: exec}, nil
+	default:
+		return nil, fmt.Errorf("unknown mounter %q, expected %s or %s", kind, MounterNative, MounterExec)
+	}
+}
+
+// nativeMounter reads the mount table and calls the mount syscalls,
+// without depending on the node tools
+type nativeMounter struct {
+	// file is the mount table
+	file string
+	// sysBlock is the sysfs directory of block device numbers
+	sysBlock string
+}
+
+// MountPoint finds the last mount at dir in the mount table, since later
+// mounts over the same directory hide earlier ones. Bind mounts are
+// reported with the device backing the mounted directory.
+func (m *nativeMounter) MountPoint(dir string) (*mountPoint, error) {
+	dir = resolvePath(dir)
+
+	mounts, err := mountinfo.Read(m.file)
+	if err != nil {
+		return nil, flex.NewError(flex.ErrorCodeCommandFailed, "could not read mount table: %s", err.Error())
+	}
+
+	var found *mountinfo.Mount
+	for i := range mounts {
+		if mounts[i].Mountpoint == dir {
+			found = &mounts[i]
+		}
+	}
+	if found == nil {
+		return nil, nil
+	}
+
+	return m.mountPoint(found), nil
+}
+
+// DeviceMountPoint finds the first mount of the device in the mount table,
+// comparing the block device nodes of the mounts with the resolved device
+func (m *nativeMounter) DeviceMountPoint(device string) (*mountPoint, error) {
+	device = resolvePath(device)
+
+	mounts, err := mountinfo.Read(m.file)
+	if err != nil {
+		return nil, flex.NewError(flex.ErrorCodeCommandFailed, "could not read mount table: %s", err.Error())
+	}
+	for i := range mounts {
+		if mp := m.mountPoint(&mounts[i]); mp.Device == device {
+			return mp, nil
+		}
+	}
+	return nil, nil
+}
+
+// mountPoint returns the mount point of the mount table entry
+func (m *nativeMounter) mountPoint(mount *mountinfo.Mount) *mountPoint {
+	return &mountPoint{
+		Dir:     mount.Mountpoint,
+		Device:  m.device(mount),
+		FSType:  mount.FSType,
+		Options: strings.Split(mount.Options, ","),
+	}
+}
+
+// device returns the block device node of the mount from its device number,
+// since the mount source might be stale or a name such as /dev/root.
+// The source is returned for mounts not backed by a block device.
+func (m *nativeMounter) device(mount *mountinfo.Mount) string {
+	link, err := os.Readlink(filepath.Join(m.sysBlock, fmt.Sprintf("%d:%d", mount.Major, mount.Minor)))
+	if err != nil {
+		return mount.Source
+	}
+	return filepath.Join("/dev", filepath.Base(link))
+}
+
+// execMounter runs findmnt, mount and umount
+type execMounter struct {
+	exec executor
+}
+
+// MountPoint lists the mounts at dir with findmnt, which exits with
+// an error status when nothing is mounted there
+func (m *execMounter) MountPoint(dir string) (*mountPoint, error) {
+	return m.findmnt("--mountpoint", dir)
+}
+
+// DeviceMountPoint lists the mounts of the device with findmnt
+func (m *execMounter) DeviceMountPoint(device string) (*mountPoint, error) {
+	return m.findmnt("--source", device)
+}
+
+// findmnt returns the last mount listed by findmnt for the filter
+func (m *execMounter) findmnt(filter, value string) (*mountPoint, error) {
+	out, err := m.exec.Output("findmnt", "-n", "-r", "-o", "TARGET,SOURCE,FSTYPE,OPTIONS", filter, value)
+	if err != nil {
+		if _, ok := exitCode(err); !ok {
+			return nil, flex.NewError(flex.ErrorCodeCommandFailed, "findmnt command failed: %s", err.Error())
+		}
+		return nil, nil
+	}
+
+	// overlapping mounts are listed in mount order, the last one is visible
+	var found *mountPoint
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 4 {
+			continue
+		}
+		// bind mounts sources are reported as device[/dir]
+		device := unescapeFindmnt(fields[1])
+		if i := strings.Index(device, "["); i > 0 && strings.HasSuffix(device, "]") {
+			device = device[:i]
+		}
+		found = &mountPoint{
+			Dir:     unescapeFindmnt(fields[0]),
+			Device:  device,
+			FSType:  fields[2],
+			Options: strings.Split(fields[3], ","),
+		}
+	}
+	return found, nil
+}
+
+// unescapeFindmnt decodes the \xHH escapes of findmnt raw output
+func unescapeFindmnt(s string) string {
+	if !strings.Contains(s, `\x`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) && s[i+1] == 'x' {
+			if c, err := strconv.ParseUint(s[i+2:i+4], 16, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+func (m *execMounter) Mount(device, dir, fsType string, options []string) error {
+	args := []string{}
+	if fsType != "" {
+		args = append(args, "-t", fsType)
+	}
+	if len(options) > 0 {
+		args = append(args, "-o", strings.Join(options, ","))
+	}
+	args = append(args, device, dir)
+	if out, err := m.exec.CombinedOutput("mount", args...); err != nil {
+		return flex.NewError(flex.ErrorCodeMountFailed, "mounting device %s at dir %s failed with error [%s] and output [%s]", device, dir, err.Error(), string(out))
+	}
+	return nil
+}
+
+func (m *execMounter) Unmount(dir string) error {
+	if out, err := m.exec.CombinedOutput("umount", dir); err != nil {
+		return flex.NewError(flex.ErrorCodeUnmountFailed, "unmounting the device at %s failed with error [%s] and output [%s]", dir, err.Error(), string(out))
+	}
+	return nil
+}
+
+func (m *execMounter) LazyUnmount(dir string) error {
+	if out, err := m.exec.CombinedOutput("umount", "-l", dir); err != nil {
+		return flex.NewError(flex.ErrorCodeUnmountFailed, "detaching the device at %s failed with error [%s] and output [%s]", dir, err.Error(), string(out))
+	}
+	return nil
+}
+
+// resolvePath returns the path with symbolic links resolved as the
+// mount table reports it, or cleaned if it can not be resolved
+func resolvePath(path string) string {
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		return resolved
+	}
+	return filepath.Clean(path)
+}
+
+// sameDevice returns whether both paths are the same device node
+func sameDevice(a, b string) bool {
+	if resolvePath(a) == resolvePath(b) {
+		return true
+	}
+	ai, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	bi, err := os.Stat(b)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(ai, bi)
+}
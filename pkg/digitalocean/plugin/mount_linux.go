@@ -0,0 +1,83 @@
+//go:build linux
+// +build linux
+
+package plugin
+
+import (
+	"strings"
+
+	"github.com/StackPointCloud/digitalocean-flex-volume/pkg/flex"
+	"golang.org/x/sys/unix"
+)
+
+// mountFlags are the mount options passed as syscall flags, any other
+// option is passed to the filesystem as data
+var mountFlags = map[string]struct {
+	flag  uintptr
+	clear bool
+}{
+	"ro":          {unix.MS_RDONLY, false},
+	"rw":          {unix.MS_RDONLY, true},
+	"nosuid":      {unix.MS_NOSUID, false},
+	"suid":        {unix.MS_NOSUID, true},
+	"nodev":       {unix.MS_NODEV, false},
+	"dev":         {unix.MS_NODEV, true},
+	"noexec":      {unix.MS_NOEXEC, false},
+	"exec":        {unix.MS_NOEXEC, true},
+	"sync":        {unix.MS_SYNCHRONOUS, false},
+	"async":       {unix.MS_SYNCHRONOUS, true},
+	"dirsync":     {unix.MS_DIRSYNC, false},
+	"noatime":     {unix.MS_NOATIME, false},
+	"atime":       {unix.MS_NOATIME, true},
+	"nodiratime":  {unix.MS_NODIRATIME, false},
+	"diratime":    {unix.MS_NODIRATIME, true},
+	"relatime":    {unix.MS_RELATIME, false},
+	"norelatime":  {unix.MS_RELATIME, true},
+	"strictatime": {unix.MS_STRICTATIME, false},
+	"lazytime":    {unix.MS_LAZYTIME, false},
+	"nolazytime":  {unix.MS_LAZYTIME, true},
+	"bind":        {unix.MS_BIND, false},
+	"rbind":       {unix.MS_BIND | unix.MS_REC, false},
+	"remount":     {unix.MS_REMOUNT, false},
+	"defaults":    {0, false},
+}
+
+// parseMountOptions splits the options into syscall flags and filesystem data
+func parseMountOptions(options []string) (uintptr, string) {
+	var flags uintptr
+	data := []string{}
+	for _, o := range options {
+		f, ok := mountFlags[o]
+		switch {
+		case !ok:
+			data = append(data, o)
+		case f.clear:
+			flags &^= f.flag
+		default:
+			flags |= f.flag
+		}
+	}
+	return flags, strings.Join(data, ",")
+}
+
+func (m *nativeMounter) Mount(device, dir, fsType string, options []string) error {
+	flags, data := parseMountOptions(options)
+	if err := unix.Mount(device, dir, fsType, flags, data); err != nil {
+		return flex.NewError(flex.ErrorCodeMountFailed, "mounting device %s at dir %s failed with error [%s]", device, dir, err.Error())
+	}
+	return nil
+}
+
+func (m *nativeMounter) Unmount(dir string) error {
+	if err := unix.Unmount(dir, 0); err != nil {
+		return flex.NewError(flex.ErrorCodeUnmountFailed, "unmounting the device at %s failed with error [%s]", dir, err.Error())
+	}
+	return nil
+}
+
+func (m *nativeMounter) LazyUnmount(dir string) error {
+	if err := unix.Unmount(dir, unix.MNT_DETACH); err != nil {
+		return flex.NewError(flex.ErrorCodeUnmountFailed, "detaching the device at %s failed with error [%s]", dir, err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+//go:build linux
+// +build linux
+
+package plugin
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/StackPointCloud/digitalocean-flex-volume/pkg/mountinfo"
+	"golang.org/x/sys/unix"
+)
+
+func TestParseMountOptions(t *testing.T) {
+	flags, data := parseMountOptions([]string{"defaults", "ro", "noatime", "nodev", "discard", "errors=remount-ro"})
+	if flags != unix.MS_RDONLY|unix.MS_NOATIME|unix.MS_NODEV || data != "discard,errors=remount-ro" {
+		t.Errorf("unexpected flags %x and data %q", flags, data)
+	}
+
+	flags, _ = parseMountOptions([]string{"ro", "noexec", "rw"})
+	if flags != unix.MS_NOEXEC {
+		t.Errorf("expected later options to clear flags but got %x", flags)
+	}
+}
+
+func TestMountBlockDeviceNode(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("publishing block devices needs root")
+	}
+	vp, _, dir := newMountPlugin(t)
+	defer os.RemoveAll(dir)
+	vp.mounter = &nativeMounter{file: mountinfo.File, sysBlock: sysBlockDir}
+	mountdir := filepath.Join(dir, "pods", "0123-4567", "volumes", "digitalocean~flex-volume", "pvc-uid-data")
+	deviceDir := filepath.Join(dir, "plugins", "kubernetes.io", "flexvolume", "digitalocean", "flex-volume", "mounts", "pvc-uid-data")
+	device := filepath.Join(dir, "loop0")
+	if err := unix.Mknod(device, unix.S_IFBLK|0600, int(unix.Mkdev(7, 0))); err != nil {
+		t.Skipf("could not create device node: %s", err)
+	}
+	if err := publishBlock(device, deviceDir); err != nil {
+		t.Fatal(err)
+	}
+
+	// the pod directory holds the device node, not a link to the host /dev
+	if _, err := vp.Mount(mountdir, `{"volumeID":"id0123456789","volumeMode":"Block"}`); err != nil {
+		if strings.Contains(err.Error(), unix.EPERM.Error()) {
+			t.Skipf("mounting is not permitted: %s", err)
+		}
+		t.Fatalf("unexpected error: %s", err)
+	}
+	fi, err := os.Lstat(mountdir)
+	if err != nil || fi.Mode()&os.ModeDevice == 0 || fi.Mode()&os.ModeCharDevice != 0 {
+		t.Errorf("expected block device node at %s but got %v, %v", mountdir, fi, err)
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); !ok || uint64(st.Rdev) != unix.Mkdev(7, 0) {
+		t.Errorf("expected device 7:0 at %s but got %+v", mountdir, fi.Sys())
+	}
+
+	if _, err := vp.Unmount(mountdir); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, err := os.Lstat(mountdir); !os.IsNotExist(err) {
+		t.Errorf("expected file to be removed but got %v", err)
+	}
+}
@@ -0,0 +1,121 @@
+package plugin
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNativeMountPoint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mount")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the first mount at /mnt/data is hidden by the later bind mount
+	content := `22 1 8:1 / / rw,relatime shared:1 - ext4 /dev/root rw
+30 22 8:16 / /mnt/data rw,relatime shared:2 - ext4 /dev/sdb rw
+31 22 8:32 /exported /mnt/data ro,relatime shared:3 - xfs /dev/sdc rw
+32 22 0:40 / /mnt/my\040dir rw - tmpfs tmpfs rw
+`
+	file := filepath.Join(dir, "mountinfo")
+	if err := ioutil.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	sysBlock := filepath.Join(dir, "block")
+	if err := os.Mkdir(sysBlock, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("../../devices/virtual/block/sda1", filepath.Join(sysBlock, "8:1")); err != nil {
+		t.Fatal(err)
+	}
+
+	m := &nativeMounter{file: file, sysBlock: sysBlock}
+	cases := []struct {
+		dir     string
+		device  string
+		fsType  string
+		options string
+	}{
+		{"/", "/dev/sda1", "ext4", "rw,relatime"},
+		{"/mnt/data", "/dev/sdc", "xfs", "ro,relatime"},
+		{"/mnt/data/", "/dev/sdc", "xfs", "ro,relatime"},
+		{"/mnt/my dir", "tmpfs", "tmpfs", "rw"},
+		{"/mnt/other", "", "", ""},
+	}
+	for _, c := range cases {
+		mp, err := m.MountPoint(c.dir)
+		if err != nil {
+			t.Errorf("unexpected error at %q: %s", c.dir, err)
+			continue
+		}
+		if c.device == "" {
+			if mp != nil {
+				t.Errorf("expected nothing mounted at %q but got %+v", c.dir, mp)
+			}
+			continue
+		}
+		if mp == nil || mp.Device != c.device || mp.FSType != c.fsType || strings.Join(mp.Options, ",") != c.options {
+			t.Errorf("expected %s %s %s mounted at %q but got %+v", c.device, c.fsType, c.options, c.dir, mp)
+		}
+	}
+
+	if mp, err := m.DeviceMountPoint("/dev/sdb"); err != nil || mp == nil || mp.Dir != "/mnt/data" {
+		t.Errorf("expected /dev/sdb mounted at /mnt/data but got %+v, %v", mp, err)
+	}
+	if mp, err := m.DeviceMountPoint("/dev/sdd"); err != nil || mp != nil {
+		t.Errorf("expected /dev/sdd not mounted but got %+v, %v", mp, err)
+	}
+
+	m.file = filepath.Join(dir, "missing")
+	if _, err := m.MountPoint("/"); err == nil {
+		t.Errorf("expected error reading a missing mount table")
+	}
+}
+
+func TestExecMountPoint(t *testing.T) {
+	f := newFakeExecutor()
+	m := &execMounter{exec: f}
+
+	f.on(findmntCommand+"/mnt/data", "/mnt/data /dev/sdb ext4 rw,relatime\n/mnt/data /dev/sdc[/exported] xfs ro,relatime\n", nil)
+	f.on(findmntCommand+"/mnt/my dir", `/mnt/my\x20dir tmpfs tmpfs rw`+"\n", nil)
+	f.on(findmntCommand+"/mnt/other", "", exitError(1))
+	f.on(findmntCommand+"/mnt/broken", "", os.ErrNotExist)
+
+	mp, err := m.MountPoint("/mnt/data")
+	if err != nil || mp == nil || mp.Device != "/dev/sdc" || mp.FSType != "xfs" || mp.Options[0] != "ro" {
+		t.Errorf("expected bind mount of /dev/sdc but got %+v, %v", mp, err)
+	}
+	mp, err = m.MountPoint("/mnt/my dir")
+	if err != nil || mp == nil || mp.Dir != "/mnt/my dir" {
+		t.Errorf("expected escaped mount point but got %+v, %v", mp, err)
+	}
+	mp, err = m.MountPoint("/mnt/other")
+	if err != nil || mp != nil {
+		t.Errorf("expected nothing mounted but got %+v, %v", mp, err)
+	}
+	if _, err := m.MountPoint("/mnt/broken"); err == nil {
+		t.Errorf("expected error when findmnt can not run")
+	}
+
+	if err := m.Mount("/dev/sdb", "/mnt/data", "ext4", []string{"ro", "noatime"}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !f.ran("mount -t ext4 -o ro,noatime /dev/sdb /mnt/data") {
+		t.Errorf("expected mount with options but ran %q", f.calls)
+	}
+}
+
+func TestNewMounter(t *testing.T) {
+	for _, kind := range []string{"", MounterNative, MounterExec} {
+		if _, err := newMounter(kind, newFakeExecutor()); err != nil {
+			t.Errorf("unexpected error for mounter %q: %s", kind, err)
+		}
+	}
+	if _, err := newMounter("fuse", newFakeExecutor()); err == nil {
+		t.Errorf("expected error for unknown mounter")
+	}
+}
@@ -0,0 +1,22 @@
+//go:build !linux
+// +build !linux
+
+package plugin
+
+import (
+	"github.com/StackPointCloud/digitalocean-flex-volume/pkg/flex"
+)
+
+// native mounts are only available on linux
+
+func (m *nativeMounter) Mount(device, dir, fsType string, options []string) error {
+	return flex.NewError(flex.ErrorCodeMountFailed, "native mounts are only supported on linux, use the %s mounter", MounterExec)
+}
+
+func (m *nativeMounter) Unmount(dir string) error {
+	return flex.NewError(flex.ErrorCodeUnmountFailed, "native mounts are only supported on linux, use the %s mounter", MounterExec)
+}
+
+func (m *nativeMounter) LazyUnmount(dir string) error {
+	return flex.NewError(flex.ErrorCodeUnmountFailed, "native mounts are only supported on linux, use the %s mounter", MounterExec)
+}
@@ -1,17 +1,17 @@
 package plugin
 
 import (
-	"bufio"
 	"fmt"
 	"os"
-	"os/exec"
 	"strings"
 
 	"github.com/StackPointCloud/digitalocean-flex-volume/pkg/flex"
-
-	"golang.org/x/sys/unix"
+	"github.com/golang/glog"
 )
 
+// unknownFormat is the format of devices holding data other than a filesystem
+const unknownFormat = "unknown data, probably partitions"
+
 // MountDevice mounts the volume as a device
 func (v *VolumePlugin) MountDevice(mountdir, device string, options string) (*flex.DriverStatus, error) {
 	opt, err := v.newOptions(options)
@@ -19,63 +19,128 @@ func (v *VolumePlugin) MountDevice(mountdir, device string, options string) (*fl
 		return nil, err
 	}
 
-	err = v.internalMount(mountdir, device, opt.FsType)
+	r, rejected, err := v.mountRequest(opt)
+	if err != nil {
+		return nil, err
+	}
+
+	fsckMessage, err := v.internalMount(mountdir, device, r)
 	if err != nil {
 		return nil, err
 	}
 
+	messages := []string{}
+	if len(rejected) > 0 {
+		glog.Warningf("ignored mount options %s not allowed for %s at device %s", strings.Join(rejected, ","), r.fsType, device)
+		messages = append(messages, fmt.Sprintf("ignored mount options not allowed for %s: %s", r.fsType, strings.Join(rejected, ",")))
+	}
+	if fsckMessage != "" {
+		messages = append(messages, fsckMessage)
+	}
+
 	return &flex.DriverStatus{
-		Status: flex.StatusSuccess,
+		Status:  flex.StatusSuccess,
+		Message: strings.Join(messages, "; "),
 	}, nil
 }
 
-// UnmountDevice from the node
-func (v *VolumePlugin) UnmountDevice(device string) (*flex.DriverStatus, error) {
-	if err := v.internalUnmount(device); err != nil {
-		return nil, err
+// mountRequest describes how a device is formatted and mounted
+type mountRequest struct {
+	fsType string
+	// options are the allowed mount options, including ro for read only mounts
+	options       []string
+	readOnly      bool
+	allowReformat bool
+	// label is the filesystem label set when formatting and checked later
+	label string
+	// mkfsArgs are the extra mkfs arguments
+	mkfsArgs []string
+	// fsck is the filesystem check policy
+	fsck string
+	// volumeID and volumeName identify the DigitalOcean volume expected at the device
+	volumeID   string
+	volumeName string
+	// encryption opens encrypted volumes, nil if not encrypted
+	encryption *encryption
+	// block publishes the device instead of mounting a filesystem
+	block bool
+}
+
+// mountRequest returns how the device is formatted, checked and mounted
+// according to the flex options and the plugin defaults, and the mount
+// options rejected for the filesystem
+func (v *VolumePlugin) mountRequest(o *digitalOceanOptions) (*mountRequest, []string, error) {
+	allowReformat, err := o.allowReformat()
+	if err != nil {
+		return nil, nil, err
+	}
+	block, err := o.blockMode()
+	if err != nil {
+		return nil, nil, err
 	}
 
-	r := &flex.DriverStatus{
-		Status: flex.StatusSuccess,
+	r := &mountRequest{
+		fsType:        o.FsType,
+		readOnly:      o.RW == "ro",
+		allowReformat: allowReformat,
+		volumeID:      o.VolumeID,
+		volumeName:    o.VolumeName,
+		block:         block,
+	}
+	if r.fsType == "" {
+		// default to ext4
+		r.fsType = "ext4"
 	}
-	return r, nil
-}
 
-func (v *VolumePlugin) isMounted(targetDir string) (bool, error) {
-	findmntCmd := exec.Command("findmnt", "-n", targetDir)
-	findmntStdout, err := findmntCmd.StdoutPipe()
-	if err != nil {
-		return false, fmt.Errorf("could not get findmount stdout pipe: %s", err.Error())
+	r.label = fsLabel(r.fsType, o.VolumeName)
+	volumeArgs := strings.Fields(o.MkfsOptions)
+	if err := checkMkfsArgs(volumeArgs); err != nil {
+		return nil, nil, flex.NewError(flex.ErrorCodeInvalidOptions, "invalid %s flex option: %s", MkfsOptionsOption, err.Error())
 	}
+	r.mkfsArgs = append(append([]string{}, v.mkfsOptions[r.fsType]...), volumeArgs...)
 
-	if err = findmntCmd.Start(); err != nil {
-		return false, fmt.Errorf("findmnt failed to start: %s", err.Error())
+	r.fsck = v.fsckPolicy
+	if o.Fsck != "" {
+		r.fsck = o.Fsck
+	}
+	if r.fsck == "" {
+		r.fsck = FsckAutoPreen
+	}
+	if err := checkFsckPolicy(r.fsck); err != nil {
+		return nil, nil, flex.NewError(flex.ErrorCodeInvalidOptions, "invalid %s flex option: %s", FsckOption, err.Error())
 	}
 
-	findmntScanner := bufio.NewScanner(findmntStdout)
-	findmntScanner.Split(bufio.ScanWords)
-	findmntScanner.Scan()
-	if findmntScanner.Err() != nil {
-		return false, fmt.Errorf("could not get findmount output: %s", findmntScanner.Err().Error())
+	if r.encryption, err = v.encryption(o); err != nil {
+		return nil, nil, err
+	}
+	if r.block {
+		// no filesystem is mounted
+		return r, nil, nil
 	}
 
-	findmntText := findmntScanner.Text()
-	if err = findmntCmd.Wait(); err != nil {
-		_, isExitError := err.(*exec.ExitError)
-		if !isExitError {
-			return false, fmt.Errorf("findmount command failed: %s", err.Error())
-		}
+	var rejected []string
+	r.options, rejected = filterMountOptions(r.fsType, o.MountOptions, r.readOnly)
+	return r, rejected, nil
+}
+
+// UnmountDevice from the node
+func (v *VolumePlugin) UnmountDevice(device string) (*flex.DriverStatus, error) {
+	if err := v.internalUnmount(device); err != nil {
+		return nil, err
 	}
 
-	return findmntText == targetDir, nil
+	r := &flex.DriverStatus{
+		Status: flex.StatusSuccess,
+	}
+	return r, nil
 }
 
+// currentFormat returns the filesystem at the device, empty if the device is
+// blank or unknownFormat if it holds partitions or other unrecognized data
 func (v *VolumePlugin) currentFormat(device string) (string, error) {
-
-	lsblkCmd := exec.Command("lsblk", "-n", "-o", "FSTYPE", device)
-	lsblkOut, err := lsblkCmd.CombinedOutput()
+	lsblkOut, err := v.exec.CombinedOutput("lsblk", "-n", "-o", "FSTYPE", device)
 	if err != nil {
-		return "", fmt.Errorf("lsblk -n -o FSTYPE %s: output[%s] error[%s]", device, string(lsblkOut), err.Error())
+		return "", flex.NewError(flex.ErrorCodeCommandFailed, "lsblk -n -o FSTYPE %s: output[%s] error[%s]", device, string(lsblkOut), err.Error())
 	}
 
 	output := strings.TrimSuffix(string(lsblkOut), "\n")
@@ -85,76 +150,182 @@ func (v *VolumePlugin) currentFormat(device string) (string, error) {
 		return lines[0], nil
 	}
 
-	if len(lines) == 1 {
-		// The device is unformatted and has no dependent devices
-		return "", nil
+	if len(lines) > 1 {
+		// The device has dependent devices, most probably partitions (LVM, LUKS
+		// and MD RAID are reported as FSTYPE and caught above).
+		return unknownFormat, nil
 	}
 
-	// The device has dependent devices, most probably partitions (LVM, LUKS
-	// and MD RAID are reported as FSTYPE and caught above).
-	return "unknown data, probably partitions", nil
+	// lsblk reads the udev database, which might not be updated yet for a
+	// recently attached device, so probe the device itself before declaring it blank
+	return v.probeFormat(device)
 }
 
-func (v *VolumePlugin) internalMount(targetDir string, device string, fsType string) error {
-	if fsType == "" {
-		// default to ext4
-		fsType = "ext4"
+// probe reads the device signatures with blkid, bypassing its cache,
+// returning nil when no signature is found
+func (v *VolumePlugin) probe(device string) (map[string]string, error) {
+	out, err := v.exec.CombinedOutput("blkid", "-p", "-o", "export", device)
+	if err != nil {
+		// blkid exits with status 2 when no signature is found
+		if code, ok := exitCode(err); ok && code == 2 {
+			return nil, nil
+		}
+		return nil, flex.NewError(flex.ErrorCodeCommandFailed, "blkid -p -o export %s: output[%s] error[%s]", device, string(out), err.Error())
 	}
 
-	var res unix.Stat_t
-	if err := unix.Stat(device, &res); err != nil {
-		return fmt.Errorf("could not stat device %s: %s", device, err.Error())
+	values := map[string]string{}
+	for _, line := range strings.Split(string(out), "\n") {
+		if i := strings.Index(line, "="); i > 0 {
+			values[line[:i]] = line[i+1:]
+		}
 	}
+	return values, nil
+}
 
-	if res.Mode&unix.S_IFMT != unix.S_IFBLK {
-		return fmt.Errorf("device %s is not a block device", device)
+// probeFormat returns the filesystem probed at the device
+func (v *VolumePlugin) probeFormat(device string) (string, error) {
+	values, err := v.probe(device)
+	if err != nil || values == nil {
+		return "", err
+	}
+	if format, ok := values["TYPE"]; ok {
+		return format, nil
 	}
+	// a partition table or some other signature without filesystem
+	return unknownFormat, nil
+}
 
-	mounted, err := v.isMounted(targetDir)
+// internalMount formats, checks and mounts the device unless already
+// mounted, returning the filesystem check message. Stale mounts are detached
+// and mounted again. Encrypted devices are
+// opened first, and closed again if they could not be mounted. Block
+// volumes are published without filesystem.
+func (v *VolumePlugin) internalMount(targetDir string, device string, r *mountRequest) (message string, err error) {
+	if err := v.checkDevice(device); err != nil {
+		return "", err
+	}
+
+	if err := v.verifyDevice(device, r.volumeID, r.volumeName); err != nil {
+		return "", err
+	}
+
+	if r.block {
+		return "", v.mountBlock(targetDir, device, r)
+	}
+
+	mountDevice := device
+	if r.encryption != nil {
+		mountDevice = r.encryption.device()
+	}
+
+	mp, err := v.mounter.MountPoint(targetDir)
 	if err != nil {
-		return err
+		return "", err
+	}
+	if mp != nil {
+		stale := v.checkMount(mp)
+		if stale == nil {
+			if !sameDevice(mp.Device, mountDevice) {
+				return "", flex.NewError(flex.ErrorCodeMountFailed, "dir %s already has %s mounted instead of device %s", targetDir, mp.Device, mountDevice)
+			}
+			return "", nil
+		}
+		// the volume is mounted again once the dead mount is gone
+		if err := v.detachStale(targetDir, mp, stale); err != nil {
+			return "", err
+		}
 	}
-	if mounted {
-		return nil
+
+	if r.encryption != nil {
+		if device, err = v.openEncrypted(device, r); err != nil {
+			return "", err
+		}
+		defer func() {
+			if err == nil {
+				return
+			}
+			if closeErr := v.closeEncrypted(r.encryption.mapping); closeErr != nil {
+				glog.Warningf("could not close encrypted volume after failed mount: %s", closeErr.Error())
+			}
+		}()
 	}
 
-	format, err := v.currentFormat(device)
+	formatted, err := v.format(device, r)
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	if format != fsType {
-		mkfsCmd := exec.Command("mkfs", "-t", fsType, device)
-		if mkfsOut, err := mkfsCmd.CombinedOutput(); err != nil {
-			return fmt.Errorf("mkfs -t %s %s failed with error [%s] and output [%s]", fsType, device, err.Error(), string(mkfsOut))
+	// a new filesystem needs no check
+	fsckMessage := ""
+	if !formatted {
+		if fsckMessage, err = v.fsck(device, r); err != nil {
+			return "", err
 		}
 	}
 
 	if err := os.MkdirAll(targetDir, 0777); err != nil {
-		return fmt.Errorf("could not create directory %s: %s", targetDir, err.Error())
+		return "", flex.NewError(flex.ErrorCodeMountFailed, "could not create directory %s: %s", targetDir, err.Error())
 	}
 
-	mountCmd := exec.Command("mount", device, targetDir)
-	if mountOut, err := mountCmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("mounting device %s at dir %s failed with error [%s] and output [%s] ", device, targetDir, err.Error(), string(mountOut))
+	if r.encryption != nil {
+		if err := recordMapping(targetDir, r.encryption.mapping); err != nil {
+			return "", err
+		}
 	}
-
-	return nil
+	if err := v.mounter.Mount(device, targetDir, r.fsType, r.options); err != nil {
+		if r.encryption != nil {
+			removeMappingRecord(targetDir)
+		}
+		return "", err
+	}
+	return fsckMessage, nil
 }
 
+// internalUnmount unmounts the directory and closes the LUKS mapping of
+// encrypted volumes. When nothing is mounted, the mapping recorded at the
+// directory when mounting is closed if still open, in case a previous
+// unmount could not close it. Stale mounts are detached lazily. Block
+// volumes are unlinked.
 func (v *VolumePlugin) internalUnmount(targetDir string) error {
-	mounted, err := v.isMounted(targetDir)
+	device, err := publishedDevice(targetDir)
 	if err != nil {
 		return err
 	}
-	if !mounted {
-		return nil
+	if device != "" {
+		return v.unmountBlock(targetDir, device)
 	}
 
-	umountCmd := exec.Command("umount", targetDir)
-	if umountOut, err := umountCmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("unmounting the device at %s failed with error [%s] and output [%s]", targetDir, err.Error(), string(umountOut))
+	mp, err := v.mounter.MountPoint(targetDir)
+	if err != nil {
+		return err
 	}
 
+	var mapping string
+	if mp == nil {
+		if mapping = recordedMapping(targetDir); mapping != "" {
+			active, err := v.luksActive(mapping)
+			if err != nil {
+				return err
+			}
+			if !active {
+				mapping = ""
+			}
+		}
+	} else {
+		if stale := v.checkMount(mp); stale != nil {
+			return v.detachStale(targetDir, mp, stale)
+		}
+		mapping = v.luksMapping(mp.Device)
+		if err := v.mounter.Unmount(targetDir); err != nil {
+			return err
+		}
+	}
+
+	if mapping != "" {
+		if err := v.closeEncrypted(mapping); err != nil {
+			return err
+		}
+	}
+	removeMappingRecord(targetDir)
 	return nil
 }
@@ -0,0 +1,247 @@
+package plugin
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/StackPointCloud/digitalocean-flex-volume/pkg/flex"
+)
+
+// exitError is a command exit status
+type exitError int
+
+func (e exitError) Error() string { return fmt.Sprintf("exit status %d", int(e)) }
+func (e exitError) ExitCode() int { return int(e) }
+
+// result is the scripted result of a command
+type result struct {
+	out string
+	err error
+}
+
+// fakeExecutor returns scripted results and records the commands run,
+// unscripted commands succeed without output
+type fakeExecutor struct {
+	results map[string]result
+	// queued are the results of the next runs, before results
+	queued map[string][]result
+	calls  []string
+	// inputs are the standard input of the commands run with input
+	inputs map[string][]byte
+}
+
+func newFakeExecutor() *fakeExecutor {
+	return &fakeExecutor{results: map[string]result{}, queued: map[string][]result{}, inputs: map[string][]byte{}}
+}
+
+// on scripts the result of the command line
+func (f *fakeExecutor) on(command string, out string, err error) {
+	f.results[command] = result{out, err}
+}
+
+// once scripts the result of the next run of the command line only
+func (f *fakeExecutor) once(command string, out string, err error) {
+	f.queued[command] = append(f.queued[command], result{out, err})
+}
+
+func (f *fakeExecutor) run(name string, args ...string) ([]byte, error) {
+	command := strings.Join(append([]string{name}, args...), " ")
+	f.calls = append(f.calls, command)
+	if q := f.queued[command]; len(q) > 0 {
+		f.queued[command] = q[1:]
+		return []byte(q[0].out), q[0].err
+	}
+	r := f.results[command]
+	return []byte(r.out), r.err
+}
+
+func (f *fakeExecutor) Output(name string, args ...string) ([]byte, error) {
+	return f.run(name, args...)
+}
+
+func (f *fakeExecutor) CombinedOutput(name string, args ...string) ([]byte, error) {
+	return f.run(name, args...)
+}
+
+func (f *fakeExecutor) CombinedOutputWithInput(input []byte, name string, args ...string) ([]byte, error) {
+	f.inputs[strings.Join(append([]string{name}, args...), " ")] = input
+	return f.run(name, args...)
+}
+
+// ran returns whether a command starting with prefix was run
+func (f *fakeExecutor) ran(prefix string) bool {
+	for _, c := range f.calls {
+		if strings.HasPrefix(c, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+const findmntCommand = "findmnt -n -r -o TARGET,SOURCE,FSTYPE,OPTIONS --mountpoint "
+
+// newMountPlugin returns a plugin running commands with a fake executor,
+// and a temporary directory for mount points
+func newMountPlugin(t *testing.T) (*VolumePlugin, *fakeExecutor, string) {
+	dir, err := ioutil.TempDir("", "mounter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// mount points of healthy mounts can be stat'ed
+	if err := os.MkdirAll(filepath.Join(dir, "mnt"), 0750); err != nil {
+		t.Fatal(err)
+	}
+	f := newFakeExecutor()
+	f.on(findmntCommand+filepath.Join(dir, "mnt"), "", exitError(1))
+	vp := &VolumePlugin{
+		exec:            f,
+		mounter:         &execMounter{exec: f},
+		sysBlockDevices: filepath.Join(dir, "sys"),
+		checkDevice:     func(string) error { return nil },
+	}
+	return vp, f, dir
+}
+
+func TestMountDeviceFormatPolicy(t *testing.T) {
+	const device = "/dev/disk/by-id/scsi-0DO_Volume_prueba"
+	cases := []struct {
+		name          string
+		fsType        string
+		allowReformat string
+		lsblk         result
+		blkid         result
+		mkfs          string
+		code          string
+	}{
+		{name: "blank device", lsblk: result{out: "\n"}, blkid: result{err: exitError(2)}, mkfs: "mkfs -t ext4 " + device},
+		{name: "blank xfs device", fsType: "xfs", lsblk: result{out: "\n"}, blkid: result{err: exitError(2)}, mkfs: "mkfs -t xfs " + device},
+		{name: "same filesystem", lsblk: result{out: "ext4\n"}},
+		{name: "same filesystem probed", fsType: "xfs", lsblk: result{out: "\n"}, blkid: result{out: "DEVNAME=" + device + "\nTYPE=xfs\n"}},
+		{name: "different filesystem", lsblk: result{out: "xfs\n"}, code: flex.ErrorCodeFormatMismatch},
+		{name: "different filesystem probed", lsblk: result{out: "\n"}, blkid: result{out: "TYPE=xfs\n"}, code: flex.ErrorCodeFormatMismatch},
+		{name: "partitions", lsblk: result{out: "\next4\n"}, code: flex.ErrorCodeFormatMismatch},
+		{name: "partition table probed", lsblk: result{out: "\n"}, blkid: result{out: "PTTYPE=gpt\n"}, code: flex.ErrorCodeFormatMismatch},
+		{name: "reformat disallowed", allowReformat: "false", lsblk: result{out: "xfs\n"}, code: flex.ErrorCodeFormatMismatch},
+		{name: "reformat ext4", allowReformat: "true", lsblk: result{out: "xfs\n"}, mkfs: "mkfs -t ext4 -F " + device},
+		{name: "reformat xfs", fsType: "xfs", allowReformat: "true", lsblk: result{out: "\next4\n"}, mkfs: "mkfs -t xfs -f " + device},
+		{name: "invalid reformat option", allowReformat: "sure", code: flex.ErrorCodeInvalidOptions},
+		{name: "blkid failure", lsblk: result{out: "\n"}, blkid: result{out: "bad device", err: exitError(4)}, code: flex.ErrorCodeCommandFailed},
+		{name: "lsblk failure", lsblk: result{"not a block device", exitError(32)}, code: flex.ErrorCodeCommandFailed},
+	}
+
+	for _, c := range cases {
+		vp, f, dir := newMountPlugin(t)
+		mountdir := filepath.Join(dir, "mnt")
+		f.on("lsblk -n -o FSTYPE "+device, c.lsblk.out, c.lsblk.err)
+		f.on("blkid -p -o export "+device, c.blkid.out, c.blkid.err)
+
+		options := fmt.Sprintf(`{"kubernetes.io/fsType":%q,"volumeID":"id0123456789","allowReformat":%q}`, c.fsType, c.allowReformat)
+		_, err := vp.MountDevice(mountdir, device, options)
+		os.RemoveAll(dir)
+
+		if c.code != "" {
+			if fe, ok := err.(*flex.Error); !ok || fe.Code != c.code {
+				t.Errorf("%s: expected %s error but got %v", c.name, c.code, err)
+			}
+			if f.ran("mkfs") || f.ran("mount") {
+				t.Errorf("%s: expected device not to be formatted or mounted but ran %q", c.name, f.calls)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", c.name, err)
+			continue
+		}
+		if c.mkfs == "" && f.ran("mkfs") {
+			t.Errorf("%s: expected device not to be formatted but ran %q", c.name, f.calls)
+		}
+		if c.mkfs != "" && !f.ran(c.mkfs) {
+			t.Errorf("%s: expected %q but ran %q", c.name, c.mkfs, f.calls)
+		}
+		fsType := c.fsType
+		if fsType == "" {
+			fsType = "ext4"
+		}
+		if !f.ran("mount -t " + fsType + " " + device + " " + mountdir) {
+			t.Errorf("%s: expected device to be mounted but ran %q", c.name, f.calls)
+		}
+	}
+}
+
+func TestMountDeviceOptions(t *testing.T) {
+	const device = "/dev/sda"
+	vp, f, dir := newMountPlugin(t)
+	defer os.RemoveAll(dir)
+	mountdir := filepath.Join(dir, "mnt")
+	f.on("lsblk -n -o FSTYPE "+device, "xfs\n", nil)
+
+	ds, err := vp.MountDevice(mountdir, device, `{"kubernetes.io/fsType":"xfs","kubernetes.io/readwrite":"ro","kubernetes.io/mountOptions":"noatime,nobarrier,nouuid"}`)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !f.ran("mount -t xfs -o noatime,nouuid,ro " + device + " " + mountdir) {
+		t.Errorf("expected read only mount with allowed options but ran %q", f.calls)
+	}
+	if !strings.Contains(ds.Message, "nobarrier") {
+		t.Errorf("expected rejected option at the status message but got %q", ds.Message)
+	}
+
+	// read only mounts never format
+	f.calls = nil
+	f.on("lsblk -n -o FSTYPE "+device, "\n", nil)
+	f.on("blkid -p -o export "+device, "", exitError(2))
+	if _, err := vp.MountDevice(mountdir, device, `{"kubernetes.io/fsType":"ext4","kubernetes.io/readwrite":"ro"}`); err == nil {
+		t.Errorf("expected error mounting a blank device read only")
+	}
+	if f.ran("mkfs") || f.ran("mount") {
+		t.Errorf("expected no format nor mount but ran %q", f.calls)
+	}
+}
+
+func TestMountDeviceAlreadyMounted(t *testing.T) {
+	vp, f, dir := newMountPlugin(t)
+	defer os.RemoveAll(dir)
+	mountdir := filepath.Join(dir, "mnt")
+	f.on(findmntCommand+mountdir, mountdir+" /dev/sda ext4 rw,relatime\n", nil)
+
+	if _, err := vp.MountDevice(mountdir, "/dev/sda", `{"kubernetes.io/fsType":"xfs"}`); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if f.ran("lsblk") || f.ran("mkfs") || f.ran("mount") {
+		t.Errorf("expected mounted device to be left alone but ran %q", f.calls)
+	}
+
+	// another device mounted at the directory is not hidden
+	_, err := vp.MountDevice(mountdir, "/dev/sdb", `{"kubernetes.io/fsType":"ext4"}`)
+	if fe, ok := err.(*flex.Error); !ok || fe.Code != flex.ErrorCodeMountFailed {
+		t.Errorf("expected %s error but got %v", flex.ErrorCodeMountFailed, err)
+	}
+	if f.ran("mount") {
+		t.Errorf("expected no mount over another device but ran %q", f.calls)
+	}
+}
+
+func TestUnmountDevice(t *testing.T) {
+	vp, f, dir := newMountPlugin(t)
+	defer os.RemoveAll(dir)
+	mountdir := filepath.Join(dir, "mnt")
+
+	if _, err := vp.UnmountDevice(mountdir); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if f.ran("umount") {
+		t.Errorf("expected no umount when not mounted but ran %q", f.calls)
+	}
+
+	f.on(findmntCommand+mountdir, mountdir+" /dev/sda ext4 rw,relatime\n", nil)
+	f.on("umount "+mountdir, "target is busy", exitError(32))
+	_, err := vp.UnmountDevice(mountdir)
+	if fe, ok := err.(*flex.Error); !ok || fe.Code != flex.ErrorCodeUnmountFailed {
+		t.Errorf("expected %s error but got %v", flex.ErrorCodeUnmountFailed, err)
+	}
+}
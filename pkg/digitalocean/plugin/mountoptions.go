@@ -0,0 +1,164 @@
+package plugin
+
+import (
+	"strconv"
+	"strings"
+)
+
+// optionValue validates the value of a key=value mount option,
+// nil for options without value
+type optionValue func(value string) bool
+
+// oneOf accepts any of the values
+func oneOf(values ...string) optionValue {
+	return func(value string) bool {
+		for _, v := range values {
+			if value == v {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// number accepts non negative integers
+func number(value string) bool {
+	_, err := strconv.ParseUint(value, 10, 64)
+	return err == nil
+}
+
+// size accepts sizes with an optional k, m or g suffix
+func size(value string) bool {
+	return number(strings.TrimRight(strings.ToLower(value), "kmg"))
+}
+
+// commonMountOptions are accepted for every filesystem
+var commonMountOptions = map[string]optionValue{
+	"defaults":    nil,
+	"ro":          nil,
+	"rw":          nil,
+	"noatime":     nil,
+	"atime":       nil,
+	"relatime":    nil,
+	"norelatime":  nil,
+	"strictatime": nil,
+	"nodiratime":  nil,
+	"diratime":    nil,
+	"lazytime":    nil,
+	"nolazytime":  nil,
+	"nodev":       nil,
+	"dev":         nil,
+	"nosuid":      nil,
+	"suid":        nil,
+	"noexec":      nil,
+	"exec":        nil,
+	"sync":        nil,
+	"async":       nil,
+	"dirsync":     nil,
+}
+
+var extMountOptions = map[string]optionValue{
+	"discard":              nil,
+	"nodiscard":            nil,
+	"barrier":              oneOf("0", "1"),
+	"nobarrier":            nil,
+	"data":                 oneOf("ordered", "writeback", "journal"),
+	"commit":               number,
+	"errors":               oneOf("continue", "remount-ro", "panic"),
+	"user_xattr":           nil,
+	"nouser_xattr":         nil,
+	"acl":                  nil,
+	"noacl":                nil,
+	"delalloc":             nil,
+	"nodelalloc":           nil,
+	"journal_checksum":     nil,
+	"journal_ioprio":       number,
+	"stripe":               number,
+	"max_batch_time":       number,
+	"min_batch_time":       number,
+	"init_itable":          number,
+	"noinit_itable":        nil,
+	"auto_da_alloc":        nil,
+	"noauto_da_alloc":      nil,
+	"block_validity":       nil,
+	"noblock_validity":     nil,
+	"dioread_lock":         nil,
+	"dioread_nolock":       nil,
+	"i_version":            nil,
+	"inode_readahead_blks": number,
+}
+
+// fsMountOptions are the options accepted per filesystem besides the common ones
+var fsMountOptions = map[string]map[string]optionValue{
+	"ext2": {
+		"errors":       oneOf("continue", "remount-ro", "panic"),
+		"user_xattr":   nil,
+		"nouser_xattr": nil,
+		"acl":          nil,
+		"noacl":        nil,
+	},
+	"ext3": extMountOptions,
+	"ext4": extMountOptions,
+	"xfs": {
+		"discard":     nil,
+		"nodiscard":   nil,
+		"allocsize":   size,
+		"logbufs":     number,
+		"logbsize":    size,
+		"inode32":     nil,
+		"inode64":     nil,
+		"largeio":     nil,
+		"nolargeio":   nil,
+		"noquota":     nil,
+		"uquota":      nil,
+		"gquota":      nil,
+		"pquota":      nil,
+		"nouuid":      nil,
+		"wsync":       nil,
+		"filestreams": nil,
+		"swalloc":     nil,
+		"noalign":     nil,
+	},
+}
+
+// validMountOption returns whether the option is allowed for the filesystem
+func validMountOption(fsType, option string) bool {
+	name, value, hasValue := option, "", false
+	if i := strings.Index(option, "="); i >= 0 {
+		name, value, hasValue = option[:i], option[i+1:], true
+	}
+
+	validate, ok := commonMountOptions[name]
+	if !ok {
+		validate, ok = fsMountOptions[fsType][name]
+	}
+	if !ok {
+		return false
+	}
+	if validate == nil {
+		return !hasValue
+	}
+	return hasValue && validate(value)
+}
+
+// filterMountOptions splits the comma separated options into those
+// allowed for the filesystem and those rejected. Read only mounts
+// drop the rw option and add ro.
+func filterMountOptions(fsType, options string, readOnly bool) (accepted, rejected []string) {
+	accepted, rejected = []string{}, []string{}
+	for _, o := range strings.Split(options, ",") {
+		o = strings.TrimSpace(o)
+		switch {
+		case o == "":
+		case readOnly && (o == "rw" || o == "ro"):
+		case validMountOption(fsType, o):
+			accepted = append(accepted, o)
+		default:
+			rejected = append(rejected, o)
+		}
+	}
+	if readOnly {
+		accepted = append(accepted, "ro")
+	}
+	return accepted, rejected
+}
@@ -0,0 +1,31 @@
+package plugin
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFilterMountOptions(t *testing.T) {
+	cases := []struct {
+		fsType   string
+		options  string
+		readOnly bool
+		accepted string
+		rejected string
+	}{
+		{"ext4", "", false, "", ""},
+		{"ext4", "noatime, discard,nobarrier,data=ordered,commit=30", false, "noatime,discard,nobarrier,data=ordered,commit=30", ""},
+		{"ext4", "data=unordered,commit=soon,noload,discard=1,noatime=1", false, "", "data=unordered,commit=soon,noload,discard=1,noatime=1"},
+		{"ext4", "rw,noatime", true, "noatime,ro", ""},
+		{"ext4", "", true, "ro", ""},
+		{"xfs", "discard,nouuid,logbsize=256k,nobarrier,data=ordered", false, "discard,nouuid,logbsize=256k", "nobarrier,data=ordered"},
+		{"btrfs", "noatime,compress=zstd", false, "noatime", "compress=zstd"},
+	}
+	for _, c := range cases {
+		accepted, rejected := filterMountOptions(c.fsType, c.options, c.readOnly)
+		if strings.Join(accepted, ",") != c.accepted || strings.Join(rejected, ",") != c.rejected {
+			t.Errorf("%s %q read only %t: expected %q accepted and %q rejected but got %q and %q",
+				c.fsType, c.options, c.readOnly, c.accepted, c.rejected, accepted, rejected)
+		}
+	}
+}
@@ -3,14 +3,58 @@ package plugin
 import (
 	"encoding/json"
 	"fmt"
+	"strconv"
+	"time"
 
 	"github.com/StackPointCloud/digitalocean-flex-volume/pkg/digitalocean/cloud"
 	"github.com/StackPointCloud/digitalocean-flex-volume/pkg/flex"
 )
 
+const (
+	// DriverName is the flex driver name the plugin is installed as
+	DriverName = "digitalocean/flex-volume"
+	// VolumeIDOption is the flex option holding the DigitalOcean volume ID
+	VolumeIDOption = "volumeID"
+	// VolumeNameOption is the flex option holding the DigitalOcean volume name
+	VolumeNameOption = "volumeName"
+	// AllowReformatOption is the flex option permitting to format devices holding data
+	AllowReformatOption = "allowReformat"
+	// MkfsOptionsOption is the flex option with extra mkfs arguments
+	MkfsOptionsOption = "mkfsOptions"
+	// FsckOption is the flex option overriding the filesystem check policy
+	FsckOption = "fsck"
+	// EncryptedOption is the flex option enabling LUKS encryption
+	EncryptedOption = "encrypted"
+	// VolumeModeOption is the flex option selecting VolumeModeFilesystem or VolumeModeBlock
+	VolumeModeOption = "volumeMode"
+	// SubDirectoryOption is the flex option mounting a directory of the volume at the pods
+	SubDirectoryOption = "subDirectory"
+
+	defaultAttachTimeout = 2 * time.Minute
+	attachPollInterval   = 500 * time.Millisecond
+)
+
 // VolumePlugin is a Digital Ocean flex volume plugin
 type VolumePlugin struct {
-	manager *cloud.DigitalOceanManager
+	manager cloud.Provider
+	exec    executor
+	mounter mounter
+	// mkfsOptions are the extra mkfs arguments per filesystem
+	mkfsOptions map[string][]string
+	// fsckPolicy is the default filesystem check policy
+	fsckPolicy string
+	// attachTimeout is the longest wait for attached devices to appear
+	attachTimeout time.Duration
+	// attachPoll is the interval devices are looked for
+	attachPoll time.Duration
+	// sysBlockDevices is the sysfs directory of block devices
+	sysBlockDevices string
+	// statTimeout is the longest wait for the stat of a mount point
+	statTimeout time.Duration
+	// keyDir holds the LUKS keys of encrypted volumes
+	keyDir string
+	// checkDevice fails unless the device is a block device
+	checkDevice func(device string) error
 }
 
 // digitalOceanOptions from the flex plugin
@@ -19,15 +63,96 @@ type digitalOceanOptions struct {
 	FsType         string `json:"kubernetes.io/fsType"`
 	PVorVolumeName string `json:"kubernetes.io/pvOrVolumeName"`
 	RW             string `json:"kubernetes.io/readwrite"`
+	MountOptions   string `json:"kubernetes.io/mountOptions,omitempty"`
 	VolumeName     string `json:"volumeName,omitempty"`
 	VolumeID       string `json:"volumeID,omitempty"`
+	// AllowReformat permits formatting devices holding another filesystem or partitions
+	AllowReformat string `json:"allowReformat,omitempty"`
+	// MkfsOptions are extra space separated mkfs arguments
+	MkfsOptions string `json:"mkfsOptions,omitempty"`
+	// Fsck is the filesystem check policy
+	Fsck string `json:"fsck,omitempty"`
+	// VolumeMode is VolumeModeFilesystem or VolumeModeBlock
+	VolumeMode string `json:"volumeMode,omitempty"`
+	// SubDirectory is the directory of the volume mounted at the pods
+	SubDirectory string `json:"subDirectory,omitempty"`
+	// Encrypted enables LUKS encryption
+	Encrypted string `json:"encrypted,omitempty"`
 }
 
-// NewDigitalOceanVolumePlugin creates a Digital Ocean flex plugin
-func NewDigitalOceanVolumePlugin(m *cloud.DigitalOceanManager) flex.VolumePlugin {
-	return &VolumePlugin{
-		manager: m,
+// Options configures how the plugin handles volumes at the node
+type Options struct {
+	// Mounter is MounterNative or MounterExec
+	Mounter string
+	// MkfsOptions are extra mkfs arguments per filesystem type,
+	// followed by those of the volume flex options
+	MkfsOptions map[string][]string
+	// Fsck is the filesystem check policy, FsckNever, FsckAutoPreen or
+	// FsckFailOnError, which volumes can override with their flex options
+	Fsck string
+	// AttachTimeout is the longest time waited for the device of an
+	// attached volume to appear at the node
+	AttachTimeout time.Duration
+	// KeyDir holds the LUKS key files of encrypted volumes, named after
+	// the volume ID or name
+	KeyDir string
+}
+
+// DefaultOptions returns the default plugin options
+func DefaultOptions() Options {
+	return Options{
+		Mounter:       MounterNative,
+		Fsck:          FsckAutoPreen,
+		AttachTimeout: defaultAttachTimeout,
+	}
+}
+
+// NewDigitalOceanVolumePlugin creates a Digital Ocean flex plugin,
+// nil options use the defaults
+func NewDigitalOceanVolumePlugin(m cloud.Provider, options *Options) (flex.VolumePlugin, error) {
+	if options == nil {
+		o := DefaultOptions()
+		options = &o
+	}
+
+	exec := osExecutor{}
+	mounter, err := newMounter(options.Mounter, exec)
+	if err != nil {
+		return nil, err
+	}
+
+	fsck := options.Fsck
+	if fsck == "" {
+		fsck = FsckAutoPreen
+	}
+	if err := checkFsckPolicy(fsck); err != nil {
+		return nil, err
+	}
+
+	attachTimeout := options.AttachTimeout
+	if attachTimeout <= 0 {
+		attachTimeout = defaultAttachTimeout
+	}
+
+	for fsType, args := range options.MkfsOptions {
+		if err := checkMkfsArgs(args); err != nil {
+			return nil, fmt.Errorf("invalid %s mkfs options: %s", fsType, err.Error())
+		}
 	}
+
+	return &VolumePlugin{
+		manager:         m,
+		exec:            exec,
+		mounter:         mounter,
+		mkfsOptions:     options.MkfsOptions,
+		fsckPolicy:      fsck,
+		attachTimeout:   attachTimeout,
+		attachPoll:      attachPollInterval,
+		sysBlockDevices: sysBlockDevicesDir,
+		statTimeout:     defaultStatTimeout,
+		keyDir:          options.KeyDir,
+		checkDevice:     checkBlockDevice,
+	}, nil
 }
 
 // Init driver
@@ -36,8 +161,9 @@ func (v *VolumePlugin) Init() (*flex.DriverStatus, error) {
 		Status:  flex.StatusSuccess,
 		Message: "DigitalOcean flex driver initialized",
 		Capabilities: &flex.DriverCapabilities{
-			Attach:         true,
-			SELinuxRelabel: true,
+			Attach:           true,
+			SELinuxRelabel:   true,
+			RequiresFSResize: true,
 		},
 	}, nil
 }
@@ -45,43 +171,58 @@ func (v *VolumePlugin) Init() (*flex.DriverStatus, error) {
 func (v *VolumePlugin) newOptions(options string) (*digitalOceanOptions, error) {
 	opts := &digitalOceanOptions{}
 	if err := json.Unmarshal([]byte(options), opts); err != nil {
-		return nil, err
+		return nil, flex.NewError(flex.ErrorCodeInvalidOptions, "could not parse flex options: %s", err.Error())
 	}
 	return opts, nil
 }
 
-// GetVolumeName Retrieves a unique volume name
-func (v *VolumePlugin) GetVolumeName(options string) (*flex.DriverStatus, error) {
-	opt, err := v.newOptions(options)
-	if err != nil {
-		return nil, err
+// allowReformat returns whether the options permit destroying existing data when formatting
+func (o *digitalOceanOptions) allowReformat() (bool, error) {
+	if o.AllowReformat == "" {
+		return false, nil
 	}
+	return parseBool(AllowReformatOption, o.AllowReformat)
+}
 
-	if opt.VolumeID == "" {
-		return nil, fmt.Errorf("DigitalOcean volume needs VolumeID property at flex options")
+// uniqueName returns the DigitalOcean volume ID, or the volume name if not set
+func (o *digitalOceanOptions) uniqueName() (string, error) {
+	name := o.VolumeID
+	if name == "" {
+		name = o.VolumeName
 	}
-
-	r := &flex.DriverStatus{
-		Status:     flex.StatusSuccess,
-		VolumeName: opt.VolumeID,
+	if name == "" {
+		return "", flex.NewError(flex.ErrorCodeInvalidOptions, "DigitalOcean volume needs volumeID or volumeName property at flex options")
 	}
-	return r, nil
+	return name, nil
 }
 
-// Mount volume at the dir where pods will use it
-func (v *VolumePlugin) Mount(mountdir string, options string) (*flex.DriverStatus, error) {
-	r := &flex.DriverStatus{
-		Status:  flex.StatusNotSupported,
-		Message: "mount",
+// parseBool parses a boolean flex option
+func parseBool(option, value string) (bool, error) {
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, flex.NewError(flex.ErrorCodeInvalidOptions, "invalid %s flex option %q, expected true or false", option, value)
 	}
-	return r, nil
+	return b, nil
 }
 
-// Unmount the volume at mount directory
-func (v *VolumePlugin) Unmount(mountdir string) (*flex.DriverStatus, error) {
+// GetVolumeName retrieves a unique volume name.
+// The DigitalOcean volume ID is preferred since it never changes during the
+// volume lifetime, falling back to the volume name, which is unique per region.
+// The PV name is never used so that renaming a PV does not change the result.
+func (v *VolumePlugin) GetVolumeName(options string) (*flex.DriverStatus, error) {
+	opt, err := v.newOptions(options)
+	if err != nil {
+		return nil, err
+	}
+
+	name, err := opt.uniqueName()
+	if err != nil {
+		return nil, err
+	}
+
 	r := &flex.DriverStatus{
-		Status:  flex.StatusNotSupported,
-		Message: "unmount",
+		Status:     flex.StatusSuccess,
+		VolumeName: name,
 	}
 	return r, nil
 }
@@ -1,10 +1,16 @@
 package plugin
 
 import (
+	"github.com/StackPointCloud/digitalocean-flex-volume/pkg/digitalocean/cloud"
+	"github.com/StackPointCloud/digitalocean-flex-volume/pkg/digitalocean/cloud/fake"
 	"github.com/StackPointCloud/digitalocean-flex-volume/pkg/flex"
 
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
+	"time"
 )
 
 func TestGetVolumeName(t *testing.T) {
@@ -19,10 +25,26 @@ func TestGetVolumeName(t *testing.T) {
 			true,
 		},
 		{
-			`{"kubernetes.io/fsType":"ext4","kubernetes.io/pvOrVolumeName":"prueba","kubernetes.io/readwrite":"rw","volumeID":"","volumeName":"prueba"}`,
+			`{"kubernetes.io/fsType":"ext4","kubernetes.io/pvOrVolumeName":"prueba","kubernetes.io/readwrite":"rw","volumeID":"","volumeName":""}`,
 			nil,
 			true,
 		},
+		{
+			`{"kubernetes.io/fsType":"ext4","kubernetes.io/pvOrVolumeName":"prueba","kubernetes.io/readwrite":"rw","volumeID":"","volumeName":"volume-nyc1-01"}`,
+			&flex.DriverStatus{
+				Status:     flex.StatusSuccess,
+				VolumeName: "volume-nyc1-01",
+			},
+			false,
+		},
+		{
+			`{"kubernetes.io/fsType":"ext4","kubernetes.io/pvOrVolumeName":"renamed","kubernetes.io/readwrite":"rw","volumeID":"id0123456789","volumeName":"volume-nyc1-01"}`,
+			&flex.DriverStatus{
+				Status:     flex.StatusSuccess,
+				VolumeName: "id0123456789",
+			},
+			false,
+		},
 		{
 			`{"kubernetes.io/fsType":"ext4","kubernetes.io/pvOrVolumeName":"prueba","kubernetes.io/readwrite":"rw","volumeID":"id0123456789","volumeName":"prueba"}`,
 			&flex.DriverStatus{
@@ -58,3 +80,218 @@ func TestGetVolumeName(t *testing.T) {
 		}
 	}
 }
+
+func TestSizeGigabytes(t *testing.T) {
+	cases := []struct {
+		size     int64
+		expected int
+	}{
+		{0, 0},
+		{1, 1},
+		{1024 * 1024 * 1024, 1},
+		{1024*1024*1024 + 1, 2},
+		{10 * 1024 * 1024 * 1024, 10},
+	}
+
+	for _, c := range cases {
+		if s := sizeGigabytes(c.size); s != c.expected {
+			t.Errorf("size %d expected %d gigabytes but got %d", c.size, c.expected, s)
+		}
+	}
+}
+
+func newFakePlugin() (*VolumePlugin, *fake.Provider) {
+	p := fake.NewProvider("nyc1")
+	p.AddDroplet(1, "node-1", "10.0.0.1", "192.0.2.1")
+	p.AddDroplet(2, "node-2", "10.0.0.2", "192.0.2.2")
+	p.AddVolume("id0123456789", "prueba", 10)
+	return &VolumePlugin{manager: p}, p
+}
+
+func isAttached(t *testing.T, vp *VolumePlugin, options, node string) bool {
+	ds, err := vp.IsAttached(options, node)
+	if err != nil {
+		t.Fatalf("unexpected error checking attachment at node %q: %s", node, err)
+	}
+	return ds.Attached
+}
+
+func TestAttachLifecycle(t *testing.T) {
+	vp, p := newFakePlugin()
+	options := `{"kubernetes.io/fsType":"ext4","kubernetes.io/pvOrVolumeName":"prueba","kubernetes.io/readwrite":"rw","volumeID":"id0123456789","volumeName":"prueba"}`
+
+	if isAttached(t, vp, options, "node-1") {
+		t.Fatalf("volume should not be attached before attach")
+	}
+
+	ds, err := vp.Attach(options, "node-1")
+	if err != nil {
+		t.Fatalf("unexpected error attaching volume: %s", err)
+	}
+	if ds.DevicePath != cloud.DevicePrefix+"prueba" {
+		t.Errorf("expected device path %q but got %q", cloud.DevicePrefix+"prueba", ds.DevicePath)
+	}
+	if !isAttached(t, vp, options, "node-1") {
+		t.Errorf("volume should be attached to node-1")
+	}
+	if isAttached(t, vp, options, "node-2") {
+		t.Errorf("volume should not be attached to node-2")
+	}
+
+	// attaching again is a no-op, also when using the droplet IP as node name
+	if _, err = vp.Attach(options, "10.0.0.1"); err != nil {
+		t.Fatalf("unexpected error attaching an attached volume: %s", err)
+	}
+	if calls := p.Calls(fake.MethodAttachVolumeAndWait); calls != 1 {
+		t.Errorf("expected 1 attach call but got %d", calls)
+	}
+
+	// attaching to a second node fails while attached to the first one
+	if _, err = vp.Attach(options, "node-2"); err == nil {
+		t.Errorf("expected error attaching volume to a second droplet")
+	}
+
+	// detach receives the unique volume name
+	name, err := vp.GetVolumeName(options)
+	if err != nil {
+		t.Fatalf("unexpected error getting volume name: %s", err)
+	}
+	if _, err = vp.Detach(name.VolumeName, "node-1"); err != nil {
+		t.Fatalf("unexpected error detaching volume: %s", err)
+	}
+	if isAttached(t, vp, options, "node-1") {
+		t.Errorf("volume should not be attached after detach")
+	}
+
+	// detaching again, by volume name, is a no-op
+	if _, err = vp.Detach("prueba", "node-1"); err != nil {
+		t.Fatalf("unexpected error detaching a detached volume: %s", err)
+	}
+	if calls := p.Calls(fake.MethodDetachVolumeAndWait); calls != 1 {
+		t.Errorf("expected 1 detach call but got %d", calls)
+	}
+}
+
+func TestAttachByName(t *testing.T) {
+	vp, p := newFakePlugin()
+	options := `{"volumeName":"prueba"}`
+
+	if _, err := vp.Attach(options, "node-1"); err != nil {
+		t.Fatalf("unexpected error attaching volume by name: %s", err)
+	}
+	if !isAttached(t, vp, options, "node-1") {
+		t.Errorf("volume should be attached to node-1")
+	}
+	if _, err := vp.Attach(options, "node-1"); err != nil {
+		t.Fatalf("unexpected error attaching an attached volume: %s", err)
+	}
+	if calls := p.Calls(fake.MethodAttachVolumeAndWait); calls != 1 {
+		t.Errorf("expected 1 attach call but got %d", calls)
+	}
+
+	for _, attach := range []func(string, string) error{
+		func(o, n string) error { _, err := vp.Attach(o, n); return err },
+		func(o, n string) error { _, err := vp.IsAttached(o, n); return err },
+	} {
+		err := attach(`{"kubernetes.io/fsType":"ext4"}`, "node-1")
+		if fe, ok := err.(*flex.Error); !ok || fe.Code != flex.ErrorCodeInvalidOptions {
+			t.Errorf("expected invalid options error without volume ID or name but got %v", err)
+		}
+	}
+}
+
+func TestAttachFailures(t *testing.T) {
+	options := `{"volumeID":"id0123456789"}`
+
+	vp, _ := newFakePlugin()
+	if _, err := vp.Attach(options, "unknown-node"); err == nil {
+		t.Errorf("expected error attaching volume to an unknown node")
+	}
+
+	if _, err := vp.Attach(`{"volumeID":"unknown"}`, "node-1"); err == nil {
+		t.Errorf("expected error attaching an unknown volume")
+	}
+
+	vp, p := newFakePlugin()
+	p.FailNext(fake.MethodAttachVolumeAndWait, flex.NewRetryableError(flex.ErrorCodeRateLimited, "too many requests"))
+	_, err := vp.Attach(options, "node-1")
+	if fe, ok := err.(*flex.Error); !ok || fe.Code != flex.ErrorCodeRateLimited || !fe.Retryable {
+		t.Errorf("expected retryable rate limit error but got %v", err)
+	}
+	if _, err = vp.Attach(options, "node-1"); err != nil {
+		t.Errorf("unexpected error retrying attach: %s", err)
+	}
+
+	// actions slower than the timeout fail but are still applied
+	vp, p = newFakePlugin()
+	p.ActionLatency = 50 * time.Millisecond
+	p.Timeout = time.Millisecond
+	_, err = vp.Attach(options, "node-1")
+	if fe, ok := err.(*flex.Error); !ok || fe.Code != flex.ErrorCodeTimeout {
+		t.Errorf("expected timeout error for slow actions but got %v", err)
+	}
+	if !isAttached(t, vp, options, "node-1") {
+		t.Errorf("volume should be attached after the action timed out")
+	}
+}
+
+func TestWaitForAttach(t *testing.T) {
+	dir, err := ioutil.TempDir("", "byid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	f := newFakeExecutor()
+	vp := &VolumePlugin{
+		exec:          f,
+		checkDevice:   func(string) error { return nil },
+		attachTimeout: 5 * time.Second,
+		attachPoll:    10 * time.Millisecond,
+	}
+
+	device := filepath.Join(dir, "sda")
+	if err := ioutil.WriteFile(device, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(dir, "scsi-0DO_Volume_prueba")
+
+	// the link appears after the attach action completes
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		os.Symlink(device, link)
+	}()
+
+	ds, err := vp.WaitForAttach(link, "{}")
+	if err != nil {
+		t.Fatalf("unexpected error waiting for device: %s", err)
+	}
+	if resolved, _ := filepath.EvalSymlinks(device); ds.DevicePath != resolved {
+		t.Errorf("expected resolved device %q but got %q", resolved, ds.DevicePath)
+	}
+	if !f.ran("udevadm settle") {
+		t.Errorf("expected udev to settle but ran %q", f.calls)
+	}
+
+	vp.attachTimeout = 50 * time.Millisecond
+	_, err = vp.WaitForAttach(filepath.Join(dir, "scsi-0DO_Volume_missing"), "{}")
+	if fe, ok := err.(*flex.Error); !ok || fe.Code != flex.ErrorCodeTimeout || !fe.Retryable {
+		t.Errorf("expected retryable timeout error but got %v", err)
+	}
+}
+
+func TestWaitForAttachDevicePath(t *testing.T) {
+	vp, _ := newFakePlugin()
+
+	opt := &digitalOceanOptions{VolumeID: "id0123456789"}
+	if device, err := vp.devicePath(opt); err != nil || device != cloud.DevicePrefix+"prueba" {
+		t.Errorf("expected device path from the volume but got %q, %v", device, err)
+	}
+	opt = &digitalOceanOptions{VolumeName: "other"}
+	if device, err := vp.devicePath(opt); err != nil || device != cloud.DevicePrefix+"other" {
+		t.Errorf("expected device path from the volume name but got %q, %v", device, err)
+	}
+	if _, err := vp.devicePath(&digitalOceanOptions{}); err == nil {
+		t.Errorf("expected error without volume")
+	}
+}
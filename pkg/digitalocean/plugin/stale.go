@@ -0,0 +1,69 @@
+package plugin
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/StackPointCloud/digitalocean-flex-volume/pkg/flex"
+	"github.com/golang/glog"
+)
+
+// defaultStatTimeout is the longest wait for the stat of a mount point,
+// which hangs when the mount is dead
+const defaultStatTimeout = 10 * time.Second
+
+// statTimeout stats the path, failing if it does not return within the
+// timeout. The stat of a hung mount never returns, and its goroutine is leaked.
+func statTimeout(path string, timeout time.Duration) error {
+	done := make(chan error, 1)
+	go func() {
+		_, err := os.Stat(path)
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(timeout):
+		return fmt.Errorf("stat %s did not return after %s", path, timeout)
+	}
+}
+
+// checkMount returns why the mount is stale, nil if it is healthy: its
+// mount point can not be stat'ed, such as a mount giving EIO or ENOTCONN
+// once its volume is detached, or its backing device is gone
+func (v *VolumePlugin) checkMount(mp *mountPoint) error {
+	timeout := v.statTimeout
+	if timeout <= 0 {
+		timeout = defaultStatTimeout
+	}
+	if err := statTimeout(mp.Dir, timeout); err != nil {
+		return err
+	}
+
+	if strings.HasPrefix(mp.Device, "/dev/") {
+		if err := v.checkDevice(mp.Device); err != nil {
+			return fmt.Errorf("backing device %s is gone: %s", mp.Device, err.Error())
+		}
+	}
+	return nil
+}
+
+// detachStale lazily unmounts the stale mount at dir, closing its LUKS
+// mapping if encrypted, so that the volume can be mounted again
+func (v *VolumePlugin) detachStale(dir string, mp *mountPoint, cause error) error {
+	glog.Warningf("detaching stale mount of %s at %s: %s", mp.Device, dir, cause.Error())
+
+	mapping := v.luksMapping(mp.Device)
+	if err := v.mounter.LazyUnmount(dir); err != nil {
+		return flex.NewError(flex.ErrorCodeStaleMount, "stale mount of %s at %s (%s) could not be detached: %s", mp.Device, dir, cause.Error(), err.Error())
+	}
+	if mapping != "" {
+		if err := v.closeEncrypted(mapping); err != nil {
+			return flex.NewError(flex.ErrorCodeStaleMount, "stale mount of %s at %s was detached but its encrypted volume could not be closed: %s", mp.Device, dir, err.Error())
+		}
+	}
+	return nil
+}
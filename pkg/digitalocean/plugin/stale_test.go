@@ -0,0 +1,82 @@
+package plugin
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/StackPointCloud/digitalocean-flex-volume/pkg/flex"
+)
+
+func TestCheckMount(t *testing.T) {
+	vp, _, dir := newMountPlugin(t)
+	defer os.RemoveAll(dir)
+	vp.statTimeout = time.Second
+	vp.checkDevice = func(device string) error {
+		if device == "/dev/sdb" {
+			return errors.New("no such file or directory")
+		}
+		return nil
+	}
+
+	if err := vp.checkMount(&mountPoint{Dir: filepath.Join(dir, "mnt"), Device: "/dev/sda"}); err != nil {
+		t.Errorf("expected healthy mount but got %v", err)
+	}
+	if err := vp.checkMount(&mountPoint{Dir: filepath.Join(dir, "gone"), Device: "/dev/sda"}); err == nil {
+		t.Errorf("expected error for mount point that can not be stat'ed")
+	}
+	if err := vp.checkMount(&mountPoint{Dir: filepath.Join(dir, "mnt"), Device: "/dev/sdb"}); err == nil {
+		t.Errorf("expected error for mount without backing device")
+	}
+	if err := vp.checkMount(&mountPoint{Dir: filepath.Join(dir, "mnt"), Device: "tmpfs"}); err != nil {
+		t.Errorf("expected mount without device to be healthy but got %v", err)
+	}
+}
+
+func TestMountDeviceStale(t *testing.T) {
+	vp, f, dir := newMountPlugin(t)
+	defer os.RemoveAll(dir)
+	mountdir := filepath.Join(dir, "mnt")
+	// the volume was attached again as /dev/sdb while mounted as /dev/sda
+	vp.checkDevice = func(device string) error {
+		if device == "/dev/sda" {
+			return errors.New("no such file or directory")
+		}
+		return nil
+	}
+	f.on(findmntCommand+mountdir, mountdir+" /dev/sda ext4 rw,relatime\n", nil)
+	f.on("lsblk -n -o FSTYPE /dev/sdb", "ext4\n", nil)
+
+	if _, err := vp.MountDevice(mountdir, "/dev/sdb", `{"kubernetes.io/fsType":"ext4"}`); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	for _, command := range []string{"umount -l " + mountdir, "e2fsck -p /dev/sdb", "mount -t ext4 /dev/sdb " + mountdir} {
+		if !f.ran(command) {
+			t.Errorf("expected %q but ran %q", command, f.calls)
+		}
+	}
+
+	// stale mounts that can not be detached fail
+	f.on("umount -l "+mountdir, "", exitError(32))
+	_, err := vp.MountDevice(mountdir, "/dev/sdb", `{"kubernetes.io/fsType":"ext4"}`)
+	if fe, ok := err.(*flex.Error); !ok || fe.Code != flex.ErrorCodeStaleMount {
+		t.Errorf("expected %s error but got %v", flex.ErrorCodeStaleMount, err)
+	}
+}
+
+func TestUnmountDeviceStale(t *testing.T) {
+	vp, f, dir := newMountPlugin(t)
+	defer os.RemoveAll(dir)
+	mountdir := filepath.Join(dir, "stale")
+	f.on(findmntCommand+mountdir, mountdir+" /dev/sda ext4 rw,relatime\n", nil)
+
+	// the mount point gives an error such as ENOTCONN
+	if _, err := vp.UnmountDevice(mountdir); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !f.ran("umount -l "+mountdir) || f.ran("umount "+mountdir) {
+		t.Errorf("expected lazy unmount but ran %q", f.calls)
+	}
+}
@@ -0,0 +1,210 @@
+package plugin
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/StackPointCloud/digitalocean-flex-volume/pkg/digitalocean/cloud"
+)
+
+// sectorSize is the unit of the sector counters of /sys/block/<dev>/stat,
+// whatever the device sector size
+const sectorSize = 512
+
+// VolumeStats are the usage and I/O statistics of a volume mounted at the node
+type VolumeStats struct {
+	MountDir string `json:"mountDir"`
+	// Device is the device node backing the mount
+	Device string `json:"device"`
+	// VolumeName is the DigitalOcean volume name, empty if the device is not a DigitalOcean volume
+	VolumeName string `json:"volumeName,omitempty"`
+	// Filesystem is nil for raw block volumes
+	Filesystem *FilesystemStats `json:"filesystem,omitempty"`
+	// IO is nil if the device has no I/O counters
+	IO *IOStats `json:"io,omitempty"`
+}
+
+// FilesystemStats are the space and inodes of a filesystem
+type FilesystemStats struct {
+	CapacityBytes  uint64 `json:"capacityBytes"`
+	UsedBytes      uint64 `json:"usedBytes"`
+	AvailableBytes uint64 `json:"availableBytes"`
+	Inodes         uint64 `json:"inodes"`
+	InodesUsed     uint64 `json:"inodesUsed"`
+	InodesFree     uint64 `json:"inodesFree"`
+}
+
+// IOStats are the I/O counters of a block device since it appeared,
+// see the kernel Documentation/block/stat
+type IOStats struct {
+	ReadsCompleted   uint64 `json:"readsCompleted"`
+	ReadsMerged      uint64 `json:"readsMerged"`
+	ReadBytes        uint64 `json:"readBytes"`
+	ReadTimeMs       uint64 `json:"readTimeMs"`
+	WritesCompleted  uint64 `json:"writesCompleted"`
+	WritesMerged     uint64 `json:"writesMerged"`
+	WrittenBytes     uint64 `json:"writtenBytes"`
+	WriteTimeMs      uint64 `json:"writeTimeMs"`
+	InFlight         uint64 `json:"inFlight"`
+	IOTimeMs         uint64 `json:"ioTimeMs"`
+	WeightedIOTimeMs uint64 `json:"weightedIOTimeMs"`
+}
+
+// statsReader reads the statistics of the volumes mounted at the node
+type statsReader struct {
+	mounter mounter
+	// sysBlockDevices is the sysfs directory of block devices
+	sysBlockDevices string
+	// sysDevBlock links block device numbers to their sysfs directory
+	sysDevBlock string
+	// devicePrefix starts the links to the DigitalOcean volume devices
+	devicePrefix      string
+	statfs            func(dir string) (*FilesystemStats, error)
+	blockDeviceNumber func(path string) (uint32, uint32, bool)
+}
+
+// ReadVolumeStats returns the usage and I/O statistics of the volume
+// mounted or published as a raw block volume at mountdir. Only the
+// mounter of the options is used, nil options use the defaults.
+func ReadVolumeStats(mountdir string, options *Options) (*VolumeStats, error) {
+	if options == nil {
+		o := DefaultOptions()
+		options = &o
+	}
+	m, err := newMounter(options.Mounter, osExecutor{})
+	if err != nil {
+		return nil, err
+	}
+
+	r := &statsReader{
+		mounter:           m,
+		sysBlockDevices:   sysBlockDevicesDir,
+		sysDevBlock:       sysBlockDir,
+		devicePrefix:      cloud.DevicePrefix,
+		statfs:            statfs,
+		blockDeviceNumber: blockDeviceNumber,
+	}
+	return r.read(mountdir)
+}
+
+func (r *statsReader) read(mountdir string) (*VolumeStats, error) {
+	stats := &VolumeStats{MountDir: mountdir}
+
+	device, err := publishedDevice(mountdir)
+	if err != nil {
+		return nil, err
+	}
+	if device == "" {
+		// block volumes at the pods are device nodes bind mounted onto a file
+		if major, minor, ok := r.blockDeviceNumber(mountdir); ok {
+			link, err := os.Readlink(filepath.Join(r.sysDevBlock, fmt.Sprintf("%d:%d", major, minor)))
+			if err != nil {
+				return nil, fmt.Errorf("could not find block device %d:%d published at %s: %s", major, minor, mountdir, err.Error())
+			}
+			device = filepath.Join("/dev", filepath.Base(link))
+		}
+	}
+	if device == "" {
+		mp, err := r.mounter.MountPoint(mountdir)
+		if err != nil {
+			return nil, err
+		}
+		if mp == nil {
+			return nil, fmt.Errorf("no volume is mounted at %s", mountdir)
+		}
+		// statfs hangs on dead mounts
+		if err := statTimeout(mp.Dir, defaultStatTimeout); err != nil {
+			return nil, fmt.Errorf("mount at %s is stale: %s", mountdir, err.Error())
+		}
+		if stats.Filesystem, err = r.statfs(mp.Dir); err != nil {
+			return nil, fmt.Errorf("could not read filesystem statistics of %s: %s", mountdir, err.Error())
+		}
+		device = mp.Device
+	}
+
+	stats.Device = resolvePath(device)
+	name := filepath.Base(stats.Device)
+	stats.VolumeName = r.volumeName(name)
+	if stats.IO, err = r.ioStats(name); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// volumeName returns the DigitalOcean volume whose link resolves to the
+// device, or to the device below it, such as the one of a LUKS mapping
+func (r *statsReader) volumeName(name string) string {
+	links, err := filepath.Glob(r.devicePrefix + "*")
+	if err != nil {
+		return ""
+	}
+
+	names := []string{name}
+	if slaves, err := ioutil.ReadDir(filepath.Join(r.sysBlockDevices, name, "slaves")); err == nil {
+		for _, s := range slaves {
+			names = append(names, s.Name())
+		}
+	}
+	for _, link := range links {
+		target := filepath.Base(resolvePath(link))
+		for _, n := range names {
+			if target == n {
+				return strings.TrimPrefix(link, r.devicePrefix)
+			}
+		}
+	}
+	return ""
+}
+
+// ioStats reads the I/O counters of the device from sysfs, nil if
+// the device has none, such as partitions or devices without sysfs
+func (r *statsReader) ioStats(name string) (*IOStats, error) {
+	file := filepath.Join(r.sysBlockDevices, name, "stat")
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("could not read I/O statistics of device %s: %s", name, err.Error())
+	}
+	stats, err := parseIOStats(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("invalid I/O statistics at %s: %s", file, err.Error())
+	}
+	return stats, nil
+}
+
+// parseIOStats parses the first 11 fields of /sys/block/<dev>/stat,
+// newer kernels append discard and flush counters
+func parseIOStats(data string) (*IOStats, error) {
+	fields := strings.Fields(data)
+	if len(fields) < 11 {
+		return nil, fmt.Errorf("expected at least 11 fields but got %d", len(fields))
+	}
+	values := make([]uint64, 11)
+	for i := range values {
+		v, err := strconv.ParseUint(fields[i], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid field %q", fields[i])
+		}
+		values[i] = v
+	}
+
+	return &IOStats{
+		ReadsCompleted:   values[0],
+		ReadsMerged:      values[1],
+		ReadBytes:        values[2] * sectorSize,
+		ReadTimeMs:       values[3],
+		WritesCompleted:  values[4],
+		WritesMerged:     values[5],
+		WrittenBytes:     values[6] * sectorSize,
+		WriteTimeMs:      values[7],
+		InFlight:         values[8],
+		IOTimeMs:         values[9],
+		WeightedIOTimeMs: values[10],
+	}, nil
+}
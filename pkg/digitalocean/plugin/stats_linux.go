@@ -0,0 +1,40 @@
+//go:build linux
+// +build linux
+
+package plugin
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// statfs reads the space and inodes of the filesystem mounted at dir,
+// counting as used the blocks reserved for root as df does
+func statfs(dir string) (*FilesystemStats, error) {
+	var s unix.Statfs_t
+	if err := unix.Statfs(dir, &s); err != nil {
+		return nil, err
+	}
+
+	size := uint64(s.Frsize)
+	if size == 0 {
+		size = uint64(s.Bsize)
+	}
+	return &FilesystemStats{
+		CapacityBytes:  s.Blocks * size,
+		UsedBytes:      (s.Blocks - s.Bfree) * size,
+		AvailableBytes: s.Bavail * size,
+		Inodes:         s.Files,
+		InodesUsed:     s.Files - s.Ffree,
+		InodesFree:     s.Ffree,
+	}, nil
+}
+
+// blockDeviceNumber returns the device number of the block device node at
+// path, following bind mounts of device nodes onto files
+func blockDeviceNumber(path string) (uint32, uint32, bool) {
+	var s unix.Stat_t
+	if err := unix.Stat(path, &s); err != nil || s.Mode&unix.S_IFMT != unix.S_IFBLK {
+		return 0, 0, false
+	}
+	return unix.Major(uint64(s.Rdev)), unix.Minor(uint64(s.Rdev)), true
+}
@@ -0,0 +1,111 @@
+package plugin
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const diskStat = "    2510      118   183414     1253    91265    52018  4561704   180271        0   112940   181524        0        0        0        0\n"
+
+func TestParseIOStats(t *testing.T) {
+	s, err := parseIOStats(diskStat)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expected := IOStats{
+		ReadsCompleted:   2510,
+		ReadsMerged:      118,
+		ReadBytes:        183414 * 512,
+		ReadTimeMs:       1253,
+		WritesCompleted:  91265,
+		WritesMerged:     52018,
+		WrittenBytes:     4561704 * 512,
+		WriteTimeMs:      180271,
+		IOTimeMs:         112940,
+		WeightedIOTimeMs: 181524,
+	}
+	if *s != expected {
+		t.Errorf("expected %+v but got %+v", expected, *s)
+	}
+
+	for _, data := range []string{"", "1 2 3", "1 2 3 4 5 6 7 8 9 10 x"} {
+		if _, err := parseIOStats(data); err == nil {
+			t.Errorf("expected error parsing %q", data)
+		}
+	}
+}
+
+func TestReadVolumeStats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// sda is the DigitalOcean volume prueba, opened as the LUKS mapping dm-0
+	for _, d := range []string{"dev", "by-id", "mnt", "crypt", "sys/sda", "sys/dm-0/slaves/sda", "dev-block"} {
+		os.MkdirAll(filepath.Join(dir, d), 0700)
+	}
+	for _, d := range []string{"sda", "dm-0"} {
+		ioutil.WriteFile(filepath.Join(dir, "dev", d), nil, 0600)
+		ioutil.WriteFile(filepath.Join(dir, "sys", d, "stat"), []byte(diskStat), 0600)
+	}
+	os.Symlink(filepath.Join(dir, "dev", "sda"), filepath.Join(dir, "by-id", "scsi-0DO_Volume_prueba"))
+	os.Symlink(filepath.Join(dir, "dev", "sda"), filepath.Join(dir, "block"))
+	os.Symlink("../../devices/platform/host0/block/sda", filepath.Join(dir, "dev-block", "8:0"))
+	// pods get the device node bind mounted onto a file, a devtmpfs mount
+	pod := filepath.Join(dir, "pod")
+	ioutil.WriteFile(pod, nil, 0600)
+
+	f := newFakeExecutor()
+	mountdir := filepath.Join(dir, "mnt")
+	cryptdir := filepath.Join(dir, "crypt")
+	f.on(findmntCommand+mountdir, mountdir+" "+filepath.Join(dir, "dev", "sda")+" ext4 rw,relatime\n", nil)
+	f.on(findmntCommand+cryptdir, cryptdir+" "+filepath.Join(dir, "dev", "dm-0")+" ext4 rw,relatime\n", nil)
+	f.on(findmntCommand+filepath.Join(dir, "other"), "", exitError(1))
+	f.on(findmntCommand+pod, pod+" udev devtmpfs rw\n", nil)
+	r := &statsReader{
+		mounter:         &execMounter{exec: f},
+		sysBlockDevices: filepath.Join(dir, "sys"),
+		sysDevBlock:     filepath.Join(dir, "dev-block"),
+		devicePrefix:    filepath.Join(dir, "by-id", "scsi-0DO_Volume_"),
+		statfs: func(string) (*FilesystemStats, error) {
+			return &FilesystemStats{CapacityBytes: 1000, UsedBytes: 400, AvailableBytes: 550, Inodes: 10, InodesUsed: 4, InodesFree: 6}, nil
+		},
+		blockDeviceNumber: func(path string) (uint32, uint32, bool) {
+			return 8, 0, path == pod
+		},
+	}
+
+	s, err := r.read(mountdir)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if s.VolumeName != "prueba" || s.Device != filepath.Join(dir, "dev", "sda") || s.Filesystem == nil || s.Filesystem.UsedBytes != 400 ||
+		s.IO == nil || s.IO.ReadsCompleted != 2510 {
+		t.Errorf("unexpected stats %+v", s)
+	}
+
+	s, err = r.read(cryptdir)
+	if err != nil || s.VolumeName != "prueba" || s.Device != filepath.Join(dir, "dev", "dm-0") {
+		t.Errorf("expected encrypted volume stats but got %+v, %v", s, err)
+	}
+
+	// raw block volumes have no filesystem
+	s, err = r.read(filepath.Join(dir, "block"))
+	if err != nil || s.VolumeName != "prueba" || s.Filesystem != nil || s.IO == nil {
+		t.Errorf("expected block volume stats but got %+v, %v", s, err)
+	}
+
+	// block volumes at the pods are found from the device number, not the devtmpfs mount
+	s, err = r.read(pod)
+	if err != nil || s.VolumeName != "prueba" || s.Device != "/dev/sda" || s.Filesystem != nil || s.IO == nil || s.IO.ReadsCompleted != 2510 {
+		t.Errorf("expected block volume stats at the pod but got %+v, %v", s, err)
+	}
+
+	if _, err := r.read(filepath.Join(dir, "other")); err == nil {
+		t.Errorf("expected error when nothing is mounted")
+	}
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+// +build !linux
+
+package plugin
+
+import (
+	"errors"
+)
+
+// statfs is only implemented on linux, where volumes are mounted
+func statfs(dir string) (*FilesystemStats, error) {
+	return nil, errors.New("filesystem statistics are only supported on linux")
+}
+
+// blockDeviceNumber is only implemented on linux, where volumes are published
+func blockDeviceNumber(path string) (uint32, uint32, bool) {
+	return 0, 0, false
+}
@@ -0,0 +1,404 @@
+// Package provisioner creates DigitalOcean volumes for persistent volume
+// claims of the storage classes it handles, and deletes them when released.
+package provisioner
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/StackPointCloud/digitalocean-flex-volume/pkg/digitalocean/cloud"
+	"github.com/StackPointCloud/digitalocean-flex-volume/pkg/digitalocean/plugin"
+	"github.com/StackPointCloud/digitalocean-flex-volume/pkg/flex"
+	"github.com/golang/glog"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	storagelisters "k8s.io/client-go/listers/storage/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+)
+
+const (
+	// DefaultName is the storage class provisioner handled by default
+	DefaultName = "digitalocean.com/flex-volume"
+	// DefaultDriver is the flex driver set at provisioned persistent volumes
+	DefaultDriver = plugin.DriverName
+
+	// storage class parameters
+	paramRegion = "region"
+	paramFSType = "fsType"
+	paramTags   = "tags"
+
+	defaultFSType = "ext4"
+
+	provisionedByAnnotation    = "pv.kubernetes.io/provisioned-by"
+	betaStorageClassAnnotation = "volume.beta.kubernetes.io/storage-class"
+
+	claimKeyPrefix  = "claim/"
+	volumeKeyPrefix = "volume/"
+
+	gigabyte = 1 << 30
+)
+
+// supportedFSTypes are the filesystems DigitalOcean formats volumes with
+var supportedFSTypes = map[string]bool{"ext4": true, "xfs": true}
+
+// Options configures the provisioner, empty values use defaults
+type Options struct {
+	// Name is the storage class provisioner handled
+	Name string
+	// Driver is the flex driver name set at provisioned persistent volumes
+	Driver string
+	// ResyncPeriod is the interval every claim and volume is checked again
+	ResyncPeriod time.Duration
+}
+
+// Provisioner watches persistent volume claims to create DigitalOcean
+// volumes, and released persistent volumes to delete them
+type Provisioner struct {
+	client  kubernetes.Interface
+	cloud   cloud.Provider
+	options Options
+
+	factory informers.SharedInformerFactory
+	claims  corelisters.PersistentVolumeClaimLister
+	volumes corelisters.PersistentVolumeLister
+	classes storagelisters.StorageClassLister
+	synced  []cache.InformerSynced
+	queue   workqueue.RateLimitingInterface
+}
+
+// NewProvisioner returns a provisioner using the kubernetes client
+// and the DigitalOcean backend
+func NewProvisioner(client kubernetes.Interface, provider cloud.Provider, options Options) *Provisioner {
+	if options.Name == "" {
+		options.Name = DefaultName
+	}
+	if options.Driver == "" {
+		options.Driver = DefaultDriver
+	}
+
+	factory := informers.NewSharedInformerFactory(client, options.ResyncPeriod)
+	claimInformer := factory.Core().V1().PersistentVolumeClaims()
+	volumeInformer := factory.Core().V1().PersistentVolumes()
+	classInformer := factory.Storage().V1().StorageClasses()
+
+	p := &Provisioner{
+		client:  client,
+		cloud:   provider,
+		options: options,
+		factory: factory,
+		claims:  claimInformer.Lister(),
+		volumes: volumeInformer.Lister(),
+		classes: classInformer.Lister(),
+		synced: []cache.InformerSynced{
+			claimInformer.Informer().HasSynced,
+			volumeInformer.Informer().HasSynced,
+			classInformer.Informer().HasSynced,
+		},
+		queue: workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "digitalocean-provisioner"),
+	}
+
+	claimInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj interface{}) { p.enqueue(claimKeyPrefix, obj) },
+		UpdateFunc: func(_, obj interface{}) { p.enqueue(claimKeyPrefix, obj) },
+	})
+	volumeInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj interface{}) { p.enqueue(volumeKeyPrefix, obj) },
+		UpdateFunc: func(_, obj interface{}) { p.enqueue(volumeKeyPrefix, obj) },
+	})
+
+	return p
+}
+
+// Run starts the informers and processes claims and volumes with the
+// given number of workers until the stop channel is closed
+func (p *Provisioner) Run(workers int, stopCh <-chan struct{}) error {
+	defer utilruntime.HandleCrash()
+	defer p.queue.ShutDown()
+
+	glog.Infof("starting DigitalOcean provisioner %q", p.options.Name)
+	p.factory.Start(stopCh)
+	if !cache.WaitForCacheSync(stopCh, p.synced...) {
+		return fmt.Errorf("could not sync kubernetes informer caches")
+	}
+
+	for i := 0; i < workers; i++ {
+		go wait.Until(p.work, time.Second, stopCh)
+	}
+
+	<-stopCh
+	glog.Infof("stopping DigitalOcean provisioner %q", p.options.Name)
+	return nil
+}
+
+func (p *Provisioner) enqueue(prefix string, obj interface{}) {
+	key, err := cache.MetaNamespaceKeyFunc(obj)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+	p.queue.Add(prefix + key)
+}
+
+// work processes queued keys until the queue is shut down
+func (p *Provisioner) work() {
+	for p.processNext() {
+	}
+}
+
+func (p *Provisioner) processNext() bool {
+	item, quit := p.queue.Get()
+	if quit {
+		return false
+	}
+	defer p.queue.Done(item)
+
+	key := item.(string)
+	var err error
+	switch {
+	case strings.HasPrefix(key, claimKeyPrefix):
+		err = p.syncClaim(strings.TrimPrefix(key, claimKeyPrefix))
+	case strings.HasPrefix(key, volumeKeyPrefix):
+		err = p.syncVolume(strings.TrimPrefix(key, volumeKeyPrefix))
+	}
+
+	if err != nil {
+		glog.Errorf("error syncing %s, will retry: %s", key, err.Error())
+		p.queue.AddRateLimited(item)
+		return true
+	}
+	p.queue.Forget(item)
+	return true
+}
+
+// syncClaim provisions a volume for an unbound claim of a handled storage class
+func (p *Provisioner) syncClaim(key string) error {
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return err
+	}
+	claim, err := p.claims.PersistentVolumeClaims(namespace).Get(name)
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if claim.Spec.VolumeName != "" || claim.DeletionTimestamp != nil {
+		return nil
+	}
+	className := claimClass(claim)
+	if className == "" {
+		return nil
+	}
+	class, err := p.classes.Get(className)
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if class.Provisioner != p.options.Name {
+		return nil
+	}
+
+	// persistent volumes are named after the claim UID, so an existing
+	// volume means the claim was provisioned and is waiting to be bound
+	pvName := volumeName(claim)
+	if _, err := p.volumes.Get(pvName); err == nil {
+		return nil
+	}
+
+	pv, err := p.provision(claim, class)
+	if err != nil {
+		return err
+	}
+
+	_, err = p.client.CoreV1().PersistentVolumes().Create(context.TODO(), pv, metav1.CreateOptions{})
+	if err != nil && !apierrors.IsAlreadyExists(err) {
+		return err
+	}
+	glog.Infof("provisioned persistent volume %q for claim %s", pvName, key)
+	return nil
+}
+
+// provision creates the DigitalOcean volume and returns the persistent volume for it.
+// The volume is reused if a previous attempt created it but not the persistent volume.
+func (p *Provisioner) provision(claim *v1.PersistentVolumeClaim, class *storagev1.StorageClass) (*v1.PersistentVolume, error) {
+	request, err := volumeRequest(claim, class)
+	if err != nil {
+		return nil, err
+	}
+
+	// look the volume up where it is created, not at this droplet's region
+	vol, err := p.cloud.GetVolumeByName(request.Name, request.Region)
+	if fe, ok := err.(*flex.Error); ok && fe.Code == flex.ErrorCodeNotFound {
+		vol, err = p.cloud.CreateVolume(request)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	reclaimPolicy := v1.PersistentVolumeReclaimDelete
+	if class.ReclaimPolicy != nil {
+		reclaimPolicy = *class.ReclaimPolicy
+	}
+
+	return &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: request.Name,
+			Annotations: map[string]string{
+				provisionedByAnnotation: p.options.Name,
+			},
+		},
+		Spec: v1.PersistentVolumeSpec{
+			Capacity: v1.ResourceList{
+				v1.ResourceStorage: *resource.NewQuantity(vol.SizeGigaBytes*gigabyte, resource.BinarySI),
+			},
+			AccessModes:                   claim.Spec.AccessModes,
+			PersistentVolumeReclaimPolicy: reclaimPolicy,
+			StorageClassName:              class.Name,
+			MountOptions:                  class.MountOptions,
+			ClaimRef: &v1.ObjectReference{
+				Kind:            "PersistentVolumeClaim",
+				APIVersion:      "v1",
+				Namespace:       claim.Namespace,
+				Name:            claim.Name,
+				UID:             claim.UID,
+				ResourceVersion: claim.ResourceVersion,
+			},
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				FlexVolume: &v1.FlexPersistentVolumeSource{
+					Driver: p.options.Driver,
+					FSType: request.FilesystemType,
+					Options: map[string]string{
+						plugin.VolumeIDOption:   vol.ID,
+						plugin.VolumeNameOption: vol.Name,
+					},
+				},
+			},
+		},
+	}, nil
+}
+
+// syncVolume deletes the DigitalOcean volume and the persistent
+// volume when a provisioned volume with a delete policy is released
+func (p *Provisioner) syncVolume(name string) error {
+	pv, err := p.volumes.Get(name)
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if pv.Annotations[provisionedByAnnotation] != p.options.Name ||
+		pv.Status.Phase != v1.VolumeReleased ||
+		pv.Spec.PersistentVolumeReclaimPolicy != v1.PersistentVolumeReclaimDelete {
+		return nil
+	}
+
+	if pv.Spec.FlexVolume == nil || pv.Spec.FlexVolume.Options[plugin.VolumeIDOption] == "" {
+		return fmt.Errorf("persistent volume %q has no DigitalOcean %s", name, plugin.VolumeIDOption)
+	}
+	volumeID := pv.Spec.FlexVolume.Options[plugin.VolumeIDOption]
+
+	// attached volumes can not be deleted, the error is retried until detached
+	err = p.cloud.DeleteVolume(volumeID)
+	if fe, ok := err.(*flex.Error); ok && fe.Code == flex.ErrorCodeNotFound {
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+
+	err = p.client.CoreV1().PersistentVolumes().Delete(context.TODO(), name, metav1.DeleteOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	glog.Infof("deleted persistent volume %q and DigitalOcean volume %q", name, volumeID)
+	return nil
+}
+
+// volumeRequest returns the DigitalOcean volume request for the claim
+func volumeRequest(claim *v1.PersistentVolumeClaim, class *storagev1.StorageClass) (*cloud.VolumeRequest, error) {
+	for _, mode := range claim.Spec.AccessModes {
+		if mode != v1.ReadWriteOnce {
+			return nil, fmt.Errorf("DigitalOcean volumes only support %s access mode, claim requested %s", v1.ReadWriteOnce, mode)
+		}
+	}
+	if claim.Spec.Selector != nil {
+		return nil, fmt.Errorf("claims with a selector are not supported")
+	}
+
+	size, ok := claim.Spec.Resources.Requests[v1.ResourceStorage]
+	if !ok {
+		return nil, fmt.Errorf("claim does not request %s", v1.ResourceStorage)
+	}
+
+	request := &cloud.VolumeRequest{
+		Name:           volumeName(claim),
+		Description:    fmt.Sprintf("kubernetes claim %s/%s", claim.Namespace, claim.Name),
+		SizeGigabytes:  sizeGigabytes(size.Value()),
+		FilesystemType: defaultFSType,
+	}
+
+	for k, v := range class.Parameters {
+		switch k {
+		case paramRegion:
+			request.Region = strings.TrimSpace(v)
+		case paramFSType:
+			fsType := strings.ToLower(strings.TrimSpace(v))
+			if !supportedFSTypes[fsType] {
+				return nil, fmt.Errorf("unsupported storage class %s %q", paramFSType, v)
+			}
+			request.FilesystemType = fsType
+		case paramTags:
+			for _, tag := range strings.Split(v, ",") {
+				if tag = strings.TrimSpace(tag); tag != "" {
+					request.Tags = append(request.Tags, tag)
+				}
+			}
+		default:
+			return nil, fmt.Errorf("unknown storage class parameter %q", k)
+		}
+	}
+	return request, nil
+}
+
+// claimClass returns the claim storage class name, including the beta annotation
+func claimClass(claim *v1.PersistentVolumeClaim) string {
+	if class, ok := claim.Annotations[betaStorageClassAnnotation]; ok {
+		return class
+	}
+	if claim.Spec.StorageClassName != nil {
+		return *claim.Spec.StorageClassName
+	}
+	return ""
+}
+
+// volumeName returns the persistent volume and DigitalOcean volume name for the claim
+func volumeName(claim *v1.PersistentVolumeClaim) string {
+	return "pvc-" + string(claim.UID)
+}
+
+// sizeGigabytes rounds the size up to gigabytes, DigitalOcean volumes
+// are at least a gigabyte
+func sizeGigabytes(size int64) int64 {
+	gb := (size + gigabyte - 1) / gigabyte
+	if gb < 1 {
+		gb = 1
+	}
+	return gb
+}
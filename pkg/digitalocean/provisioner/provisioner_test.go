@@ -0,0 +1,294 @@
+package provisioner
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/StackPointCloud/digitalocean-flex-volume/pkg/digitalocean/cloud/fake"
+	"github.com/StackPointCloud/digitalocean-flex-volume/pkg/digitalocean/plugin"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func newClass(name, provisioner string, parameters map[string]string) *storagev1.StorageClass {
+	return &storagev1.StorageClass{
+		ObjectMeta:  metav1.ObjectMeta{Name: name},
+		Provisioner: provisioner,
+		Parameters:  parameters,
+	}
+}
+
+func newClaim(name, class, size string) *v1.PersistentVolumeClaim {
+	return &v1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "default",
+			UID:       types.UID("uid-" + name),
+		},
+		Spec: v1.PersistentVolumeClaimSpec{
+			StorageClassName: &class,
+			AccessModes:      []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce},
+			Resources: v1.VolumeResourceRequirements{
+				Requests: v1.ResourceList{v1.ResourceStorage: resource.MustParse(size)},
+			},
+		},
+	}
+}
+
+// newTestProvisioner returns a provisioner whose listers are filled with the objects
+func newTestProvisioner(t *testing.T, objects ...interface{}) (*Provisioner, *k8sfake.Clientset, *fake.Provider) {
+	client := k8sfake.NewSimpleClientset()
+	provider := fake.NewProvider("nyc1")
+	p := NewProvisioner(client, provider, Options{})
+
+	for _, obj := range objects {
+		var err error
+		switch o := obj.(type) {
+		case *v1.PersistentVolumeClaim:
+			_, err = client.CoreV1().PersistentVolumeClaims(o.Namespace).Create(context.TODO(), o, metav1.CreateOptions{})
+			if err == nil {
+				err = p.factory.Core().V1().PersistentVolumeClaims().Informer().GetIndexer().Add(o)
+			}
+		case *v1.PersistentVolume:
+			_, err = client.CoreV1().PersistentVolumes().Create(context.TODO(), o, metav1.CreateOptions{})
+			if err == nil {
+				err = p.factory.Core().V1().PersistentVolumes().Informer().GetIndexer().Add(o)
+			}
+		case *storagev1.StorageClass:
+			err = p.factory.Storage().V1().StorageClasses().Informer().GetIndexer().Add(o)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return p, client, provider
+}
+
+func TestSyncClaim(t *testing.T) {
+	retain := v1.PersistentVolumeReclaimRetain
+	retainClass := newClass("retain", DefaultName, nil)
+	retainClass.ReclaimPolicy = &retain
+
+	p, client, provider := newTestProvisioner(t,
+		newClass("do", DefaultName, map[string]string{"region": "sfo2", "fsType": "xfs", "tags": "k8s, prod"}),
+		retainClass,
+		newClass("other", "kubernetes.io/aws-ebs", nil),
+		newClaim("data", "do", "1500Mi"),
+		newClaim("kept", "retain", "1Gi"),
+		newClaim("ebs", "other", "1Gi"),
+	)
+
+	if err := p.syncClaim("default/data"); err != nil {
+		t.Fatalf("unexpected error provisioning claim: %s", err)
+	}
+	pv, err := client.CoreV1().PersistentVolumes().Get(context.TODO(), "pvc-uid-data", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("expected provisioned persistent volume: %s", err)
+	}
+
+	volumes := provider.Volumes()
+	if len(volumes) != 1 {
+		t.Fatalf("expected 1 DigitalOcean volume but got %d", len(volumes))
+	}
+	vol := volumes[0]
+	if vol.Name != "pvc-uid-data" || vol.SizeGigaBytes != 2 || vol.Region.Slug != "sfo2" {
+		t.Errorf("unexpected DigitalOcean volume %+v", vol)
+	}
+	request, _ := provider.CreateRequest(vol.ID)
+	if request.FilesystemType != "xfs" || len(request.Tags) != 2 || request.Tags[1] != "prod" {
+		t.Errorf("expected filesystem type and tags to be requested but got %+v", request)
+	}
+
+	flexSource := pv.Spec.FlexVolume
+	if flexSource == nil || flexSource.Driver != DefaultDriver || flexSource.FSType != "xfs" ||
+		flexSource.Options[plugin.VolumeIDOption] != vol.ID || flexSource.Options[plugin.VolumeNameOption] != vol.Name {
+		t.Errorf("unexpected flex volume source %+v", flexSource)
+	}
+	if pv.Spec.ClaimRef == nil || pv.Spec.ClaimRef.UID != "uid-data" {
+		t.Errorf("expected persistent volume bound to the claim but got %+v", pv.Spec.ClaimRef)
+	}
+	if pv.Spec.PersistentVolumeReclaimPolicy != v1.PersistentVolumeReclaimDelete {
+		t.Errorf("expected delete reclaim policy but got %s", pv.Spec.PersistentVolumeReclaimPolicy)
+	}
+	if size := pv.Spec.Capacity[v1.ResourceStorage]; size.Cmp(resource.MustParse("2Gi")) != 0 {
+		t.Errorf("expected 2Gi capacity but got %s", size.String())
+	}
+
+	if err := p.syncClaim("default/kept"); err != nil {
+		t.Fatalf("unexpected error provisioning claim: %s", err)
+	}
+	pv, err = client.CoreV1().PersistentVolumes().Get(context.TODO(), "pvc-uid-kept", metav1.GetOptions{})
+	if err != nil || pv.Spec.PersistentVolumeReclaimPolicy != v1.PersistentVolumeReclaimRetain {
+		t.Errorf("expected retained persistent volume but got %+v, %v", pv, err)
+	}
+
+	// claims of other provisioners are ignored
+	if err := p.syncClaim("default/ebs"); err != nil {
+		t.Fatalf("unexpected error syncing claim: %s", err)
+	}
+	if _, err := client.CoreV1().PersistentVolumes().Get(context.TODO(), "pvc-uid-ebs", metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("expected no persistent volume for other provisioners but got %v", err)
+	}
+	if n := provider.Calls(fake.MethodCreateVolume); n != 2 {
+		t.Errorf("expected 2 created volumes but got %d", n)
+	}
+}
+
+func TestSyncClaimRetries(t *testing.T) {
+	p, client, provider := newTestProvisioner(t,
+		newClass("do", DefaultName, nil),
+		newClass("far", DefaultName, map[string]string{"region": "sfo2"}),
+		newClaim("data", "do", "1Gi"),
+		newClaim("remote", "far", "1Gi"),
+	)
+
+	// a volume created by a failed attempt is reused
+	provider.AddVolume("id0123456789", "pvc-uid-data", 1)
+	if err := p.syncClaim("default/data"); err != nil {
+		t.Fatalf("unexpected error provisioning claim: %s", err)
+	}
+	pv, err := client.CoreV1().PersistentVolumes().Get(context.TODO(), "pvc-uid-data", metav1.GetOptions{})
+	if err != nil || pv.Spec.FlexVolume.Options[plugin.VolumeIDOption] != "id0123456789" {
+		t.Errorf("expected persistent volume for the existing volume but got %+v, %v", pv, err)
+	}
+	if n := provider.Calls(fake.MethodCreateVolume); n != 0 {
+		t.Errorf("expected no created volumes but got %d", n)
+	}
+
+	// volumes of classes at other regions are found where they were created
+	failed := false
+	client.PrependReactor("create", "persistentvolumes", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if failed {
+			return false, nil, nil
+		}
+		failed = true
+		return true, nil, errors.New("connection refused")
+	})
+	if err := p.syncClaim("default/remote"); err == nil {
+		t.Fatalf("expected error creating the persistent volume")
+	}
+	if err := p.syncClaim("default/remote"); err != nil {
+		t.Fatalf("unexpected error retrying claim: %s", err)
+	}
+	if _, err := client.CoreV1().PersistentVolumes().Get(context.TODO(), "pvc-uid-remote", metav1.GetOptions{}); err != nil {
+		t.Errorf("expected provisioned persistent volume: %s", err)
+	}
+	if n := provider.Calls(fake.MethodCreateVolume); n != 1 {
+		t.Errorf("expected 1 created volume but got %d", n)
+	}
+}
+
+func TestVolumeRequestErrors(t *testing.T) {
+	class := newClass("do", DefaultName, nil)
+	cases := []struct {
+		name       string
+		parameters map[string]string
+		modes      []v1.PersistentVolumeAccessMode
+	}{
+		{"unknown parameter", map[string]string{"zone": "a"}, nil},
+		{"unsupported filesystem", map[string]string{"fsType": "btrfs"}, nil},
+		{"shared access", nil, []v1.PersistentVolumeAccessMode{v1.ReadWriteMany}},
+	}
+	for _, c := range cases {
+		class.Parameters = c.parameters
+		claim := newClaim("data", "do", "1Gi")
+		if c.modes != nil {
+			claim.Spec.AccessModes = c.modes
+		}
+		if _, err := volumeRequest(claim, class); err == nil {
+			t.Errorf("%s: expected error", c.name)
+		}
+	}
+}
+
+func TestSyncVolume(t *testing.T) {
+	released := func(name, volumeID, provisioner string, policy v1.PersistentVolumeReclaimPolicy) *v1.PersistentVolume {
+		return &v1.PersistentVolume{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        name,
+				Annotations: map[string]string{provisionedByAnnotation: provisioner},
+			},
+			Spec: v1.PersistentVolumeSpec{
+				PersistentVolumeReclaimPolicy: policy,
+				PersistentVolumeSource: v1.PersistentVolumeSource{
+					FlexVolume: &v1.FlexPersistentVolumeSource{
+						Driver:  DefaultDriver,
+						Options: map[string]string{plugin.VolumeIDOption: volumeID},
+					},
+				},
+			},
+			Status: v1.PersistentVolumeStatus{Phase: v1.VolumeReleased},
+		}
+	}
+
+	p, client, provider := newTestProvisioner(t,
+		released("deleted", "id-deleted", DefaultName, v1.PersistentVolumeReclaimDelete),
+		released("retained", "id-retained", DefaultName, v1.PersistentVolumeReclaimRetain),
+		released("foreign", "id-foreign", "other", v1.PersistentVolumeReclaimDelete),
+		released("gone", "id-gone", DefaultName, v1.PersistentVolumeReclaimDelete),
+	)
+	provider.AddDroplet(1, "node-1", "", "")
+	provider.AddVolume("id-deleted", "deleted", 1)
+	provider.AddVolume("id-retained", "retained", 1)
+	provider.AddVolume("id-foreign", "foreign", 1)
+
+	// attached volumes are retried until detached
+	provider.AttachVolumeAndWait("id-deleted", 1)
+	if err := p.syncVolume("deleted"); err == nil {
+		t.Errorf("expected error deleting an attached volume")
+	}
+	provider.DetachVolumeAndWait("id-deleted", 1)
+
+	for _, name := range []string{"deleted", "retained", "foreign", "gone"} {
+		if err := p.syncVolume(name); err != nil {
+			t.Errorf("unexpected error syncing volume %q: %s", name, err)
+		}
+	}
+
+	if volumes := provider.Volumes(); len(volumes) != 2 {
+		t.Errorf("expected 2 remaining DigitalOcean volumes but got %d", len(volumes))
+	}
+	for _, name := range []string{"deleted", "gone"} {
+		if _, err := client.CoreV1().PersistentVolumes().Get(context.TODO(), name, metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+			t.Errorf("expected persistent volume %q to be deleted but got %v", name, err)
+		}
+	}
+	for _, name := range []string{"retained", "foreign"} {
+		if _, err := client.CoreV1().PersistentVolumes().Get(context.TODO(), name, metav1.GetOptions{}); err != nil {
+			t.Errorf("expected persistent volume %q to be kept but got %v", name, err)
+		}
+	}
+}
+
+func TestRun(t *testing.T) {
+	client := k8sfake.NewSimpleClientset(newClass("do", DefaultName, nil))
+	provider := fake.NewProvider("nyc1")
+	p := NewProvisioner(client, provider, Options{})
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go p.Run(1, stopCh)
+
+	claim := newClaim("data", "do", "1Gi")
+	if _, err := client.CoreV1().PersistentVolumeClaims("default").Create(context.TODO(), claim, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	err := wait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		_, err := client.CoreV1().PersistentVolumes().Get(context.TODO(), "pvc-uid-data", metav1.GetOptions{})
+		return err == nil, nil
+	})
+	if err != nil {
+		t.Errorf("expected persistent volume to be provisioned: %s", err)
+	}
+}
@@ -0,0 +1,74 @@
+package flex
+
+import "fmt"
+
+// Error codes reported at the driver status
+const (
+	ErrorCodeRateLimited    = "RateLimited"
+	ErrorCodeAPIUnavailable = "APIUnavailable"
+	ErrorCodeAPIError       = "APIError"
+	ErrorCodeUnauthorized   = "Unauthorized"
+	ErrorCodeNotFound       = "NotFound"
+	ErrorCodeActionFailed   = "ActionFailed"
+	ErrorCodeTimeout        = "Timeout"
+	ErrorCodeMetadata       = "MetadataUnavailable"
+	ErrorCodeInvalidOptions = "InvalidOptions"
+	ErrorCodeDeviceNotFound = "DeviceNotFound"
+	ErrorCodeNotBlockDevice = "NotBlockDevice"
+	ErrorCodeDeviceMismatch = "DeviceMismatch"
+	ErrorCodeCommandFailed  = "CommandFailed"
+	ErrorCodeFormatFailed   = "FormatFailed"
+	ErrorCodeFormatMismatch = "FormatMismatch"
+	ErrorCodeFsckFailed     = "FsckFailed"
+	ErrorCodeMountFailed    = "MountFailed"
+	ErrorCodeUnmountFailed  = "UnmountFailed"
+	ErrorCodeStaleMount     = "StaleMount"
+	ErrorCodeResizeFailed   = "ResizeFailed"
+)
+
+// Error is a machine readable driver error
+type Error struct {
+	// Code classifies the error, see ErrorCode constants
+	Code string
+	// Message is the human readable description
+	Message string
+	// Retryable is true when the operation might succeed if retried
+	Retryable bool
+	// RequestID is the DigitalOcean API request ID, if any
+	RequestID string
+}
+
+// NewError returns a non retryable driver error
+func NewError(code string, format string, a ...interface{}) *Error {
+	return &Error{
+		Code:    code,
+		Message: fmt.Sprintf(format, a...),
+	}
+}
+
+// NewRetryableError returns a driver error for operations that might succeed if retried
+func NewRetryableError(code string, format string, a ...interface{}) *Error {
+	e := NewError(code, format, a...)
+	e.Retryable = true
+	return e
+}
+
+// Error returns the error message
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// NewErrorStatus returns a failure driver status for the error,
+// filling the error code fields when the error is a driver Error
+func NewErrorStatus(e error) *DriverStatus {
+	ds := &DriverStatus{
+		Status:  StatusFailure,
+		Message: e.Error(),
+	}
+	if fe, ok := e.(*Error); ok {
+		ds.Code = fe.Code
+		ds.Retryable = fe.Retryable
+		ds.RequestID = fe.RequestID
+	}
+	return ds
+}
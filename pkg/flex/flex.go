@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"strconv"
 )
 
 // Status codes
@@ -26,6 +27,8 @@ const (
 	unmountDeviceCmd = "unmountdevice"
 	mountCmd         = "mount"
 	unmountCmd       = "unmount"
+	expandVolumeCmd  = "expandvolume"
+	expandFSCmd      = "expandfs"
 )
 
 // VolumePlugin defines the interface that the internal plugin must implement
@@ -40,6 +43,8 @@ type VolumePlugin interface {
 	UnmountDevice(device string) (*DriverStatus, error)
 	Mount(mountdir string, options string) (*DriverStatus, error)
 	Unmount(mountdir string) (*DriverStatus, error)
+	ExpandVolume(options string, newSize, oldSize int64) (*DriverStatus, error)
+	ExpandFS(options, device, mountdir string, newSize, oldSize int64) (*DriverStatus, error)
 }
 
 // DriverStatus represents the return value of the driver callout.
@@ -50,12 +55,16 @@ type DriverStatus struct {
 	VolumeName   string              `json:"volumeName,omitempty"`
 	Attached     bool                `json:"attached,omitempty"`
 	Capabilities *DriverCapabilities `json:",omitempty"`
+	Code         string              `json:"code,omitempty"`
+	Retryable    bool                `json:"retryable,omitempty"`
+	RequestID    string              `json:"requestID,omitempty"`
 }
 
 // DriverCapabilities stores Digital Ocean volume capabilities
 type DriverCapabilities struct {
-	Attach         bool `json:"attach"`
-	SELinuxRelabel bool `json:"selinuxRelabel"`
+	Attach           bool `json:"attach"`
+	SELinuxRelabel   bool `json:"selinuxRelabel"`
+	RequiresFSResize bool `json:"requiresFSResize"`
 }
 
 // Command contains all parameters needed to run a plugin operation
@@ -65,6 +74,8 @@ type Command struct {
 	device   string
 	mountdir string
 	options  string
+	newSize  int64
+	oldSize  int64
 }
 
 // NewFlexCommand given an argument list returns a Flex Command structure
@@ -115,6 +126,28 @@ func NewFlexCommand(args []string) (*Command, error) {
 	case unmountCmd:
 		fc.mountdir = fa[0]
 
+	case expandVolumeCmd:
+		// kubelet may pass the device mount path before the sizes,
+		// which is not needed to resize the volume at DigitalOcean
+		if len(fa) < 3 {
+			return nil, fmt.Errorf("%s needs options, new size and old size arguments", fc.command)
+		}
+		fc.options = fa[0]
+		if err := fc.parseSizes(fa[len(fa)-2:]); err != nil {
+			return nil, err
+		}
+
+	case expandFSCmd:
+		if len(fa) < 5 {
+			return nil, fmt.Errorf("%s needs options, device, mount dir, new size and old size arguments", fc.command)
+		}
+		fc.options = fa[0]
+		fc.device = fa[1]
+		fc.mountdir = fa[2]
+		if err := fc.parseSizes(fa[3:5]); err != nil {
+			return nil, err
+		}
+
 	default:
 		return nil, fmt.Errorf("command %q not recognized as a valid flex command", fc.command)
 	}
@@ -122,6 +155,21 @@ func NewFlexCommand(args []string) (*Command, error) {
 	return fc, nil
 }
 
+// parseSizes reads the new and old size in bytes from the arguments
+func (fc *Command) parseSizes(sizes []string) error {
+	newSize, err := strconv.ParseInt(sizes[0], 10, 64)
+	if err != nil {
+		return fmt.Errorf("could not parse new size %q: %s", sizes[0], err.Error())
+	}
+	oldSize, err := strconv.ParseInt(sizes[1], 10, 64)
+	if err != nil {
+		return fmt.Errorf("could not parse old size %q: %s", sizes[1], err.Error())
+	}
+	fc.newSize = newSize
+	fc.oldSize = oldSize
+	return nil
+}
+
 // Manager is able to execute flex commands
 type Manager struct {
 	output *os.File
@@ -139,12 +187,10 @@ func NewManager(plugin VolumePlugin, output *os.File) *Manager {
 // ExecuteCommand given the command and the plugin
 func (m *Manager) ExecuteCommand(fc *Command) (*DriverStatus, error) {
 	switch fc.command {
-	// case initCmd:
-	// 	return m.plugin.Init()
-	// case getVolumeNameCmd:
-	// 	return m.plugin.GetVolumeName(fc.options)
 	case initCmd:
 		return m.plugin.Init()
+	case getVolumeNameCmd:
+		return m.plugin.GetVolumeName(fc.options)
 	case attachCmd:
 		return m.plugin.Attach(fc.options, fc.nodeName)
 	case detachCmd:
@@ -161,6 +207,10 @@ func (m *Manager) ExecuteCommand(fc *Command) (*DriverStatus, error) {
 		return m.plugin.Mount(fc.mountdir, fc.options)
 	case unmountCmd:
 		return m.plugin.Unmount(fc.mountdir)
+	case expandVolumeCmd:
+		return m.plugin.ExpandVolume(fc.options, fc.newSize, fc.oldSize)
+	case expandFSCmd:
+		return m.plugin.ExpandFS(fc.options, fc.device, fc.mountdir, fc.newSize, fc.oldSize)
 	}
 	return &DriverStatus{
 		Status: StatusNotSupported,
@@ -169,10 +219,7 @@ func (m *Manager) ExecuteCommand(fc *Command) (*DriverStatus, error) {
 
 // WriteError creates a Flex response containing an error
 func (m *Manager) WriteError(e error) {
-	ds := &DriverStatus{
-		Status:  StatusFailure,
-		Message: e.Error(),
-	}
+	ds := NewErrorStatus(e)
 	j, err := json.Marshal(ds)
 	if err != nil {
 		fmt.Printf("could not return JSON encoded error message: %s", err.Error())
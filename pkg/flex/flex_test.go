@@ -1,6 +1,7 @@
 package flex
 
 import (
+	"fmt"
 	"reflect"
 	"testing"
 )
@@ -36,6 +37,48 @@ func TestNexFlexCommand(t *testing.T) {
 			},
 			false,
 		},
+		{
+			[]string{"cmd", "expandvolume", `{"volumeID":"id0123456789"}`, "10737418240", "5368709120"},
+			&Command{
+				command: "expandvolume",
+				options: `{"volumeID":"id0123456789"}`,
+				newSize: 10737418240,
+				oldSize: 5368709120,
+			},
+			false,
+		},
+		{
+			[]string{"cmd", "expandvolume", `{"volumeID":"id0123456789"}`, "/var/lib/kubelet/plugins/mnt", "10737418240", "5368709120"},
+			&Command{
+				command: "expandvolume",
+				options: `{"volumeID":"id0123456789"}`,
+				newSize: 10737418240,
+				oldSize: 5368709120,
+			},
+			false,
+		},
+		{
+			[]string{"cmd", "expandvolume", `{"volumeID":"id0123456789"}`, "10G", "5G"},
+			nil,
+			true,
+		},
+		{
+			[]string{"cmd", "expandfs", `{"volumeID":"id0123456789"}`, "/dev/disk/by-id/scsi-0DO_Volume_prueba", "/var/lib/kubelet/plugins/mnt", "10737418240", "5368709120"},
+			&Command{
+				command:  "expandfs",
+				options:  `{"volumeID":"id0123456789"}`,
+				device:   "/dev/disk/by-id/scsi-0DO_Volume_prueba",
+				mountdir: "/var/lib/kubelet/plugins/mnt",
+				newSize:  10737418240,
+				oldSize:  5368709120,
+			},
+			false,
+		},
+		{
+			[]string{"cmd", "expandfs", `{"volumeID":"id0123456789"}`, "/dev/disk/by-id/scsi-0DO_Volume_prueba"},
+			nil,
+			true,
+		},
 	}
 
 	for _, c := range cases {
@@ -61,3 +104,63 @@ func TestNexFlexCommand(t *testing.T) {
 		}
 	}
 }
+
+type fakePlugin struct {
+	VolumePlugin
+	volumeName string
+}
+
+func (f *fakePlugin) GetVolumeName(options string) (*DriverStatus, error) {
+	return &DriverStatus{Status: StatusSuccess, VolumeName: f.volumeName}, nil
+}
+
+func TestExecuteGetVolumeName(t *testing.T) {
+	m := NewManager(&fakePlugin{volumeName: "id0123456789"}, nil)
+	ds, err := m.ExecuteCommand(&Command{command: getVolumeNameCmd, options: "{}"})
+	if err != nil {
+		t.Fatalf("unexpected error executing getvolumename: %s", err)
+	}
+	if ds.Status != StatusSuccess || ds.VolumeName != "id0123456789" {
+		t.Errorf("expected volume name %q but got %+v", "id0123456789", ds)
+	}
+}
+
+func TestNewErrorStatus(t *testing.T) {
+	cases := []struct {
+		err      error
+		expected *DriverStatus
+	}{
+		{
+			fmt.Errorf("plain error"),
+			&DriverStatus{
+				Status:  StatusFailure,
+				Message: "plain error",
+			},
+		},
+		{
+			&Error{Code: ErrorCodeRateLimited, Message: "too many requests", Retryable: true, RequestID: "req-1"},
+			&DriverStatus{
+				Status:    StatusFailure,
+				Message:   "too many requests",
+				Code:      ErrorCodeRateLimited,
+				Retryable: true,
+				RequestID: "req-1",
+			},
+		},
+		{
+			NewError(ErrorCodeNotBlockDevice, "device %s is not a block device", "/dev/null"),
+			&DriverStatus{
+				Status:  StatusFailure,
+				Message: "device /dev/null is not a block device",
+				Code:    ErrorCodeNotBlockDevice,
+			},
+		},
+	}
+
+	for _, c := range cases {
+		ds := NewErrorStatus(c.err)
+		if !reflect.DeepEqual(ds, c.expected) {
+			t.Errorf("error %q expected driver status %+v but got %+v", c.err, c.expected, ds)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+// Package mountinfo reads the mount table of the current process from
+// /proc/self/mountinfo, without calling findmnt or mount.
+package mountinfo
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// File is the mount table of the current process
+const File = "/proc/self/mountinfo"
+
+// Mount is a mountinfo entry, see proc(5)
+type Mount struct {
+	ID     int
+	Parent int
+	Major  int
+	Minor  int
+	// Root is the path of the mounted directory within the filesystem
+	Root string
+	// Mountpoint is the mount point relative to the process root
+	Mountpoint string
+	// Options are the per mount options
+	Options string
+	FSType  string
+	// Source is the mounted device or the filesystem specific source
+	Source string
+	// SuperOptions are the per superblock options
+	SuperOptions string
+}
+
+// Read parses the mount table at file
+func Read(file string) ([]Mount, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Parse(f)
+}
+
+// Parse parses mountinfo content
+func Parse(r io.Reader) ([]Mount, error) {
+	mounts := []Mount{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		m, err := parseLine(line)
+		if err != nil {
+			return nil, err
+		}
+		mounts = append(mounts, m)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return mounts, nil
+}
+
+// parseLine parses a line such as
+// 36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw,errors=continue
+func parseLine(line string) (Mount, error) {
+	fields := strings.Fields(line)
+	separator := -1
+	for i, f := range fields {
+		if f == "-" && i >= 6 {
+			separator = i
+			break
+		}
+	}
+	if separator < 0 || len(fields) < separator+3 {
+		return Mount{}, fmt.Errorf("invalid mountinfo line %q", line)
+	}
+
+	m := Mount{
+		Root:       unescape(fields[3]),
+		Mountpoint: unescape(fields[4]),
+		Options:    fields[5],
+		FSType:     fields[separator+1],
+		Source:     unescape(fields[separator+2]),
+	}
+	if len(fields) > separator+3 {
+		m.SuperOptions = fields[separator+3]
+	}
+
+	var err error
+	if m.ID, err = strconv.Atoi(fields[0]); err != nil {
+		return Mount{}, fmt.Errorf("invalid mount ID at mountinfo line %q", line)
+	}
+	if m.Parent, err = strconv.Atoi(fields[1]); err != nil {
+		return Mount{}, fmt.Errorf("invalid parent mount ID at mountinfo line %q", line)
+	}
+	device := strings.Split(fields[2], ":")
+	if len(device) != 2 {
+		return Mount{}, fmt.Errorf("invalid device number at mountinfo line %q", line)
+	}
+	if m.Major, err = strconv.Atoi(device[0]); err != nil {
+		return Mount{}, fmt.Errorf("invalid device major at mountinfo line %q", line)
+	}
+	if m.Minor, err = strconv.Atoi(device[1]); err != nil {
+		return Mount{}, fmt.Errorf("invalid device minor at mountinfo line %q", line)
+	}
+	return m, nil
+}
+
+// unescape decodes the octal escapes used for spaces, tabs,
+// new lines and backslashes in paths
+func unescape(s string) string {
+	if !strings.Contains(s, "\\") {
+		return s
+	}
+	b := []byte{}
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if v, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b = append(b, byte(v))
+				i += 3
+				continue
+			}
+		}
+		b = append(b, s[i])
+	}
+	return string(b)
+}
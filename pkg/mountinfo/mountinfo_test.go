@@ -0,0 +1,71 @@
+package mountinfo
+
+import (
+	"strings"
+	"testing"
+)
+
+const sample = `22 1 8:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw,errors=remount-ro
+36 22 98:0 /mnt1 /mnt\0402 rw,noatime master:1 - ext3 /dev/root rw,errors=continue
+40 22 8:16 / /var/lib/kubelet/plugins/kubernetes.io/flexvolume/digitalocean/flex-volume/mounts/pvc-1 rw,relatime shared:20 - xfs /dev/sdb rw,attr2,inode64,noquota
+41 22 0:45 / /run rw,nosuid - tmpfs tmpfs rw
+`
+
+func TestParse(t *testing.T) {
+	mounts, err := Parse(strings.NewReader(sample))
+	if err != nil {
+		t.Fatalf("unexpected error parsing mountinfo: %s", err)
+	}
+	if len(mounts) != 4 {
+		t.Fatalf("expected 4 mounts but got %d", len(mounts))
+	}
+
+	m := mounts[1]
+	expected := Mount{
+		ID:           36,
+		Parent:       22,
+		Major:        98,
+		Minor:        0,
+		Root:         "/mnt1",
+		Mountpoint:   "/mnt 2",
+		Options:      "rw,noatime",
+		FSType:       "ext3",
+		Source:       "/dev/root",
+		SuperOptions: "rw,errors=continue",
+	}
+	if m != expected {
+		t.Errorf("expected mount %+v but got %+v", expected, m)
+	}
+	if mounts[2].Source != "/dev/sdb" || mounts[2].FSType != "xfs" || mounts[2].Minor != 16 {
+		t.Errorf("unexpected mount %+v", mounts[2])
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	lines := []string{
+		"22 1 8:1 / / rw,relatime shared:1 ext4 /dev/sda1 rw",
+		"a 1 8:1 / / rw - ext4 /dev/sda1 rw",
+		"22 1 81 / / rw - ext4 /dev/sda1 rw",
+		"22 1 8:1 / / rw -",
+	}
+	for _, l := range lines {
+		if _, err := Parse(strings.NewReader(l)); err == nil {
+			t.Errorf("expected error parsing %q", l)
+		}
+	}
+}
+
+func TestUnescape(t *testing.T) {
+	cases := map[string]string{
+		`/plain`:        "/plain",
+		`/a\040b`:       "/a b",
+		`/tab\011`:      "/tab\t",
+		`/back\134side`: `/back\side`,
+		`/short\04`:     `/short\04`,
+	}
+	for in, expected := range cases {
+		if out := unescape(in); out != expected {
+			t.Errorf("unescape %q expected %q but got %q", in, expected, out)
+		}
+	}
+}